@@ -0,0 +1,122 @@
+package soju
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const auditSourceSojuctl = "sojuctl"
+
+// audit records an action performed via a downstream connection in the audit
+// log. actionErr is the outcome of the action.
+func (dc *downstreamConn) audit(ctx context.Context, action, target, details string, actionErr error) {
+	entry := AuditEntry{
+		Time:    time.Now(),
+		Actor:   dc.user.Username,
+		Source:  dc.RemoteAddr().String(),
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+
+	if err := dc.srv.db.StoreAuditEntry(ctx, &entry); err != nil {
+		dc.logger.Errorf("failed to store audit log entry for %v: %v", action, err)
+	}
+}
+
+// RecordSojuctlAudit records an action performed via sojuctl in the audit
+// log.
+func RecordSojuctlAudit(ctx context.Context, db Database, action, target string, actionErr error) error {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Source: auditSourceSojuctl,
+		Action: action,
+		Target: target,
+	}
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+	return db.StoreAuditEntry(ctx, &entry)
+}
+
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected an RFC 3339 timestamp, a date or a duration", s)
+}
+
+// ParseAuditFilter parses audit log filter flags: -actor, -target, -action,
+// -since, -until and -limit. Times can be RFC 3339 timestamps, dates or
+// durations relative to now.
+func ParseAuditFilter(args []string) (*AuditFilter, error) {
+	filter := &AuditFilter{Limit: 50}
+
+	fs := newFlagSet()
+	fs.StringVar(&filter.Actor, "actor", "", "")
+	fs.StringVar(&filter.Target, "target", "", "")
+	fs.StringVar(&filter.Action, "action", "", "")
+	since := fs.String("since", "", "")
+	until := fs.String("until", "", "")
+	fs.IntVar(&filter.Limit, "limit", filter.Limit, "")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if len(fs.Args()) > 0 {
+		return nil, fmt.Errorf("unexpected argument")
+	}
+
+	var err error
+	if *since != "" {
+		if filter.Since, err = parseAuditTime(*since); err != nil {
+			return nil, err
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = parseAuditTime(*until); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+// FormatAuditEntry formats an audit log entry on a single line.
+func FormatAuditEntry(entry *AuditEntry) string {
+	var sb strings.Builder
+	sb.WriteString(entry.Time.Local().Format(time.RFC3339))
+	sb.WriteString(" ")
+	if entry.Actor != "" {
+		sb.WriteString(entry.Actor)
+	} else {
+		sb.WriteString("-")
+	}
+	if entry.Source != "" {
+		sb.WriteString(" (" + entry.Source + ")")
+	}
+	sb.WriteString(" " + entry.Action)
+	if entry.Target != "" {
+		sb.WriteString(" " + strconv.Quote(entry.Target))
+	}
+	if entry.Details != "" {
+		sb.WriteString(": " + entry.Details)
+	}
+	if entry.Error != "" {
+		sb.WriteString(" [failed: " + entry.Error + "]")
+	} else {
+		sb.WriteString(" [ok]")
+	}
+	return sb.String()
+}
@@ -0,0 +1,311 @@
+package soju
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	backupDBName  = "db.json"
+	backupLogsDir = "logs"
+)
+
+// logFileSnapshot records the size of a message log file at the time of a
+// backup. Log files are append-only, so the file can be copied up to that
+// size later on.
+type logFileSnapshot struct {
+	path string // relative to the logs root
+	size int64
+	mode os.FileMode
+	time time.Time
+}
+
+func snapshotLogs(root string) ([]logFileSnapshot, error) {
+	var files []logFileSnapshot
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, logFileSnapshot{
+			path: filepath.ToSlash(rel),
+			size: fi.Size(),
+			mode: fi.Mode().Perm(),
+			time: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list message logs: %v", err)
+	}
+	return files, nil
+}
+
+// writeBackupArchive writes a gzipped tar archive containing a database dump
+// and message log files.
+func writeBackupArchive(w io.Writer, dump *dbDump, logRoot string, logFiles []logFileSnapshot) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	b, err := json.Marshal(dump)
+	if err != nil {
+		return fmt.Errorf("failed to encode database dump: %v", err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupDBName,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	for _, lf := range logFiles {
+		if err := writeBackupLogFile(tw, logRoot, lf); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeBackupLogFile(tw *tar.Writer, root string, lf logFileSnapshot) error {
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(lf.path)))
+	if err != nil {
+		return fmt.Errorf("failed to open message log file: %v", err)
+	}
+	defer f.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    path.Join(backupLogsDir, lf.path),
+		Mode:    int64(lf.mode),
+		Size:    lf.size,
+		ModTime: lf.time,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, f, lf.size); err != nil {
+		return fmt.Errorf("failed to copy message log file %q: %v", lf.path, err)
+	}
+	return nil
+}
+
+// WriteBackup writes a backup archive of a database and, if logPath isn't
+// empty, of the message logs. The archive is only consistent if the bouncer
+// isn't running, see Server.Backup otherwise.
+func WriteBackup(ctx context.Context, w io.Writer, db Database, logPath string) error {
+	dump, err := dumpDB(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	var logFiles []logFileSnapshot
+	if logPath != "" {
+		if logFiles, err = snapshotLogs(logPath); err != nil {
+			return err
+		}
+	}
+
+	return writeBackupArchive(w, dump, logPath, logFiles)
+}
+
+// Backup writes a consistent backup archive while the bouncer is running.
+// User goroutines are paused while the database is dumped, so that no
+// message is logged and no delivery receipt is stored in the meantime. The
+// message logs are included if withLogs is set.
+//
+// caller is the user running the backup, if any: its goroutine is busy with
+// the backup, so it can't be paused.
+func (s *Server) Backup(ctx context.Context, w io.Writer, withLogs bool, caller *user) error {
+	if withLogs && s.Config().LogPath == "" {
+		return fmt.Errorf("message logging is disabled")
+	}
+
+	resume, err := s.pauseUsers(ctx, caller)
+	if err != nil {
+		return err
+	}
+	if caller != nil {
+		caller.flushDeliveryReceipts()
+	}
+
+	dump, err := dumpDB(ctx, s.db)
+	var logFiles []logFileSnapshot
+	if err == nil && withLogs {
+		logFiles, err = snapshotLogs(s.Config().LogPath)
+	}
+	resume()
+	if err != nil {
+		return err
+	}
+
+	return writeBackupArchive(w, dump, s.Config().LogPath, logFiles)
+}
+
+// pauseUsers pauses the goroutines of all users except one. The returned
+// function resumes them.
+func (s *Server) pauseUsers(ctx context.Context, except *user) (resume func(), err error) {
+	var users []*user
+	s.forEachUser(func(u *user) {
+		if u != except {
+			users = append(users, u)
+		}
+	})
+
+	resumeCh := make(chan struct{})
+	resume = func() {
+		close(resumeCh)
+	}
+
+	for _, u := range users {
+		paused := make(chan struct{})
+		event := eventPause{paused: paused, resume: resumeCh}
+		select {
+		case u.events <- event:
+		case <-u.done:
+			continue
+		case <-ctx.Done():
+			resume()
+			return nil, ctx.Err()
+		}
+
+		select {
+		case <-paused:
+		case <-u.done:
+		case <-ctx.Done():
+			resume()
+			return nil, ctx.Err()
+		}
+	}
+
+	return resume, nil
+}
+
+// RestoreBackup restores a backup archive written by WriteBackup or
+// Server.Backup. It must not be used while the bouncer is running.
+//
+// The database must be empty unless force is set, in which case all existing
+// users are deleted first. Existing audit log entries are kept. Message logs are restored if logPath isn't empty.
+func RestoreBackup(ctx context.Context, r io.Reader, db Database, logPath string, force bool) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read backup archive: %v", err)
+	}
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("failed to read backup archive: %v", err)
+	}
+	if hdr.Name != backupDBName {
+		return fmt.Errorf("invalid backup archive: expected %q, got %q", backupDBName, hdr.Name)
+	}
+	var dump dbDump
+	if err := json.NewDecoder(tr).Decode(&dump); err != nil {
+		return fmt.Errorf("failed to decode database dump: %v", err)
+	}
+
+	empty, err := isDBEmpty(ctx, db)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		if !force {
+			return fmt.Errorf("the database isn't empty")
+		}
+		users, err := db.ListUsers(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list users: %v", err)
+		}
+		for _, user := range users {
+			if err := db.DeleteUser(ctx, user.ID); err != nil {
+				return fmt.Errorf("failed to delete user %q: %v", user.Username, err)
+			}
+		}
+	}
+
+	// The audit log is kept, restored entries are appended
+	prevAuditEntries, err := countAuditEntries(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	// IDs can only be preserved in a freshly created database
+	if err := loadDump(ctx, db, &dump, empty); err != nil {
+		return err
+	}
+	if err := verifyDump(ctx, db, &dump, prevAuditEntries); err != nil {
+		return fmt.Errorf("failed to verify restored database: %v", err)
+	}
+
+	if logPath == "" {
+		return nil
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read backup archive: %v", err)
+		}
+		if err := restoreBackupLogFile(tr, hdr, logPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreBackupLogFile(tr *tar.Reader, hdr *tar.Header, root string) error {
+	name := path.Clean(hdr.Name)
+	prefix := backupLogsDir + "/"
+	if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(name, prefix) {
+		return fmt.Errorf("invalid backup archive: unexpected entry %q", hdr.Name)
+	}
+	rel := strings.TrimPrefix(name, prefix)
+	if rel == "" || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+		return fmt.Errorf("invalid backup archive: unexpected entry %q", hdr.Name)
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return fmt.Errorf("failed to create message logs directory: %v", err)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create message log file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, tr); err != nil {
+		return fmt.Errorf("failed to restore message log file %q: %v", rel, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(p, hdr.ModTime, hdr.ModTime)
+}
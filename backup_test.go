@@ -0,0 +1,84 @@
+package soju
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+
+	net := &Network{Addr: "irc.example.org", Enabled: true}
+	if err := db.StoreNetwork(ctx, user.ID, net); err != nil {
+		t.Fatalf("failed to store network: %v", err)
+	}
+	receipts := []DeliveryReceipt{{Target: "#soju", InternalMsgID: "1"}}
+	if err := db.StoreClientDeliveryReceipts(ctx, net.ID, "laptop", receipts); err != nil {
+		t.Fatalf("failed to store delivery receipts: %v", err)
+	}
+	entry := &AuditEntry{Time: time.Now(), Action: "user.create", Target: user.Username}
+	if err := db.StoreAuditEntry(ctx, entry); err != nil {
+		t.Fatalf("failed to store audit log entry: %v", err)
+	}
+
+	logPath, err := ioutil.TempDir("", "soju-backup-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(logPath)
+
+	logFile := filepath.Join(user.Username, "irc.example.org", "#soju", "2021-01-01.log")
+	if err := os.MkdirAll(filepath.Join(logPath, filepath.Dir(logFile)), 0750); err != nil {
+		t.Fatalf("failed to create log directory: %v", err)
+	}
+	logContents := []byte("[00:00:00] <soju> hello\n")
+	if err := ioutil.WriteFile(filepath.Join(logPath, logFile), logContents, 0640); err != nil {
+		t.Fatalf("failed to write log file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteBackup(ctx, &buf, db, logPath); err != nil {
+		t.Fatalf("failed to write backup: %v", err)
+	}
+	archive := buf.Bytes()
+
+	if err := RestoreBackup(ctx, bytes.NewReader(archive), db, "", false); err == nil {
+		t.Errorf("expected restore to a non-empty database to fail")
+	}
+
+	restoreDB := createTempSqliteDB(t)
+	restorePath := filepath.Join(logPath, "restore")
+	if err := RestoreBackup(ctx, bytes.NewReader(archive), restoreDB, restorePath, false); err != nil {
+		t.Fatalf("failed to restore backup: %v", err)
+	}
+
+	networks, err := restoreDB.ListNetworks(ctx, user.ID)
+	if err != nil || len(networks) != 1 || networks[0].ID != net.ID {
+		t.Fatalf("unexpected restored networks: %v (%v)", networks, err)
+	}
+	restored, err := restoreDB.ListDeliveryReceipts(ctx, net.ID)
+	if err != nil || len(restored) != 1 || restored[0].Client != "laptop" {
+		t.Errorf("unexpected restored delivery receipts: %v (%v)", restored, err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(restorePath, logFile))
+	if err != nil || !bytes.Equal(b, logContents) {
+		t.Errorf("unexpected restored log file: %q (%v)", b, err)
+	}
+
+	// Audit log entries are kept when forcing a restore
+	if err := RestoreBackup(ctx, bytes.NewReader(archive), restoreDB, "", true); err != nil {
+		t.Errorf("failed to force restore backup: %v", err)
+	}
+	entries, err := restoreDB.ListAuditEntries(ctx, &AuditFilter{})
+	if err != nil || len(entries) != 2 {
+		t.Errorf("unexpected audit log entries after forced restore: %v (%v)", entries, err)
+	}
+}
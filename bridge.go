@@ -21,7 +21,7 @@ func sendTopic(dc *downstreamConn, ch *upstreamChannel) {
 
 	if ch.Topic != "" {
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_TOPIC,
 			Params:  []string{dc.nick, downstreamName, ch.Topic},
 		})
@@ -29,14 +29,14 @@ func sendTopic(dc *downstreamConn, ch *upstreamChannel) {
 			topicWho := dc.marshalUserPrefix(ch.conn.network, ch.TopicWho)
 			topicTime := strconv.FormatInt(ch.TopicTime.Unix(), 10)
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: rpl_topicwhotime,
 				Params:  []string{dc.nick, downstreamName, topicWho.String(), topicTime},
 			})
 		}
 	} else {
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_NOTOPIC,
 			Params:  []string{dc.nick, downstreamName, "No topic is set"},
 		})
@@ -47,7 +47,7 @@ func sendNames(dc *downstreamConn, ch *upstreamChannel) {
 	downstreamName := dc.marshalEntity(ch.conn.network, ch.Name)
 
 	emptyNameReply := &irc.Message{
-		Prefix:  dc.srv.prefix(),
+		Prefix:  dc.srvPrefix(),
 		Command: irc.RPL_NAMREPLY,
 		Params:  []string{dc.nick, string(ch.Status), downstreamName, ""},
 	}
@@ -63,7 +63,7 @@ func sendNames(dc *downstreamConn, ch *upstreamChannel) {
 		if buf.Len() != 0 && n > maxLength {
 			// There's not enough space for the next space + nick.
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_NAMREPLY,
 				Params:  []string{dc.nick, string(ch.Status), downstreamName, buf.String()},
 			})
@@ -78,14 +78,14 @@ func sendNames(dc *downstreamConn, ch *upstreamChannel) {
 
 	if buf.Len() != 0 {
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_NAMREPLY,
 			Params:  []string{dc.nick, string(ch.Status), downstreamName, buf.String()},
 		})
 	}
 
 	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
+		Prefix:  dc.srvPrefix(),
 		Command: irc.RPL_ENDOFNAMES,
 		Params:  []string{dc.nick, downstreamName, "End of /NAMES list"},
 	})
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+// checkConfig validates a configuration without starting the server. It
+// returns the list of problems found.
+func checkConfig(cfg *config.Server) []error {
+	var errs []error
+	report := func(format string, v ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, v...))
+	}
+
+	s := &server{cfg: cfg}
+	if cfg.ACME != nil {
+		s.acme = newACMEManager(cfg.ACME)
+		if err := checkWritableDir(cfg.ACME.StoragePath); err != nil {
+			report("acme storage: %v", err)
+		}
+	}
+
+	for _, tlsCfg := range cfg.TLS {
+		if err := (&certStore{}).Load([]config.TLS{tlsCfg}, nil); err != nil {
+			report("tls: %v", err)
+		}
+	}
+
+	for _, l := range cfg.Listen {
+		u, err := parseListenURI(l.URI)
+		if err != nil {
+			report("listen %q: %v", l.URI, err)
+			continue
+		}
+		if !listenerUsesTLS(u) {
+			continue
+		}
+		if len(l.TLS) > 0 {
+			if err := (&certStore{}).Load(l.TLS, nil); err != nil {
+				report("listen %q: %v", l.URI, err)
+			}
+		} else if len(cfg.TLS) == 0 && s.acme == nil {
+			report("listen %q: missing TLS configuration", l.URI)
+		}
+	}
+
+	if err := checkDB(cfg.SQLDriver, cfg.SQLSource); err != nil {
+		report("db: %v", err)
+	}
+
+	if cfg.LogPath != "" {
+		if err := checkWritableDir(cfg.LogPath); err != nil {
+			report("log: %v", err)
+		}
+	}
+
+	if cfg.OidentdPath != "" {
+		if err := checkWritableDir(filepath.Dir(cfg.OidentdPath)); err != nil {
+			report("oidentd: %v", err)
+		}
+	}
+
+	if cfg.MOTDPath != "" {
+		if _, err := ioutil.ReadFile(cfg.MOTDPath); err != nil {
+			report("motd: %v", err)
+		}
+	}
+
+	if cfg.HTTPRoot != "" {
+		if fi, err := os.Stat(cfg.HTTPRoot); err != nil {
+			report("http-root: %v", err)
+		} else if !fi.IsDir() {
+			report("http-root: %q is not a directory", cfg.HTTPRoot)
+		}
+	}
+
+	return errs
+}
+
+// checkDB checks that the database can be reached, without creating or
+// upgrading it.
+func checkDB(driver, source string) error {
+	if driver == "sqlite3" {
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			// The database will be created on startup
+			return checkWritableDir(filepath.Dir(source))
+		} else if err != nil {
+			return err
+		}
+	}
+
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
+
+// checkWritableDir checks that a directory is writable, or can be created if
+// it doesn't exist.
+func checkWritableDir(path string) error {
+	for {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			parent := filepath.Dir(path)
+			if parent == path {
+				return err
+			}
+			path = parent
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("%q is not a directory", path)
+		}
+		if err := unix.Access(path, unix.W_OK); err != nil {
+			return fmt.Errorf("%q is not writable: %v", path, err)
+		}
+		return nil
+	}
+}
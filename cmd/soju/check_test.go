@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-check-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	cfg := config.Defaults()
+	cfg.SQLSource = filepath.Join(dir, "db", "soju.db")
+	cfg.LogPath = filepath.Join(dir, "logs")
+	cfg.MOTDPath = file
+	cfg.HTTPRoot = dir
+	tlsListener := config.NewListener("ircs://")
+	tlsListener.TLS = []config.TLS{writeTestCert(t, dir, "irc.example.org")}
+	cfg.Listen = []config.Listener{
+		config.NewListener("irc+insecure://"),
+		tlsListener,
+	}
+	if errs := checkConfig(cfg); len(errs) != 0 {
+		t.Errorf("unexpected errors for a valid config: %v", errs)
+	}
+
+	cfg = config.Defaults()
+	cfg.SQLSource = filepath.Join(file, "soju.db")
+	cfg.LogPath = filepath.Join(file, "logs")
+	cfg.MOTDPath = filepath.Join(dir, "missing")
+	cfg.HTTPRoot = file
+	cfg.TLS = []config.TLS{{CertPath: filepath.Join(dir, "missing.crt"), KeyPath: filepath.Join(dir, "missing.key")}}
+	cfg.Listen = []config.Listener{config.NewListener("foo://")}
+	errs := checkConfig(cfg)
+	for _, prefix := range []string{"db:", "log:", "motd:", "http-root:", "tls:", `listen "foo://":`} {
+		found := false
+		for _, err := range errs {
+			if strings.HasPrefix(err.Error(), prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing %q error in %v", prefix, errs)
+		}
+	}
+
+	cfg = config.Defaults()
+	cfg.SQLSource = filepath.Join(dir, "soju.db")
+	cfg.Listen = []config.Listener{config.NewListener("ircs://")}
+	errs = checkConfig(cfg)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "missing TLS configuration") {
+		t.Errorf("expected a missing TLS configuration error, got %v", errs)
+	}
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-check-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := checkWritableDir(dir); err != nil {
+		t.Errorf("existing directory: %v", err)
+	}
+	if err := checkWritableDir(filepath.Join(dir, "a", "b")); err != nil {
+		t.Errorf("directory which can be created: %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := checkWritableDir(file); err == nil {
+		t.Errorf("expected an error for a file")
+	}
+	if err := checkWritableDir(filepath.Join(file, "a")); err == nil {
+		t.Errorf("expected an error for a path below a file")
+	}
+}
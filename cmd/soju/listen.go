@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by the service manager,
+// see sd_listen_fds(3).
+const listenFDsStart = 3
+
+// upgradeFDEnv is the environment variable containing the file descriptor of
+// the socket connecting the new process to the previous one during an
+// upgrade.
+const upgradeFDEnv = "SOJU_UPGRADE_FD"
+
+// upgradeListenFDsEnv is the environment variable containing the number of
+// listening sockets passed by the previous process during an upgrade. LISTEN_FDS
+// can't be used, since LISTEN_PID can't be known before the new process is
+// started.
+const upgradeListenFDsEnv = "SOJU_UPGRADE_LISTEN_FDS"
+
+// listenerSet keeps track of the listening sockets. Sockets can be inherited
+// from the service manager (socket activation) or from a previous soju
+// process (upgrade).
+type listenerSet struct {
+	inherited []net.Listener
+	bound     []net.Listener
+}
+
+// inheritListeners collects the listening sockets passed via the LISTEN_FDS
+// protocol, or by the previous process during an upgrade. Like
+// sd_listen_fds(3), LISTEN_FDS is ignored unless LISTEN_PID matches this
+// process, so that variables inherited from a parent process aren't used.
+func inheritListeners() (*listenerSet, error) {
+	pid := os.Getenv("LISTEN_PID")
+	nfds := os.Getenv("LISTEN_FDS")
+	upgradeNFDs := os.Getenv(upgradeListenFDsEnv)
+	// Don't leak the variables to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(upgradeListenFDsEnv)
+
+	ls := &listenerSet{}
+	if upgradeNFDs != "" {
+		nfds = upgradeNFDs
+	} else if pid != strconv.Itoa(os.Getpid()) {
+		return ls, nil
+	}
+	if nfds == "" {
+		return ls, nil
+	}
+
+	n, err := strconv.Atoi(nfds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %v", err)
+	}
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%v", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit file descriptor %v: %v", fd, err)
+		}
+		ls.inherited = append(ls.inherited, ln)
+	}
+	return ls, nil
+}
+
+// listenerMatches checks whether a listener is bound to an address.
+func listenerMatches(ln net.Listener, network, addr string) bool {
+	switch la := ln.Addr().(type) {
+	case *net.UnixAddr:
+		return network == "unix" && la.Name == addr
+	case *net.TCPAddr:
+		if network != "tcp" {
+			return false
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		if p, err := net.LookupPort("tcp", port); err != nil || p != la.Port {
+			return false
+		}
+		if host == "" {
+			return la.IP.IsUnspecified()
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.Equal(la.IP)
+	default:
+		return false
+	}
+}
+
+// Listen returns an inherited listener bound to the address if any, or
+// creates a new one.
+func (ls *listenerSet) Listen(lc *net.ListenConfig, network, addr string) (net.Listener, error) {
+	for i, ln := range ls.inherited {
+		if listenerMatches(ln, network, addr) {
+			ls.inherited = append(ls.inherited[:i], ls.inherited[i+1:]...)
+			ls.bound = append(ls.bound, ln)
+			return ln, nil
+		}
+	}
+
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ls.bound = append(ls.bound, ln)
+	return ln, nil
+}
+
+// Forget stops tracking a listener which has been closed.
+func (ls *listenerSet) Forget(ln net.Listener) {
+	for i, l := range ls.bound {
+		if l == ln {
+			ls.bound = append(ls.bound[:i], ls.bound[i+1:]...)
+			break
+		}
+	}
+}
+
+// CloseUnused closes the inherited listeners which don't match any listen
+// directive.
+func (ls *listenerSet) CloseUnused() {
+	for _, ln := range ls.inherited {
+		ln.Close()
+	}
+	ls.inherited = nil
+}
+
+// openUpgradeConn returns the socket connected to the previous soju process,
+// if this process has been started by an upgrade. Otherwise, it returns nil.
+func openUpgradeConn() (*upgradeConn, error) {
+	s := os.Getenv(upgradeFDEnv)
+	os.Unsetenv(upgradeFDEnv)
+	if s == "" {
+		return nil, nil
+	}
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", upgradeFDEnv, err)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "upgrade")
+	defer f.Close()
+
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("invalid %v: not a Unix socket", upgradeFDEnv)
+	}
+	return &upgradeConn{uc}, nil
+}
+
+// startUpgrade starts a new soju process with the same arguments, passing it
+// the listening sockets and a socket used to hand over upstream connections.
+func (ls *listenerSet) startUpgrade() (*upgradeProcess, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var unixListeners []*net.UnixListener
+	for _, ln := range ls.bound {
+		if uln, ok := ln.(*net.UnixListener); ok {
+			// The socket file is still used by the new process
+			uln.SetUnlinkOnClose(false)
+			unixListeners = append(unixListeners, uln)
+		}
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("cannot pass listener %v", ln.Addr())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pass listener %v: %v", ln.Addr(), err)
+		}
+		files = append(files, f)
+	}
+
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket pair: %v", err)
+	}
+	child := os.NewFile(uintptr(fds[1]), "upgrade")
+	files = append(files, child)
+	parent := os.NewFile(uintptr(fds[0]), "upgrade")
+	c, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.UnixConn)
+
+	exe, err := os.Executable()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, "SOJU_UPGRADE_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		fmt.Sprintf("%v=%v", upgradeListenFDsEnv, len(files)-1),
+		fmt.Sprintf("%v=%v", upgradeFDEnv, listenFDsStart+len(files)-1))
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start new process: %v", err)
+	}
+
+	return &upgradeProcess{
+		conn:          conn,
+		process:       cmd.Process,
+		unixListeners: unixListeners,
+	}, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestInheritListenersPID(t *testing.T) {
+	for _, pid := range []string{"", strconv.Itoa(os.Getpid() + 1)} {
+		// The file descriptors aren't used if the variables are ignored
+		os.Setenv("LISTEN_FDS", "1")
+		os.Setenv("LISTEN_PID", pid)
+		ls, err := inheritListeners()
+		if err != nil {
+			t.Fatalf("failed to inherit listeners with LISTEN_PID=%q: %v", pid, err)
+		}
+		if len(ls.inherited) != 0 {
+			t.Errorf("inherited %v listeners with LISTEN_PID=%q, want none", len(ls.inherited), pid)
+		}
+		if os.Getenv("LISTEN_FDS") != "" {
+			t.Errorf("LISTEN_FDS not unset")
+		}
+	}
+}
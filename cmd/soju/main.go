@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -12,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -50,29 +50,127 @@ func loadMOTD(srv *soju.Server, filename string) error {
 	return nil
 }
 
-func main() {
-	var listen []string
-	var configPath string
-	var debug bool
-	flag.Var((*stringSliceFlag)(&listen), "listen", "listening address")
-	flag.StringVar(&configPath, "config", "", "path to configuration file")
-	flag.BoolVar(&debug, "debug", false, "enable debug logging")
-	flag.Parse()
+// server holds the state of the bouncer which depends on the config file.
+type server struct {
+	srv         *soju.Server
+	cfg         *config.Server
+	configPath  string
+	extraListen []string
+	debug       bool
+	logWriter   *soju.LogWriter
+
+	listeners *listenerSet
+	running   map[string]*runningListener // indexed by listen URI
+	acme      *acmeManager                // nil if ACME is disabled
+}
 
+type runningListener struct {
+	cfg   config.Listener
+	certs *certStore // nil if the listener doesn't use TLS
+	stop  func()
+}
+
+func loadConfig(configPath string, listen []string) (*config.Server, error) {
 	var cfg *config.Server
 	if configPath != "" {
 		var err error
 		cfg, err = config.Load(configPath)
 		if err != nil {
-			log.Fatalf("failed to load config file: %v", err)
+			return nil, fmt.Errorf("failed to load config file: %v", err)
 		}
 	} else {
 		cfg = config.Defaults()
 	}
 
-	cfg.Listen = append(cfg.Listen, listen...)
+	for _, uri := range listen {
+		cfg.Listen = append(cfg.Listen, config.NewListener(uri))
+	}
 	if len(cfg.Listen) == 0 {
-		cfg.Listen = []string{":6697"}
+		cfg.Listen = []config.Listener{config.NewListener(":6697")}
+	}
+	return cfg, nil
+}
+
+func serverConfig(cfg *config.Server, debug bool) *soju.Config {
+	return &soju.Config{
+		Hostname:               cfg.Hostname,
+		Title:                  cfg.Title,
+		LogPath:                cfg.LogPath,
+		Debug:                  debug,
+		HTTPOrigins:            cfg.HTTPOrigins,
+		HTTPRoot:               cfg.HTTPRoot,
+		WebSocketCompression:   cfg.WebSocketCompression,
+		AcceptProxyIPs:         cfg.AcceptProxyIPs,
+		MaxUserNetworks:        cfg.MaxUserNetworks,
+		MaxUserChannels:        cfg.MaxUserChannels,
+		MaxUserDownstreams:     cfg.MaxUserDownstreams,
+		MaxUserLogSize:         cfg.MaxUserLogSize,
+		MaxUserConnectCommands: cfg.MaxUserConnectCommands,
+		ClientExpiry:           cfg.ClientExpiry,
+		LoginMaxFailures:       cfg.LoginMaxFailures,
+		LoginLockout:           cfg.LoginLockout,
+		MaxIPUnregisteredConns: cfg.MaxIPUnregisteredConns,
+		MaxIPConns:             cfg.MaxIPConns,
+	}
+}
+
+// configureLog applies the server log settings. The settings have already
+// been validated when loading the config file.
+func configureLog(lw *soju.LogWriter, cfg *config.Server, debug bool) {
+	level, _ := soju.ParseLogLevel(cfg.ServerLogLevel)
+	if debug {
+		level = soju.LogDebug
+	}
+	format, _ := soju.ParseLogFormat(cfg.ServerLogFormat)
+	lw.SetLevel(level)
+	lw.SetFormat(format)
+}
+
+// stdLogWriter forwards the messages of the standard logger to a soju.Logger,
+// so that they share the same format.
+type stdLogWriter struct {
+	logger soju.Logger
+}
+
+func (w stdLogWriter) Write(b []byte) (int, error) {
+	w.logger.Print(strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+func main() {
+	var listen []string
+	var configPath string
+	var debug, check bool
+	flag.Var((*stringSliceFlag)(&listen), "listen", "listening address")
+	flag.StringVar(&configPath, "config", "", "path to configuration file")
+	flag.BoolVar(&debug, "debug", false, "enable debug logging")
+	flag.BoolVar(&check, "check-config", false, "check the configuration and exit")
+	flag.Parse()
+
+	cfg, err := loadConfig(configPath, listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if check {
+		errs := checkConfig(cfg)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("configuration OK")
+		return
+	}
+
+	listeners, err := inheritListeners()
+	if err != nil {
+		log.Fatalf("failed to inherit listeners: %v", err)
+	}
+	upgrade, err := openUpgradeConn()
+	if err != nil {
+		log.Fatalf("failed to connect to previous process: %v", err)
 	}
 
 	db, err := soju.OpenDB(cfg.SQLDriver, cfg.SQLSource)
@@ -80,160 +178,60 @@ func main() {
 		log.Fatalf("failed to open database: %v", err)
 	}
 
-	var tlsCfg *tls.Config
-	var tlsCert atomic.Value
-	if cfg.TLS != nil {
-		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertPath, cfg.TLS.KeyPath)
-		if err != nil {
-			log.Fatalf("failed to load TLS certificate and key: %v", err)
-		}
-		tlsCert.Store(&cert)
+	logWriter := soju.NewLogWriter(os.Stderr)
+	configureLog(logWriter, cfg, debug)
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logWriter.Logger()})
 
-		tlsCfg = &tls.Config{
-			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-				return tlsCert.Load().(*tls.Certificate), nil
-			},
-		}
+	s := &server{
+		srv:         soju.NewServer(db),
+		cfg:         cfg,
+		configPath:  configPath,
+		extraListen: listen,
+		debug:       debug,
+		logWriter:   logWriter,
+		listeners:   listeners,
+		running:     make(map[string]*runningListener),
+	}
+	if cfg.ACME != nil {
+		s.acme = newACMEManager(cfg.ACME)
 	}
 
-	srv := soju.NewServer(db)
-	srv.Hostname = cfg.Hostname
-	srv.Title = cfg.Title
-	srv.LogPath = cfg.LogPath
-	srv.HTTPOrigins = cfg.HTTPOrigins
-	srv.AcceptProxyIPs = cfg.AcceptProxyIPs
-	srv.MaxUserNetworks = cfg.MaxUserNetworks
-	srv.Debug = debug
+	srv := s.srv
+	srv.Logger = logWriter.Logger()
+	// Created once, since upstream connections use it concurrently
+	srv.Identd = soju.NewIdentd()
+	srv.SetConfig(serverConfig(cfg, debug))
 
 	if err := loadMOTD(srv, cfg.MOTDPath); err != nil {
 		log.Fatalf("failed to load MOTD: %v", err)
 	}
-
-	for _, listen := range cfg.Listen {
-		listenURI := listen
-		if !strings.Contains(listenURI, ":/") {
-			// This is a raw domain name, make it an URL with an empty scheme
-			listenURI = "//" + listenURI
-		}
-		u, err := url.Parse(listenURI)
+	if upgrade != nil {
+		handovers, err := upgrade.receiveHandovers()
 		if err != nil {
-			log.Fatalf("failed to parse listen URI %q: %v", listen, err)
+			log.Printf("failed to receive upstream connections from previous process: %v", err)
 		}
+		srv.AdoptUpstreams(handovers)
+	}
+	if err := s.updateOidentd(); err != nil {
+		log.Fatal(err)
+	}
 
-		switch u.Scheme {
-		case "ircs", "":
-			if tlsCfg == nil {
-				log.Fatalf("failed to listen on %q: missing TLS configuration", listen)
-			}
-			host := u.Host
-			if _, _, err := net.SplitHostPort(host); err != nil {
-				host = host + ":6697"
-			}
-			ircsTLSCfg := tlsCfg.Clone()
-			ircsTLSCfg.NextProtos = []string{"irc"}
-			lc := net.ListenConfig{
-				KeepAlive: downstreamKeepAlive,
-			}
-			l, err := lc.Listen(context.Background(), "tcp", host)
-			if err != nil {
-				log.Fatalf("failed to start TLS listener on %q: %v", listen, err)
-			}
-			ln := tls.NewListener(l, ircsTLSCfg)
-			ln = proxyProtoListener(ln, srv)
-			go func() {
-				if err := srv.Serve(ln); err != nil {
-					log.Printf("serving %q: %v", listen, err)
-				}
-			}()
-		case "irc+insecure":
-			host := u.Host
-			if _, _, err := net.SplitHostPort(host); err != nil {
-				host = host + ":6667"
-			}
-			lc := net.ListenConfig{
-				KeepAlive: downstreamKeepAlive,
-			}
-			ln, err := lc.Listen(context.Background(), "tcp", host)
-			if err != nil {
-				log.Fatalf("failed to start listener on %q: %v", listen, err)
-			}
-			ln = proxyProtoListener(ln, srv)
-			go func() {
-				if err := srv.Serve(ln); err != nil {
-					log.Printf("serving %q: %v", listen, err)
-				}
-			}()
-		case "unix":
-			ln, err := net.Listen("unix", u.Path)
-			if err != nil {
-				log.Fatalf("failed to start listener on %q: %v", listen, err)
-			}
-			ln = proxyProtoListener(ln, srv)
-			go func() {
-				if err := srv.Serve(ln); err != nil {
-					log.Printf("serving %q: %v", listen, err)
-				}
-			}()
-		case "wss":
-			if tlsCfg == nil {
-				log.Fatalf("failed to listen on %q: missing TLS configuration", listen)
-			}
-			addr := u.Host
-			if _, _, err := net.SplitHostPort(addr); err != nil {
-				addr = addr + ":https"
-			}
-			httpSrv := http.Server{
-				Addr:      addr,
-				TLSConfig: tlsCfg,
-				Handler:   srv,
-			}
-			go func() {
-				if err := httpSrv.ListenAndServeTLS("", ""); err != nil {
-					log.Fatalf("serving %q: %v", listen, err)
-				}
-			}()
-		case "ws+insecure":
-			addr := u.Host
-			if _, _, err := net.SplitHostPort(addr); err != nil {
-				addr = addr + ":http"
-			}
-			httpSrv := http.Server{
-				Addr:    addr,
-				Handler: srv,
-			}
-			go func() {
-				if err := httpSrv.ListenAndServe(); err != nil {
-					log.Fatalf("serving %q: %v", listen, err)
-				}
-			}()
-		case "ident":
-			if srv.Identd == nil {
-				srv.Identd = soju.NewIdentd()
-			}
-
-			host := u.Host
-			if _, _, err := net.SplitHostPort(host); err != nil {
-				host = host + ":113"
-			}
-			ln, err := net.Listen("tcp", host)
-			if err != nil {
-				log.Fatalf("failed to start listener on %q: %v", listen, err)
-			}
-			ln = proxyProtoListener(ln, srv)
-			go func() {
-				if err := srv.Identd.Serve(ln); err != nil {
-					log.Printf("serving %q: %v", listen, err)
-				}
-			}()
-		default:
-			log.Fatalf("failed to listen on %q: unsupported scheme", listen)
+	for _, l := range cfg.Listen {
+		if _, ok := s.running[l.URI]; ok {
+			continue
 		}
-
-		log.Printf("server listening on %q", listen)
+		rl, err := s.startListener(l)
+		if err != nil {
+			log.Fatalf("failed to listen on %q: %v", l.URI, err)
+		}
+		s.running[l.URI] = rl
+		log.Printf("server listening on %q", l.URI)
 	}
+	listeners.CloseUnused()
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 
 	if err := srv.Start(); err != nil {
 		log.Fatal(err)
@@ -242,18 +240,36 @@ func main() {
 	for sig := range sigCh {
 		switch sig {
 		case syscall.SIGHUP:
-			log.Print("reloading TLS certificate and MOTD")
-			if cfg.TLS != nil {
-				cert, err := tls.LoadX509KeyPair(cfg.TLS.CertPath, cfg.TLS.KeyPath)
-				if err != nil {
-					log.Printf("failed to reload TLS certificate and key: %v", err)
-					break
-				}
-				tlsCert.Store(&cert)
+			log.Print("reloading configuration")
+			s.reload()
+		case syscall.SIGUSR2:
+			log.Print("upgrading server")
+			up, err := listeners.startUpgrade()
+			if err != nil {
+				log.Printf("failed to upgrade server: %v", err)
+				break
+			}
+			if err := up.waitReady(upgradeTimeout); err != nil {
+				log.Printf("failed to upgrade server: new process isn't ready: %v", err)
+				up.abort()
+				break
+			}
+			// The new process outlives this one: let the service manager
+			// track it instead
+			if err := sdNotify(fmt.Sprintf("MAINPID=%v", up.process.Pid)); err != nil {
+				log.Printf("failed to notify service manager of the new main PID: %v", err)
 			}
-			if err := loadMOTD(srv, cfg.MOTDPath); err != nil {
-				log.Printf("failed to reload MOTD: %v", err)
+			for _, rl := range s.running {
+				rl.stop()
 			}
+			handovers := srv.HandoverUpstreams(upgradeTimeout)
+			if err := up.sendHandovers(handovers); err != nil {
+				log.Printf("failed to hand over upstream connections: %v", err)
+			}
+			srv.Shutdown()
+			// Let the new process start serving
+			up.Close()
+			return
 		case syscall.SIGINT, syscall.SIGTERM:
 			log.Print("shutting down server")
 			srv.Shutdown()
@@ -262,6 +278,278 @@ func main() {
 	}
 }
 
+// reload loads the config file again and applies it to the running server.
+// Directives which can't change while running keep their previous value.
+func (s *server) reload() {
+	cfg, err := loadConfig(s.configPath, s.extraListen)
+	if err != nil {
+		log.Printf("failed to reload configuration: %v", err)
+		return
+	}
+
+	if cfg.SQLDriver != s.cfg.SQLDriver || cfg.SQLSource != s.cfg.SQLSource {
+		log.Print("the db directive can't be changed while running, restart required")
+		cfg.SQLDriver, cfg.SQLSource = s.cfg.SQLDriver, s.cfg.SQLSource
+	}
+	if cfg.LogPath != s.cfg.LogPath {
+		log.Print("the log directive can't be changed while running, restart required")
+		cfg.LogPath = s.cfg.LogPath
+	}
+
+	if err := loadMOTD(s.srv, cfg.MOTDPath); err != nil {
+		log.Printf("failed to reload MOTD: %v", err)
+	}
+
+	if !reflect.DeepEqual(cfg.ACME, s.cfg.ACME) {
+		s.acme = nil
+		if cfg.ACME != nil {
+			s.acme = newACMEManager(cfg.ACME)
+		}
+	}
+
+	oidentdChanged := cfg.OidentdPath != s.cfg.OidentdPath
+	s.cfg = cfg
+	configureLog(s.logWriter, cfg, s.debug)
+	if oidentdChanged {
+		if err := s.updateOidentd(); err != nil {
+			log.Print(err)
+		}
+	}
+	s.srv.SetConfig(serverConfig(cfg, s.debug))
+
+	want := make(map[string]config.Listener)
+	for _, l := range cfg.Listen {
+		if _, ok := want[l.URI]; !ok {
+			want[l.URI] = l
+		}
+	}
+	for uri, rl := range s.running {
+		l, ok := want[uri]
+		if ok && reflect.DeepEqual(l, rl.cfg) {
+			if rl.certs != nil {
+				if err := rl.certs.Load(s.listenerTLS(l), s.acme); err != nil {
+					log.Printf("failed to reload TLS certificates for %q: %v", uri, err)
+				}
+			}
+			continue
+		}
+		rl.stop()
+		delete(s.running, uri)
+		log.Printf("server stopped listening on %q", uri)
+	}
+	for _, l := range cfg.Listen {
+		if _, ok := s.running[l.URI]; ok {
+			continue
+		}
+		rl, err := s.startListener(l)
+		if err != nil {
+			log.Printf("failed to listen on %q: %v", l.URI, err)
+			continue
+		}
+		s.running[l.URI] = rl
+		log.Printf("server listening on %q", l.URI)
+	}
+}
+
+// listenerTLS returns the TLS certificates of a listener.
+func (s *server) listenerTLS(l config.Listener) []config.TLS {
+	if len(l.TLS) > 0 {
+		return l.TLS
+	}
+	return s.cfg.TLS
+}
+
+// parseListenURI parses and checks the URI of a listen directive.
+func parseListenURI(listen string) (*url.URL, error) {
+	listenURI := listen
+	if !strings.Contains(listenURI, ":/") && !strings.HasPrefix(listenURI, "unix:") {
+		// This is a raw domain name, make it an URL with an empty scheme
+		listenURI = "//" + listenURI
+	}
+	u, err := url.Parse(listenURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse listen URI: %v", err)
+	}
+	if u.Opaque != "" && (u.Scheme != "unix" || !strings.HasPrefix(u.Opaque, "@")) {
+		return nil, fmt.Errorf("invalid listen URI")
+	}
+
+	switch u.Scheme {
+	case "ircs", "", "irc+insecure", "unix", "wss", "ws+insecure", "ident":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme")
+	}
+}
+
+// listenerUsesTLS checks whether a listener needs TLS certificates.
+func listenerUsesTLS(u *url.URL) bool {
+	return u.Scheme == "ircs" || u.Scheme == "" || u.Scheme == "wss"
+}
+
+// updateOidentd applies the oidentd directive.
+func (s *server) updateOidentd() error {
+	return s.srv.Identd.SetOidentdPath(s.cfg.OidentdPath)
+}
+
+// startListener starts serving a listen directive.
+func (s *server) startListener(l config.Listener) (*runningListener, error) {
+	srv := s.srv
+	listen := l.URI
+	rl := &runningListener{cfg: l}
+	lcfg := &soju.ListenerConfig{
+		Hostname:    l.Hostname,
+		HTTPOrigins: l.HTTPOrigins,
+		ClientHost:  l.ClientHost,
+		PeerAuth:    l.PeerAuth,
+	}
+	wrap := func(ln net.Listener) net.Listener {
+		if l.ProxyProtocol {
+			ln = proxyProtoListener(ln, srv)
+		}
+		return ln
+	}
+	loadCerts := func(nextProtos ...string) (*tls.Config, error) {
+		rl.certs = &certStore{}
+		if err := rl.certs.Load(s.listenerTLS(l), s.acme); err != nil {
+			return nil, err
+		}
+		return rl.certs.TLSConfig(nextProtos), nil
+	}
+
+	u, err := parseListenURI(listen)
+	if err != nil {
+		return nil, err
+	}
+
+	var ln net.Listener
+	var serve func() error
+	var closeFn func() error
+	switch u.Scheme {
+	case "ircs", "":
+		host := u.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = host + ":6697"
+		}
+		ircsTLSCfg, err := loadCerts("irc")
+		if err != nil {
+			return nil, err
+		}
+		lc := net.ListenConfig{
+			KeepAlive: downstreamKeepAlive,
+		}
+		ln, err = s.listeners.Listen(&lc, "tcp", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start TLS listener: %v", err)
+		}
+		tlsLn := wrap(tls.NewListener(ln, ircsTLSCfg))
+		serve = func() error {
+			return srv.Serve(tlsLn, lcfg)
+		}
+	case "irc+insecure":
+		host := u.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = host + ":6667"
+		}
+		lc := net.ListenConfig{
+			KeepAlive: downstreamKeepAlive,
+		}
+		ln, err = s.listeners.Listen(&lc, "tcp", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start listener: %v", err)
+		}
+		proxyLn := wrap(ln)
+		serve = func() error {
+			return srv.Serve(proxyLn, lcfg)
+		}
+	case "unix":
+		path := u.Path
+		if u.Opaque != "" {
+			// Abstract socket, e.g. "unix:@soju"
+			path = u.Opaque
+		}
+		ln, err = s.listeners.Listen(&net.ListenConfig{}, "unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start listener: %v", err)
+		}
+		proxyLn := wrap(ln)
+		serve = func() error {
+			return srv.Serve(proxyLn, lcfg)
+		}
+	case "wss":
+		tlsCfg, err := loadCerts("http/1.1")
+		if err != nil {
+			return nil, err
+		}
+		addr := u.Host
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = addr + ":https"
+		}
+		ln, err = s.listeners.Listen(&net.ListenConfig{}, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start listener: %v", err)
+		}
+		httpSrv := &http.Server{
+			Addr:      addr,
+			TLSConfig: tlsCfg,
+			Handler:   srv.Handler(lcfg),
+		}
+		serve = func() error {
+			return httpSrv.ServeTLS(ln, "", "")
+		}
+		closeFn = httpSrv.Close
+	case "ws+insecure":
+		addr := u.Host
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = addr + ":http"
+		}
+		ln, err = s.listeners.Listen(&net.ListenConfig{}, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start listener: %v", err)
+		}
+		httpSrv := &http.Server{
+			Addr:    addr,
+			Handler: srv.Handler(lcfg),
+		}
+		serve = func() error {
+			return httpSrv.Serve(ln)
+		}
+		closeFn = httpSrv.Close
+	case "ident":
+		host := u.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = host + ":113"
+		}
+		ln, err = s.listeners.Listen(&net.ListenConfig{}, "tcp", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start listener: %v", err)
+		}
+		proxyLn := wrap(ln)
+		serve = func() error {
+			return srv.Identd.Serve(proxyLn)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme")
+	}
+	if closeFn == nil {
+		closeFn = ln.Close
+	}
+
+	var stopped int32
+	go func() {
+		if err := serve(); err != nil && atomic.LoadInt32(&stopped) == 0 {
+			log.Printf("serving %q: %v", listen, err)
+		}
+	}()
+
+	rl.stop = func() {
+		atomic.StoreInt32(&stopped, 1)
+		closeFn()
+		s.listeners.Forget(ln)
+	}
+	return rl, nil
+}
+
 func proxyProtoListener(ln net.Listener, srv *soju.Server) net.Listener {
 	return &proxyproto.Listener{
 		Listener: ln,
@@ -270,7 +558,7 @@ func proxyProtoListener(ln net.Listener, srv *soju.Server) net.Listener {
 			if !ok {
 				return proxyproto.IGNORE, nil
 			}
-			if srv.AcceptProxyIPs.Contains(tcpAddr.IP) {
+			if srv.Config().AcceptProxyIPs.Contains(tcpAddr.IP) {
 				return proxyproto.USE, nil
 			}
 			return proxyproto.IGNORE, nil
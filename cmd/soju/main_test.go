@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"git.sr.ht/~emersion/soju"
+	"git.sr.ht/~emersion/soju/config"
+)
+
+func TestListenerHTTPOrigins(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+
+	srv := soju.NewServer(nil)
+	srv.Logger = soju.NewLogWriter(ioutil.Discard).Logger()
+	cfg := soju.DefaultConfig()
+	cfg.HTTPOrigins = []string{"*.global.example.org"}
+	srv.SetConfig(cfg)
+
+	// The inherited listener is picked up by startListener
+	s := &server{srv: srv, listeners: &listenerSet{inherited: []net.Listener{ln}}}
+	l := config.NewListener("ws+insecure://" + addr)
+	l.HTTPOrigins = []string{"app.example.org"}
+	rl, err := s.startListener(l)
+	if err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer rl.stop()
+
+	for origin, want := range map[string]int{
+		"https://app.example.org":        http.StatusSwitchingProtocols,
+		"https://app.global.example.org": http.StatusForbidden,
+		"https://evil.example.org":       http.StatusForbidden,
+	} {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/socket", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Origin", origin)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("got status %v for origin %q, want %v", resp.StatusCode, origin, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+// acmeErrorLogInterval is the minimum delay between two logs of ACME failures.
+const acmeErrorLogInterval = 10 * time.Minute
+
+// certStore holds the TLS certificates of a listener. Certificates are
+// picked by SNI, the first one is used if none matches. Certificates for the
+// ACME domains are managed automatically, the files are used as a fallback.
+type certStore struct {
+	lastACMELog int64        // atomic, Unix time
+	state       atomic.Value // *certStoreState
+}
+
+type certStoreState struct {
+	certs []tls.Certificate
+	acme  *acmeManager // can be nil
+}
+
+// Load replaces the certificates. On error, the previous certificates are
+// kept.
+func (cs *certStore) Load(tlsCfgs []config.TLS, acme *acmeManager) error {
+	if len(tlsCfgs) == 0 && acme == nil {
+		return fmt.Errorf("missing TLS configuration")
+	}
+
+	var certs []tls.Certificate
+	for _, tlsCfg := range tlsCfgs {
+		cert, err := tls.LoadX509KeyPair(tlsCfg.CertPath, tlsCfg.KeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate and key %q: %v", tlsCfg.CertPath, err)
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS certificate %q: %v", tlsCfg.CertPath, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	cs.state.Store(&certStoreState{certs: certs, acme: acme})
+	return nil
+}
+
+// TLSConfig returns a TLS configuration using the certificates of the store.
+// The ACME TLS-ALPN-01 challenge protocol is only advertised while ACME is
+// enabled.
+func (cs *certStore) TLSConfig(nextProtos []string) *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: cs.GetCertificate,
+		NextProtos:     nextProtos,
+	}
+	acmeCfg := cfg.Clone()
+	acmeCfg.NextProtos = append(append([]string(nil), nextProtos...), acme.ALPNProto)
+	return &tls.Config{
+		GetCertificate: cs.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if state := cs.state.Load().(*certStoreState); state.acme != nil {
+				return acmeCfg, nil
+			}
+			return cfg, nil
+		},
+	}
+}
+
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	state := cs.state.Load().(*certStoreState)
+
+	if state.acme != nil && state.acme.handles(hello) {
+		cert, err := state.acme.GetCertificate(hello)
+		if err == nil || len(state.certs) == 0 {
+			return cert, err
+		}
+		if cs.shouldLogACMEError() {
+			log.Printf("failed to get ACME certificate for %q, falling back to TLS files: %v", hello.ServerName, err)
+		}
+	}
+
+	if len(state.certs) == 0 {
+		return nil, fmt.Errorf("no certificate available for %q", hello.ServerName)
+	}
+	if hello.ServerName != "" {
+		for i := range state.certs {
+			if state.certs[i].Leaf.VerifyHostname(hello.ServerName) == nil {
+				return &state.certs[i], nil
+			}
+		}
+	}
+	return &state.certs[0], nil
+}
+
+// shouldLogACMEError rate-limits the logs of ACME failures, since every TLS
+// handshake for an ACME domain fails the same way until the issue is fixed.
+func (cs *certStore) shouldLogACMEError() bool {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&cs.lastACMELog)
+	if now-last < int64(acmeErrorLogInterval/time.Second) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&cs.lastACMELog, last, now)
+}
+
+// acmeManager obtains and renews certificates with the TLS-ALPN-01 challenge.
+type acmeManager struct {
+	*autocert.Manager
+	domains map[string]bool
+}
+
+func newACMEManager(cfg *config.ACME) *acmeManager {
+	domains := make(map[string]bool)
+	for _, domain := range cfg.Domains {
+		domains[strings.ToLower(domain)] = true
+	}
+
+	return &acmeManager{
+		Manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.StoragePath),
+			HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+			Email:      cfg.Email,
+			Client:     &acme.Client{DirectoryURL: cfg.DirectoryURL},
+		},
+		domains: domains,
+	}
+}
+
+// handles checks whether a TLS handshake is an ACME challenge or requests
+// the certificate of an ACME domain.
+func (m *acmeManager) handles(hello *tls.ClientHelloInfo) bool {
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		return true
+	}
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	return m.domains[name]
+}
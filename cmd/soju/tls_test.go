@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+// writeTestCert writes a self-signed certificate for a host name and its
+// private key to a directory.
+func writeTestCert(t *testing.T, dir, host string) config.TLS {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	tlsCfg := config.TLS{
+		CertPath: filepath.Join(dir, host+".crt"),
+		KeyPath:  filepath.Join(dir, host+".key"),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(tlsCfg.CertPath, certPEM, 0644); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(tlsCfg.KeyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return tlsCfg
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-tls-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tlsCfgs := []config.TLS{
+		writeTestCert(t, dir, "irc.example.org"),
+		writeTestCert(t, dir, "irc.example.net"),
+	}
+
+	var cs certStore
+	if err := cs.Load(tlsCfgs, nil); err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+
+	for serverName, want := range map[string]string{
+		"irc.example.org":     "irc.example.org",
+		"irc.example.net":     "irc.example.net",
+		"unknown.example.com": "irc.example.org",
+		"":                    "irc.example.org",
+	} {
+		cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Errorf("failed to get certificate for %q: %v", serverName, err)
+			continue
+		}
+		if got := cert.Leaf.Subject.CommonName; got != want {
+			t.Errorf("got certificate for %q with server name %q, want %q", got, serverName, want)
+		}
+	}
+
+	if err := cs.Load([]config.TLS{{CertPath: filepath.Join(dir, "missing.crt"), KeyPath: filepath.Join(dir, "missing.key")}}, nil); err == nil {
+		t.Errorf("expected an error for a missing certificate")
+	}
+	// The previous certificates are kept on error
+	if cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "irc.example.net"}); err != nil || cert.Leaf.Subject.CommonName != "irc.example.net" {
+		t.Errorf("certificates not kept after a failed reload: %v", err)
+	}
+}
+
+func TestCertStoreACMEFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-tls-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing listens on this address, so obtaining certificates fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	directoryURL := "http://" + ln.Addr().String() + "/directory"
+	ln.Close()
+
+	m := newACMEManager(&config.ACME{
+		DirectoryURL: directoryURL,
+		Domains:      []string{"irc.example.org"},
+		StoragePath:  filepath.Join(dir, "acme"),
+	})
+
+	var cs certStore
+	if err := cs.Load(nil, m); err != nil {
+		t.Fatalf("failed to load ACME-only certificates: %v", err)
+	}
+	if _, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "irc.example.org"}); err == nil {
+		t.Errorf("expected an error without fallback certificates")
+	}
+	if _, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "irc.example.net"}); err == nil {
+		t.Errorf("expected an error for a domain not managed by ACME")
+	}
+
+	tlsCfg := writeTestCert(t, dir, "irc.example.org")
+	if err := cs.Load([]config.TLS{tlsCfg}, m); err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	for _, serverName := range []string{"irc.example.org", "irc.example.net"} {
+		cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Errorf("failed to get fallback certificate for %q: %v", serverName, err)
+		} else if cert.Leaf.Subject.CommonName != "irc.example.org" {
+			t.Errorf("got certificate for %q, want the TLS file", cert.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestACMEManagerHandles(t *testing.T) {
+	m := newACMEManager(&config.ACME{Domains: []string{"IRC.example.org"}, StoragePath: "/nonexistent"})
+	for _, tc := range []struct {
+		hello *tls.ClientHelloInfo
+		want  bool
+	}{
+		{&tls.ClientHelloInfo{ServerName: "irc.example.org"}, true},
+		{&tls.ClientHelloInfo{ServerName: "IRC.EXAMPLE.ORG."}, true},
+		{&tls.ClientHelloInfo{ServerName: "irc.example.net"}, false},
+		{&tls.ClientHelloInfo{}, false},
+		{&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}}, true},
+	} {
+		if got := m.handles(tc.hello); got != tc.want {
+			t.Errorf("handles(%q, %v) = %v, want %v", tc.hello.ServerName, tc.hello.SupportedProtos, got, tc.want)
+		}
+	}
+}
+
+func TestCertStoreACMELogRateLimit(t *testing.T) {
+	var cs certStore
+	if !cs.shouldLogACMEError() {
+		t.Errorf("first error not logged")
+	}
+	if cs.shouldLogACMEError() {
+		t.Errorf("second error logged immediately")
+	}
+}
+
+func TestCertStoreTLSConfigALPN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-tls-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tlsCfgs := []config.TLS{writeTestCert(t, dir, "irc.example.org")}
+
+	var cs certStore
+	if err := cs.Load(tlsCfgs, nil); err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	tlsCfg := cs.TLSConfig([]string{"irc"})
+
+	nextProtos := func() []string {
+		cfg, err := tlsCfg.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("failed to get TLS config: %v", err)
+		}
+		return cfg.NextProtos
+	}
+	if protos := nextProtos(); !reflect.DeepEqual(protos, []string{"irc"}) {
+		t.Errorf("got ALPN protocols %v without ACME, want [irc]", protos)
+	}
+
+	m := newACMEManager(&config.ACME{Domains: []string{"irc.example.org"}, StoragePath: filepath.Join(dir, "acme")})
+	if err := cs.Load(tlsCfgs, m); err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	if protos := nextProtos(); !reflect.DeepEqual(protos, []string{"irc", acme.ALPNProto}) {
+		t.Errorf("got ALPN protocols %v with ACME, want [irc %v]", protos, acme.ALPNProto)
+	}
+}
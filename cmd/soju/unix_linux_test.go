@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/irc.v3"
+
+	"git.sr.ht/~emersion/soju"
+	"git.sr.ht/~emersion/soju/config"
+)
+
+const testUnixPassword = "secret"
+
+func createTestUnixUser(t *testing.T, db soju.Database, username string) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(testUnixPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to generate bcrypt hash: %v", err)
+	}
+	record := &soju.User{Username: username, Password: string(hashed), Enabled: true}
+	if err := db.StoreUser(context.TODO(), record); err != nil {
+		t.Fatalf("failed to store user %q: %v", username, err)
+	}
+}
+
+type unixClient struct {
+	*irc.Conn
+	netConn net.Conn
+}
+
+func (c *unixClient) Close() error {
+	return c.netConn.Close()
+}
+
+// registerUnix registers a client on a Unix socket and returns the
+// RPL_WELCOME message. The password is omitted if empty.
+func registerUnix(t *testing.T, addr, username, password string) (*unixClient, *irc.Message) {
+	c, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to dial %q: %v", addr, err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	ic := &unixClient{Conn: irc.NewConn(c), netConn: c}
+
+	if password != "" {
+		ic.WriteMessage(&irc.Message{Command: "PASS", Params: []string{password}})
+	}
+	ic.WriteMessage(&irc.Message{Command: "NICK", Params: []string{username}})
+	ic.WriteMessage(&irc.Message{Command: "USER", Params: []string{username, "0", "*", username}})
+	return ic, expectUnixMessage(t, ic.Conn, irc.RPL_WELCOME)
+}
+
+func expectUnixMessage(t *testing.T, c *irc.Conn, cmd string) *irc.Message {
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message (want %q): %v", cmd, err)
+		}
+		if msg.Command == "ERROR" || msg.Command == irc.ERR_PASSWDMISMATCH {
+			t.Fatalf("unexpected %v (want %q)", msg, cmd)
+		}
+		if msg.Command == cmd {
+			return msg
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	current, err := osuser.Current()
+	if err != nil {
+		t.Skipf("failed to get current user: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "soju-unix-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := soju.OpenDB("sqlite3", filepath.Join(dir, "soju.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	createTestUnixUser(t, db, current.Username)
+	createTestUnixUser(t, db, "alice")
+
+	srv := soju.NewServer(db)
+	srv.Logger = soju.NewLogWriter(ioutil.Discard).Logger()
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	s := &server{srv: srv, listeners: &listenerSet{}}
+
+	path := filepath.Join(dir, "irc.sock")
+	l := config.NewListener("unix://" + path)
+	l.PeerAuth = true
+	l.ClientHost = "users.example.org"
+	rl, err := s.startListener(l)
+	if err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer rl.stop()
+
+	// Without a password, the client is logged in as its Unix user
+	c, msg := registerUnix(t, path, current.Username, "")
+	if msg.Params[0] != current.Username {
+		t.Errorf("got RPL_WELCOME for %q, want peer user %q", msg.Params[0], current.Username)
+	}
+	c.WriteMessage(&irc.Message{Command: "WHOIS", Params: []string{current.Username}})
+	msg = expectUnixMessage(t, c.Conn, irc.RPL_WHOISUSER)
+	if msg.Params[2] != current.Username || msg.Params[3] != "users.example.org" {
+		t.Errorf("got RPL_WHOISUSER %v, want user %q and client-host", msg.Params, current.Username)
+	}
+	c.Close()
+
+	// With a password, the usual authentication is used
+	c, msg = registerUnix(t, path, "alice", testUnixPassword)
+	if msg.Params[0] != "alice" {
+		t.Errorf("got RPL_WELCOME for %q, want password user alice", msg.Params[0])
+	}
+	c.WriteMessage(&irc.Message{Command: "WHOIS", Params: []string{"alice"}})
+	msg = expectUnixMessage(t, c.Conn, irc.RPL_WHOISUSER)
+	if msg.Params[2] != "alice" {
+		t.Errorf("got RPL_WHOISUSER %v, want user alice", msg.Params)
+	}
+	c.Close()
+
+	name := fmt.Sprintf("@soju-test-%v", os.Getpid())
+	u, err := parseListenURI("unix:" + name)
+	if err != nil {
+		t.Fatalf("failed to parse abstract socket URI: %v", err)
+	}
+	if u.Scheme != "unix" || u.Opaque != name {
+		t.Fatalf("got %+v for abstract socket URI", u)
+	}
+	rl, err = s.startListener(config.NewListener("unix:" + name))
+	if err != nil {
+		t.Fatalf("failed to start abstract socket listener: %v", err)
+	}
+	defer rl.stop()
+
+	c, msg = registerUnix(t, name, "alice", testUnixPassword)
+	if msg.Params[0] != "alice" {
+		t.Errorf("got RPL_WELCOME for %q on abstract socket, want alice", msg.Params[0])
+	}
+	c.WriteMessage(&irc.Message{Command: "WHOIS", Params: []string{"alice"}})
+	msg = expectUnixMessage(t, c.Conn, irc.RPL_WHOISUSER)
+	if msg.Params[3] != "localhost" {
+		t.Errorf("got host %q on abstract socket, want localhost", msg.Params[3])
+	}
+	c.Close()
+}
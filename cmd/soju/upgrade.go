@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~emersion/soju"
+)
+
+// During an upgrade, the previous process and the new one are connected by a
+// Unix socket. Once the new process has loaded its configuration and opened
+// the database, it sends upgradeReady. The previous process then sends the
+// upstream connections it hands over, each as a 4-byte big-endian length
+// carrying the file descriptor followed by the JSON-encoded state. A zero
+// length ends the list. The previous process closes the socket once it has
+// shut down.
+
+const upgradeReady = 'R'
+
+// upgradeTimeout is the maximum time the previous process waits for the new
+// one to be ready, and for upstream connections to be handed over.
+const upgradeTimeout = 30 * time.Second
+
+const maxHandoverSize = 16 * 1024 * 1024
+
+// upgradeConn is the socket connecting the new process to the previous one.
+type upgradeConn struct {
+	*net.UnixConn
+}
+
+// receiveHandovers notifies the previous process that this one is ready,
+// then returns the upstream connections it hands over. It blocks until the
+// previous process has shut down.
+func (uc *upgradeConn) receiveHandovers() ([]*soju.UpstreamHandover, error) {
+	defer uc.Close()
+
+	if _, err := uc.Write([]byte{upgradeReady}); err != nil {
+		return nil, err
+	}
+
+	var l []*soju.UpstreamHandover
+	for {
+		h, err := readHandover(uc.UnixConn)
+		if err != nil {
+			for _, h := range l {
+				h.File.Close()
+			}
+			io.Copy(ioutil.Discard, uc)
+			return nil, err
+		} else if h == nil {
+			break
+		}
+		l = append(l, h)
+	}
+
+	_, err := io.Copy(ioutil.Discard, uc)
+	return l, err
+}
+
+func readHandover(conn *net.UnixConn) (*soju.UpstreamHandover, error) {
+	var hdr [4]byte
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(hdr[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		for i := range msgs {
+			l, err := syscall.ParseUnixRights(&msgs[i])
+			if err != nil {
+				return nil, err
+			}
+			fds = append(fds, l...)
+		}
+	}
+	var files []*os.File
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "upstream"))
+	}
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	if _, err := io.ReadFull(conn, hdr[n:]); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size == 0 {
+		closeFiles()
+		return nil, nil
+	}
+	if len(files) != 1 {
+		closeFiles()
+		return nil, fmt.Errorf("expected one file descriptor, got %v", len(files))
+	}
+	if size > maxHandoverSize {
+		closeFiles()
+		return nil, fmt.Errorf("upstream connection state too large (%v bytes)", size)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	var h soju.UpstreamHandover
+	if err := json.Unmarshal(b, &h); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	h.File = files[0]
+	return &h, nil
+}
+
+// upgradeProcess is a new soju process started by an upgrade.
+type upgradeProcess struct {
+	conn          *net.UnixConn
+	process       *os.Process
+	unixListeners []*net.UnixListener
+}
+
+// waitReady waits for the new process to be ready to take over.
+func (up *upgradeProcess) waitReady(timeout time.Duration) error {
+	up.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer up.conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	if _, err := io.ReadFull(up.conn, b[:]); err == io.EOF {
+		return fmt.Errorf("new process exited")
+	} else if err != nil {
+		return err
+	}
+	if b[0] != upgradeReady {
+		return fmt.Errorf("unexpected byte %q from new process", b[0])
+	}
+	return nil
+}
+
+// abort stops the new process. This process keeps serving.
+func (up *upgradeProcess) abort() {
+	up.process.Kill()
+	up.process.Wait()
+	up.conn.Close()
+	for _, uln := range up.unixListeners {
+		uln.SetUnlinkOnClose(true)
+	}
+}
+
+// sendHandovers passes upstream connections to the new process. The files
+// are closed.
+func (up *upgradeProcess) sendHandovers(l []*soju.UpstreamHandover) error {
+	defer func() {
+		for _, h := range l {
+			h.File.Close()
+		}
+	}()
+
+	for _, h := range l {
+		if err := writeHandover(up.conn, h); err != nil {
+			return err
+		}
+	}
+	// End of the list
+	_, err := up.conn.Write(make([]byte, 4))
+	return err
+}
+
+func writeHandover(conn *net.UnixConn, h *soju.UpstreamHandover) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+	rights := syscall.UnixRights(int(h.File.Fd()))
+	if _, _, err := conn.WriteMsgUnix(hdr[:], rights, nil); err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// Close lets the new process start serving. It must be called once this
+// process has shut down.
+func (up *upgradeProcess) Close() error {
+	// Don't wait for the new process, it outlives this one
+	up.process.Release()
+	return up.conn.Close()
+}
+
+// sdNotify sends a state change to the service manager, see sd_notify(3). It
+// does nothing if the service manager doesn't accept notifications.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// Names starting with "@" are abstract sockets
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSDNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-upgrade-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "notify"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", addr.Name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("MAINPID=42"); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read notification: %v", err)
+	}
+	if got := string(buf[:n]); got != "MAINPID=42" {
+		t.Errorf("got notification %q, want %q", got, "MAINPID=42")
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("MAINPID=42"); err != nil {
+		t.Errorf("expected no error without a service manager, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"git.sr.ht/~emersion/soju"
+)
+
+// openDBURI opens a database described as "driver:source", for instance
+// "sqlite3:soju.db".
+func openDBURI(uri string, mustExist bool) (soju.Database, error) {
+	parts := strings.SplitN(uri, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid database %q: expected driver:source", uri)
+	}
+	driver, source := parts[0], parts[1]
+
+	// Opening a SQLite database which doesn't exist creates it
+	if driver == "sqlite3" && mustExist {
+		if _, err := os.Stat(source); err != nil {
+			return nil, fmt.Errorf("failed to open database %q: %v", uri, err)
+		}
+	}
+
+	db, err := soju.OpenDB(driver, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %q: %v", uri, err)
+	}
+	return db, nil
+}
+
+func runDBCommand(args []string) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "source database")
+	to := fs.String("to", "", "destination database")
+	fs.Parse(args[1:])
+
+	if *from == "" || *to == "" || fs.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	src, err := openDBURI(*from, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := openDBURI(*to, false)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err := soju.MigrateDB(context.Background(), src, dst); err != nil {
+		return fmt.Errorf("failed to migrate database: %v", err)
+	}
+
+	stats, err := dst.Stats(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to query database statistics: %v", err)
+	}
+	log.Printf("migrated %v users, %v networks and %v channels", stats.Users, stats.Networks, stats.Channels)
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"git.sr.ht/~emersion/soju"
 	"git.sr.ht/~emersion/soju/config"
@@ -17,9 +19,34 @@ import (
 
 const usage = `usage: sojuctl [-config path] <action> [options...]
 
-  create-user <username> [-admin]  Create a new user
-  change-password <username>       Change password for a user
-  help                             Show this help message
+  create-user <username> [-admin]                     Create a new user
+  change-password <username>                          Change password for a user
+  list-users                                          List users
+  delete-user <username>                              Delete a user
+  set-admin <username> <true|false>                   Grant or revoke admin privileges
+  suspend-user <username>                             Suspend a user
+  resume-user <username>                              Resume a suspended user
+  list-networks <username>                            List the networks of a user
+  create-network <username> -addr <addr> [options...] Create a network
+  update-network <username> <network> [options...]    Update a network
+  delete-network <username> <network>                 Delete a network
+  list-channels <username> <network>                  List the channels of a network
+  create-channel <username> <network> <channel> [options...]
+                                                      Create a channel
+  update-channel <username> <network> <channel> [options...]
+                                                      Update a channel
+  delete-channel <username> <network> <channel>       Delete a channel
+  stats                                               Show database statistics
+  run [-addr addr] -username <username> <command...>  Run a service command
+  audit [options...]                                  Query the audit log
+  backup [-logs] <file>                               Write a backup archive
+  restore [-force] [-logs] <file>                     Restore a backup archive
+  db migrate -from <driver:source> -to <driver:source>
+                                                      Copy a database to another one
+  help                                                Show this help message
+
+Network and channel options are the same as the ones accepted by the
+"network update" and "channel update" service commands.
 `
 
 func init() {
@@ -44,6 +71,13 @@ func main() {
 		cfg = config.Defaults()
 	}
 
+	if flag.Arg(0) == "db" {
+		if err := runDBCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	db, err := soju.OpenDB(cfg.SQLDriver, cfg.SQLSource)
 	if err != nil {
 		log.Fatalf("failed to open database: %v", err)
@@ -75,11 +109,15 @@ func main() {
 			Username: username,
 			Password: string(hashed),
 			Admin:    *admin,
+			Enabled:  true,
 		}
-		if err := db.StoreUser(context.TODO(), &user); err != nil {
+		err = db.StoreUser(context.TODO(), &user)
+		recordAudit(db, "user.create", username, err)
+		if err != nil {
 			log.Fatalf("failed to create user: %v", err)
 		}
 	case "change-password":
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> user update <username> -password <password>" instead`)
 		username := flag.Arg(1)
 		if username == "" {
 			flag.Usage()
@@ -102,9 +140,285 @@ func main() {
 		}
 
 		user.Password = string(hashed)
-		if err := db.StoreUser(context.TODO(), user); err != nil {
+		err = db.StoreUser(context.TODO(), user)
+		recordAudit(db, "user.update", username, err)
+		if err != nil {
 			log.Fatalf("failed to update password: %v", err)
 		}
+	case "suspend-user", "resume-user":
+		// The running bouncer needs to disconnect the user first, and would
+		// overwrite the change on the next user update
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> user suspend|resume <username>" instead`)
+		username := flag.Arg(1)
+		if username == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		user, err := db.GetUser(context.TODO(), username)
+		if err != nil {
+			log.Fatalf("failed to get user: %v", err)
+		}
+
+		action := "user.suspend"
+		if cmd == "resume-user" {
+			action = "user.resume"
+		}
+
+		user.Enabled = cmd == "resume-user"
+		err = db.StoreUser(context.TODO(), user)
+		recordAudit(db, action, username, err)
+		if err != nil {
+			log.Fatalf("failed to update user: %v", err)
+		}
+	case "audit":
+		filter, err := soju.ParseAuditFilter(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("invalid audit filter: %v", err)
+		}
+
+		entries, err := db.ListAuditEntries(context.TODO(), filter)
+		if err != nil {
+			log.Fatalf("failed to query audit log: %v", err)
+		}
+
+		for i := len(entries) - 1; i >= 0; i-- {
+			fmt.Println(soju.FormatAuditEntry(&entries[i]))
+		}
+	case "list-users":
+		users, err := db.ListUsers(context.TODO())
+		if err != nil {
+			log.Fatalf("failed to list users: %v", err)
+		}
+		for _, user := range users {
+			var flags []string
+			if user.Admin {
+				flags = append(flags, "admin")
+			}
+			if !user.Enabled {
+				flags = append(flags, "suspended")
+			}
+			if len(flags) > 0 {
+				fmt.Printf("%v [%v]\n", user.Username, strings.Join(flags, ", "))
+			} else {
+				fmt.Println(user.Username)
+			}
+		}
+	case "delete-user":
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> user delete <username>" instead`)
+		user := getUser(db, flag.Arg(1))
+
+		err := db.DeleteUser(context.TODO(), user.ID)
+		recordAudit(db, "user.delete", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to delete user: %v", err)
+		}
+	case "set-admin":
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> user update <username> -admin <true|false>" instead`)
+		user := getUser(db, flag.Arg(1))
+		admin, err := strconv.ParseBool(flag.Arg(2))
+		if err != nil {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		user.Admin = admin
+		err = db.StoreUser(context.TODO(), user)
+		recordAudit(db, "user.update", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to update user: %v", err)
+		}
+	case "list-networks":
+		user := getUser(db, flag.Arg(1))
+
+		networks, err := db.ListNetworks(context.TODO(), user.ID)
+		if err != nil {
+			log.Fatalf("failed to list networks: %v", err)
+		}
+		for _, network := range networks {
+			status := "enabled"
+			if !network.Enabled {
+				status = "disabled"
+			}
+			fmt.Printf("%v (%v) [%v]\n", network.GetName(), network.Addr, status)
+		}
+	case "create-network":
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> network create -user <username> ..." instead`)
+		user := getUser(db, flag.Arg(1))
+
+		network := soju.Network{Enabled: true}
+		if err := soju.ParseNetworkFlags(&network, flag.Args()[2:]); err != nil {
+			log.Fatalf("invalid network options: %v", err)
+		}
+		if network.Addr == "" {
+			log.Fatalf("flag -addr is required")
+		}
+		checkNetwork(cfg, db, user, &network)
+
+		err := db.StoreNetwork(context.TODO(), user.ID, &network)
+		recordAudit(db, "network.create", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to create network: %v", err)
+		}
+	case "update-network":
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> network update -user <username> ..." instead`)
+		user := getUser(db, flag.Arg(1))
+		network := getNetwork(db, user, flag.Arg(2))
+
+		if err := soju.ParseNetworkFlags(network, flag.Args()[3:]); err != nil {
+			log.Fatalf("invalid network options: %v", err)
+		}
+		checkNetwork(cfg, db, user, network)
+
+		err := db.StoreNetwork(context.TODO(), user.ID, network)
+		recordAudit(db, "network.update", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to update network: %v", err)
+		}
+	case "delete-network":
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> network delete -user <username> <network>" instead`)
+		user := getUser(db, flag.Arg(1))
+		network := getNetwork(db, user, flag.Arg(2))
+
+		err := db.DeleteNetwork(context.TODO(), network.ID)
+		recordAudit(db, "network.delete", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to delete network: %v", err)
+		}
+	case "list-channels":
+		user := getUser(db, flag.Arg(1))
+		network := getNetwork(db, user, flag.Arg(2))
+
+		channels, err := db.ListChannels(context.TODO(), network.ID)
+		if err != nil {
+			log.Fatalf("failed to list channels: %v", err)
+		}
+		for _, ch := range channels {
+			name := ch.Name
+			if ch.Detached {
+				name += " [detached]"
+			}
+			fmt.Printf("%v: %v\n", name, soju.FormatChannelSettings(ch.ChannelSettings, network.ChannelDefaults, user.ChannelDefaults))
+		}
+	case "create-channel":
+		checkServerStopped(cfg, "stop it before creating channels, or join them from a client")
+		user := getUser(db, flag.Arg(1))
+		network := getNetwork(db, user, flag.Arg(2))
+		name := flag.Arg(3)
+		if name == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if _, err := findChannel(db, network, name); err == nil {
+			log.Fatalf("channel %q already exists", name)
+		}
+
+		ch := soju.Channel{Name: name}
+		if err := soju.ParseChannelFlags(&ch.ChannelSettings, flag.Args()[4:]); err != nil {
+			log.Fatalf("invalid channel options: %v", err)
+		}
+
+		err := db.StoreChannel(context.TODO(), network.ID, &ch)
+		recordAudit(db, "channel.create", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to create channel: %v", err)
+		}
+	case "update-channel":
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> channel update -user <username> <channel>/<network> ..." instead`)
+		user := getUser(db, flag.Arg(1))
+		network := getNetwork(db, user, flag.Arg(2))
+		ch := getChannel(db, network, flag.Arg(3))
+
+		if err := soju.ParseChannelFlags(&ch.ChannelSettings, flag.Args()[4:]); err != nil {
+			log.Fatalf("invalid channel options: %v", err)
+		}
+
+		err := db.StoreChannel(context.TODO(), network.ID, ch)
+		recordAudit(db, "channel.update", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to update channel: %v", err)
+		}
+	case "delete-channel":
+		checkServerStopped(cfg, "stop it before deleting channels, or part them from a client")
+		user := getUser(db, flag.Arg(1))
+		network := getNetwork(db, user, flag.Arg(2))
+		ch := getChannel(db, network, flag.Arg(3))
+
+		err := db.DeleteChannel(context.TODO(), ch.ID)
+		recordAudit(db, "channel.delete", user.Username, err)
+		if err != nil {
+			log.Fatalf("failed to delete channel: %v", err)
+		}
+	case "stats":
+		stats, err := db.Stats(context.TODO())
+		if err != nil {
+			log.Fatalf("failed to query database statistics: %v", err)
+		}
+		fmt.Printf("%v users, %v networks, %v channels\n", stats.Users, stats.Networks, stats.Channels)
+	case "backup":
+		// The bouncer needs to be paused for the backup to be consistent
+		checkServerStopped(cfg, `use "sojuctl run -username <admin> server backup [-logs] <path>" instead`)
+		fs := flag.NewFlagSet("", flag.ExitOnError)
+		withLogs := fs.Bool("logs", false, "include message logs")
+		fs.Parse(flag.Args()[1:])
+		if fs.NArg() != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		var logPath string
+		if *withLogs {
+			if cfg.LogPath == "" {
+				log.Fatalf("message logging is disabled in the configuration file")
+			}
+			logPath = cfg.LogPath
+		}
+
+		f, err := os.OpenFile(fs.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("failed to create backup file: %v", err)
+		}
+		err = soju.WriteBackup(context.TODO(), f, db, logPath)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(fs.Arg(0))
+			log.Fatalf("failed to write backup: %v", err)
+		}
+	case "restore":
+		checkServerStopped(cfg, "stop it before restoring a backup")
+		fs := flag.NewFlagSet("", flag.ExitOnError)
+		force := fs.Bool("force", false, "delete existing users before restoring")
+		withLogs := fs.Bool("logs", false, "restore message logs")
+		fs.Parse(flag.Args()[1:])
+		if fs.NArg() != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		var logPath string
+		if *withLogs {
+			if cfg.LogPath == "" {
+				log.Fatalf("message logging is disabled in the configuration file")
+			}
+			logPath = cfg.LogPath
+		}
+
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("failed to open backup file: %v", err)
+		}
+		err = soju.RestoreBackup(context.TODO(), f, db, logPath, *force)
+		f.Close()
+		recordAudit(db, "server.restore", "", err)
+		if err != nil {
+			log.Fatalf("failed to restore backup: %v", err)
+		}
+	case "run":
+		if err := runServiceCommand(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
 	default:
 		flag.Usage()
 		if cmd != "help" {
@@ -113,6 +427,109 @@ func main() {
 	}
 }
 
+func getUser(db soju.Database, username string) *soju.User {
+	if username == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	user, err := db.GetUser(context.TODO(), username)
+	if err != nil {
+		log.Fatalf("failed to get user: %v", err)
+	}
+	return user
+}
+
+func findNetwork(db soju.Database, user *soju.User, name string) (*soju.Network, error) {
+	networks, err := db.ListNetworks(context.TODO(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range networks {
+		if networks[i].GetName() == name {
+			return &networks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+func getNetwork(db soju.Database, user *soju.User, name string) *soju.Network {
+	if name == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	network, err := findNetwork(db, user, name)
+	if err != nil {
+		log.Fatalf("failed to get network: %v", err)
+	}
+	return network
+}
+
+// checkNetwork applies the same checks as the bouncer before storing a
+// network: unique name, maximum number of networks and user quotas.
+func checkNetwork(cfg *config.Server, db soju.Database, user *soju.User, network *soju.Network) {
+	networks, err := db.ListNetworks(context.TODO(), user.ID)
+	if err != nil {
+		log.Fatalf("failed to list networks: %v", err)
+	}
+	srvCfg := &soju.Config{
+		MaxUserNetworks:        cfg.MaxUserNetworks,
+		MaxUserChannels:        cfg.MaxUserChannels,
+		MaxUserDownstreams:     cfg.MaxUserDownstreams,
+		MaxUserLogSize:         cfg.MaxUserLogSize,
+		MaxUserConnectCommands: cfg.MaxUserConnectCommands,
+	}
+	if err := soju.CheckNetwork(srvCfg, user, networks, network); err != nil {
+		log.Fatalf("invalid network: %v", err)
+	}
+}
+
+// checkServerStopped exits if soju is running: it wouldn't notice changes
+// made directly to the database, and could overwrite them. hint tells the
+// user what to do instead, usually sending a service command with
+// "sojuctl run".
+func checkServerStopped(cfg *config.Server, hint string) {
+	addr, err := probeServer(cfg)
+	if err != nil {
+		log.Fatalf("failed to check whether soju is running (%v), stop it first", err)
+	} else if addr != "" {
+		log.Fatalf("soju is running (listening on %q), %v", addr, hint)
+	}
+}
+
+func findChannel(db soju.Database, network *soju.Network, name string) (*soju.Channel, error) {
+	channels, err := db.ListChannels(context.TODO(), network.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range channels {
+		if channels[i].Name == name {
+			return &channels[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown channel %q", name)
+}
+
+func getChannel(db soju.Database, network *soju.Network, name string) *soju.Channel {
+	if name == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	ch, err := findChannel(db, network, name)
+	if err != nil {
+		log.Fatalf("failed to get channel: %v", err)
+	}
+	return ch
+}
+
+func recordAudit(db soju.Database, action, target string, actionErr error) {
+	if err := soju.RecordSojuctlAudit(context.TODO(), db, action, target, actionErr); err != nil {
+		log.Printf("failed to store audit log entry: %v", err)
+	}
+}
+
 func readPassword() ([]byte, error) {
 	var password []byte
 	var err error
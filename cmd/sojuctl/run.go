@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~emersion/soju/config"
+	"gopkg.in/irc.v3"
+)
+
+const (
+	serviceNick  = "BouncerServ"
+	runTimeout   = 30 * time.Second
+	runPingText  = "sojuctl"
+	probeTimeout = 5 * time.Second
+)
+
+// dialServer connects to a soju listener. If addr is empty, the first IRC
+// listener of the configuration file is used.
+func dialServer(cfg *config.Server, addr string) (net.Conn, error) {
+	serverName := cfg.Hostname
+	if addr == "" {
+		for _, l := range cfg.Listen {
+			listen := l.URI
+			if strings.HasPrefix(listen, "ircs://") || strings.HasPrefix(listen, "irc+insecure://") || strings.HasPrefix(listen, "unix:") || !strings.Contains(listen, ":/") {
+				addr = listen
+				if l.Hostname != "" {
+					serverName = l.Hostname
+				}
+				break
+			}
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("no IRC listener found in the configuration file, please specify -addr")
+		}
+	}
+
+	if !strings.Contains(addr, ":/") && !strings.HasPrefix(addr, "unix:") {
+		// This is a raw domain name, make it an URL with an empty scheme
+		addr = "//" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse address %q: %v", addr, err)
+	}
+
+	dialer := net.Dialer{Timeout: runTimeout}
+	switch u.Scheme {
+	case "ircs", "":
+		host, isLocal := dialHost(u.Host, "6697")
+		tlsConfig := &tls.Config{ServerName: u.Hostname()}
+		if isLocal {
+			// The certificate is issued for the public hostname
+			tlsConfig.ServerName = serverName
+		}
+		return tls.DialWithDialer(&dialer, "tcp", host, tlsConfig)
+	case "irc+insecure":
+		host, _ := dialHost(u.Host, "6667")
+		return dialer.Dial("tcp", host)
+	case "unix":
+		if u.Opaque != "" {
+			// Abstract socket, e.g. "unix:@soju"
+			return dialer.Dial("unix", u.Opaque)
+		}
+		return dialer.Dial("unix", u.Path)
+	default:
+		return nil, fmt.Errorf("failed to connect to %q: unsupported scheme", addr)
+	}
+}
+
+// probeServer checks whether soju is listening on one of the addresses of the
+// configuration file, and returns the first one accepting connections. Only a
+// plain TCP or Unix connection is attempted, so that the result doesn't depend
+// on TLS certificates. Errors other than a refused connection or a missing
+// socket file are returned, since soju might be running.
+func probeServer(cfg *config.Server) (string, error) {
+	listen := []string{":6697"} // default listener of soju
+	if len(cfg.Listen) > 0 {
+		listen = nil
+		for _, l := range cfg.Listen {
+			listen = append(listen, l.URI)
+		}
+	}
+
+	for _, addr := range listen {
+		network, dialAddr, err := probeAddr(addr)
+		if err != nil {
+			return "", err
+		}
+		conn, err := net.DialTimeout(network, dialAddr, probeTimeout)
+		if err == nil {
+			conn.Close()
+			return addr, nil
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to connect to %q: %v", addr, err)
+		}
+	}
+	return "", nil
+}
+
+// probeAddr returns the address to dial to reach a listener.
+func probeAddr(addr string) (network, dialAddr string, err error) {
+	listen := addr
+	if !strings.Contains(listen, ":/") && !strings.HasPrefix(listen, "unix:") {
+		// This is a raw domain name, make it an URL with an empty scheme
+		listen = "//" + listen
+	}
+	u, err := url.Parse(listen)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse listen URI %q: %v", addr, err)
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "ircs", "":
+		defaultPort = "6697"
+	case "irc+insecure":
+		defaultPort = "6667"
+	case "wss":
+		defaultPort = "https"
+	case "ws+insecure":
+		defaultPort = "http"
+	case "ident":
+		defaultPort = "113"
+	case "unix":
+		if u.Opaque != "" {
+			// Abstract socket, e.g. "unix:@soju"
+			return "unix", u.Opaque, nil
+		}
+		return "unix", u.Path, nil
+	default:
+		return "", "", fmt.Errorf("unsupported listen URI %q", addr)
+	}
+	host, _ := dialHost(u.Host, defaultPort)
+	return "tcp", host, nil
+}
+
+// dialHost turns a listen address into an address suitable for dialing.
+// Listeners bound to all interfaces are reached via localhost.
+func dialHost(host, defaultPort string) (addr string, isLocal bool) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, defaultPort
+	}
+
+	ip := net.ParseIP(hostname)
+	if hostname == "" || (ip != nil && ip.IsUnspecified()) {
+		hostname = "localhost"
+	}
+	isLocal = hostname == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified()))
+	return net.JoinHostPort(hostname, port), isLocal
+}
+
+// runServiceCommand connects to a running soju instance and runs a
+// BouncerServ command. Replies are printed on stdout.
+func runServiceCommand(cfg *config.Server, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	addr := fs.String("addr", "", "server address, defaults to the first listener")
+	username := fs.String("username", "", "bouncer username")
+	fs.Parse(args)
+
+	if *username == "" || fs.NArg() == 0 {
+		flag.Usage()
+		return fmt.Errorf("a username and a command are required")
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return fmt.Errorf("failed to read password: %v", err)
+	}
+
+	netConn, err := dialServer(cfg, *addr)
+	if err != nil {
+		return err
+	}
+	defer netConn.Close()
+	netConn.SetDeadline(time.Now().Add(runTimeout))
+
+	c := irc.NewConn(netConn)
+	for _, msg := range []*irc.Message{
+		{Command: "PASS", Params: []string{string(password)}},
+		{Command: "NICK", Params: []string{*username}},
+		{Command: "USER", Params: []string{*username, "0", "*", "sojuctl"}},
+	} {
+		if err := c.WriteMessage(msg); err != nil {
+			return fmt.Errorf("failed to register: %v", err)
+		}
+	}
+
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("failed to read message: %v", err)
+		}
+
+		switch msg.Command {
+		case irc.RPL_WELCOME:
+			// Service commands are processed in order, the PONG reply marks
+			// the end of the command output
+			err := c.WriteMessage(&irc.Message{
+				Command: "PRIVMSG",
+				Params:  []string{serviceNick, quoteWords(fs.Args())},
+			})
+			if err == nil {
+				err = c.WriteMessage(&irc.Message{
+					Command: "PING",
+					Params:  []string{runPingText},
+				})
+			}
+			if err != nil {
+				return fmt.Errorf("failed to send command: %v", err)
+			}
+		case "PRIVMSG":
+			if msg.Prefix != nil && msg.Prefix.Name == serviceNick && len(msg.Params) >= 2 {
+				fmt.Println(msg.Params[1])
+			}
+		case "PONG":
+			if len(msg.Params) > 0 && msg.Params[len(msg.Params)-1] == runPingText {
+				return nil
+			}
+		case "ERROR", irc.ERR_PASSWDMISMATCH:
+			return fmt.Errorf("failed to authenticate: %v", msg.Params[len(msg.Params)-1])
+		}
+	}
+}
+
+// quoteWords joins command words so that they are split back identically by
+// the service.
+func quoteWords(words []string) string {
+	l := make([]string, len(words))
+	for i, word := range words {
+		if word != "" && !strings.ContainsAny(word, " \t'\"\\") {
+			l[i] = word
+			continue
+		}
+		word = strings.ReplaceAll(word, `\`, `\\`)
+		word = strings.ReplaceAll(word, "'", `\'`)
+		l[i] = "'" + word + "'"
+	}
+	return strings.Join(l, " ")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+func TestProbeServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sojuctl-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	tcpAddr := ln.Addr().String()
+
+	sockPath := filepath.Join(dir, "irc.sock")
+	unixLn, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer unixLn.Close()
+
+	cfg := config.Defaults()
+	// A TLS listener is probed without a TLS handshake
+	cfg.Listen = []config.Listener{
+		config.NewListener("unix://" + filepath.Join(dir, "missing.sock")),
+		config.NewListener("ircs://" + tcpAddr),
+	}
+	if addr, err := probeServer(cfg); err != nil || addr != "ircs://"+tcpAddr {
+		t.Errorf("probeServer() = %q, %v, want the TCP listener", addr, err)
+	}
+
+	ln.Close()
+	if addr, err := probeServer(cfg); err != nil || addr != "" {
+		t.Errorf("probeServer() = %q, %v, want no running server", addr, err)
+	}
+
+	cfg.Listen = append(cfg.Listen, config.NewListener("unix://"+sockPath))
+	if addr, err := probeServer(cfg); err != nil || addr != "unix://"+sockPath {
+		t.Errorf("probeServer() = %q, %v, want the Unix listener", addr, err)
+	}
+
+	cfg.Listen = []config.Listener{config.NewListener("foo://")}
+	if _, err := probeServer(cfg); err == nil {
+		t.Errorf("expected an error for an unsupported listener")
+	}
+}
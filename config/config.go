@@ -5,6 +5,8 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"git.sr.ht/~emersion/go-scfg"
 )
@@ -36,9 +38,37 @@ type TLS struct {
 	CertPath, KeyPath string
 }
 
+// ACME contains the settings of the acme directive.
+type ACME struct {
+	DirectoryURL string // empty means Let's Encrypt
+	Email        string
+	Domains      []string
+	StoragePath  string
+}
+
+// Listener contains the settings of a listen directive.
+type Listener struct {
+	URI string
+	// Certificates picked by SNI, overriding the tls directives if non-empty
+	TLS []TLS
+	// Accept PROXY protocol headers from accept-proxy-ip addresses
+	ProxyProtocol bool
+	HTTPOrigins   []string // nil means the http-origin directive applies
+	Hostname      string   // empty means the hostname directive applies
+	ClientHost    string   // host shown to clients, empty means their address
+	// Log Unix socket clients in as the user named after their Unix user
+	PeerAuth bool
+}
+
+// NewListener returns the settings of a listen directive without any option.
+func NewListener(uri string) Listener {
+	return Listener{URI: uri, ProxyProtocol: true}
+}
+
 type Server struct {
-	Listen   []string
-	TLS      *TLS
+	Listen   []Listener
+	TLS      []TLS // picked by SNI, the first one is the default
+	ACME     *ACME
 	Hostname string
 	Title    string
 	MOTDPath string
@@ -47,10 +77,28 @@ type Server struct {
 	SQLSource string
 	LogPath   string
 
-	HTTPOrigins    []string
-	AcceptProxyIPs IPSet
+	// Server log settings, as opposed to the message logs above
+	ServerLogLevel  string
+	ServerLogFormat string
+
+	OidentdPath string
 
-	MaxUserNetworks int
+	HTTPOrigins          []string
+	HTTPRoot             string
+	WebSocketCompression string
+	AcceptProxyIPs       IPSet
+
+	MaxUserNetworks        int
+	MaxUserChannels        int
+	MaxUserDownstreams     int
+	MaxUserLogSize         int64
+	MaxUserConnectCommands int
+	ClientExpiry           time.Duration
+
+	LoginMaxFailures       int
+	LoginLockout           time.Duration
+	MaxIPUnregisteredConns int
+	MaxIPConns             int
 }
 
 func Defaults() *Server {
@@ -63,11 +111,25 @@ func Defaults() *Server {
 		SQLDriver:       "sqlite3",
 		SQLSource:       "soju.db",
 		MaxUserNetworks: -1,
+
+		ServerLogLevel:  "info",
+		ServerLogFormat: "text",
+
+		MaxUserChannels:        -1,
+		MaxUserDownstreams:     -1,
+		MaxUserLogSize:         -1,
+		MaxUserConnectCommands: -1,
+
+		LoginMaxFailures:       0,
+		LoginLockout:           15 * time.Minute,
+		MaxIPUnregisteredConns: -1,
+		MaxIPConns:             -1,
 	}
 }
 
 func Load(path string) (*Server, error) {
-	cfg, err := scfg.Load(path)
+	l := loader{visited: make(map[string]bool)}
+	cfg, err := l.loadBlock(path, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -83,7 +145,11 @@ func parse(cfg scfg.Block) (*Server, error) {
 			if err := d.ParseParams(&uri); err != nil {
 				return nil, err
 			}
-			srv.Listen = append(srv.Listen, uri)
+			l, err := parseListener(uri, d.Children)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			srv.Listen = append(srv.Listen, l)
 		case "hostname":
 			if err := d.ParseParams(&srv.Hostname); err != nil {
 				return nil, err
@@ -97,11 +163,17 @@ func parse(cfg scfg.Block) (*Server, error) {
 				return nil, err
 			}
 		case "tls":
-			tls := &TLS{}
+			var tls TLS
 			if err := d.ParseParams(&tls.CertPath, &tls.KeyPath); err != nil {
 				return nil, err
 			}
-			srv.TLS = tls
+			srv.TLS = append(srv.TLS, tls)
+		case "acme":
+			acme, err := parseACME(d.Children)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			srv.ACME = acme
 		case "db":
 			if err := d.ParseParams(&srv.SQLDriver, &srv.SQLSource); err != nil {
 				return nil, err
@@ -114,8 +186,43 @@ func parse(cfg scfg.Block) (*Server, error) {
 			if driver != "fs" {
 				return nil, fmt.Errorf("directive %q: unknown driver %q", d.Name, driver)
 			}
+		case "server-log-level":
+			if err := d.ParseParams(&srv.ServerLogLevel); err != nil {
+				return nil, err
+			}
+			switch srv.ServerLogLevel {
+			case "debug", "info", "error":
+			default:
+				return nil, fmt.Errorf("directive %q: unknown level %q", d.Name, srv.ServerLogLevel)
+			}
+		case "server-log-format":
+			if err := d.ParseParams(&srv.ServerLogFormat); err != nil {
+				return nil, err
+			}
+			switch srv.ServerLogFormat {
+			case "text", "json":
+			default:
+				return nil, fmt.Errorf("directive %q: unknown format %q", d.Name, srv.ServerLogFormat)
+			}
+		case "oidentd":
+			if err := d.ParseParams(&srv.OidentdPath); err != nil {
+				return nil, err
+			}
 		case "http-origin":
 			srv.HTTPOrigins = d.Params
+		case "websocket-compression":
+			if err := d.ParseParams(&srv.WebSocketCompression); err != nil {
+				return nil, err
+			}
+			switch srv.WebSocketCompression {
+			case "disabled", "no-context-takeover", "context-takeover":
+			default:
+				return nil, fmt.Errorf("directive %q: unknown mode %q", d.Name, srv.WebSocketCompression)
+			}
+		case "http-root":
+			if err := d.ParseParams(&srv.HTTPRoot); err != nil {
+				return nil, err
+			}
 		case "accept-proxy-ip":
 			srv.AcceptProxyIPs = nil
 			for _, s := range d.Params {
@@ -138,6 +245,65 @@ func parse(cfg scfg.Block) (*Server, error) {
 			if srv.MaxUserNetworks, err = strconv.Atoi(max); err != nil {
 				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
 			}
+		case "max-user-channels", "max-user-downstreams", "max-user-connect-commands":
+			var max string
+			if err := d.ParseParams(&max); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(max)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			switch d.Name {
+			case "max-user-channels":
+				srv.MaxUserChannels = v
+			case "max-user-downstreams":
+				srv.MaxUserDownstreams = v
+			case "max-user-connect-commands":
+				srv.MaxUserConnectCommands = v
+			}
+		case "max-user-log-size":
+			var max string
+			if err := d.ParseParams(&max); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.MaxUserLogSize, err = ParseSize(max); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+		case "client-expiry":
+			var s string
+			if err := d.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.ClientExpiry, err = parseDuration(s); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+		case "login-lockout":
+			var attempts, lockout string
+			if err := d.ParseParams(&attempts, &lockout); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.LoginMaxFailures, err = strconv.Atoi(attempts); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			if srv.LoginLockout, err = parseDuration(lockout); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+		case "max-ip-connections":
+			var unregistered, registered string
+			if err := d.ParseParams(&unregistered, &registered); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.MaxIPUnregisteredConns, err = strconv.Atoi(unregistered); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			if srv.MaxIPConns, err = strconv.Atoi(registered); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
 		default:
 			return nil, fmt.Errorf("unknown directive %q", d.Name)
 		}
@@ -145,3 +311,129 @@ func parse(cfg scfg.Block) (*Server, error) {
 
 	return srv, nil
 }
+
+func parseACME(children scfg.Block) (*ACME, error) {
+	acme := &ACME{}
+	for _, d := range children {
+		var err error
+		switch d.Name {
+		case "directory":
+			err = d.ParseParams(&acme.DirectoryURL)
+		case "email":
+			err = d.ParseParams(&acme.Email)
+		case "domains":
+			if len(d.Params) == 0 {
+				err = fmt.Errorf("directive %q: expected at least one domain", d.Name)
+			}
+			acme.Domains = append(acme.Domains, d.Params...)
+		case "storage":
+			err = d.ParseParams(&acme.StoragePath)
+		default:
+			err = fmt.Errorf("unknown directive %q", d.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(acme.Domains) == 0 {
+		return nil, fmt.Errorf("missing domains")
+	}
+	if acme.StoragePath == "" {
+		return nil, fmt.Errorf("missing storage path")
+	}
+	return acme, nil
+}
+
+func parseListener(uri string, children scfg.Block) (Listener, error) {
+	l := NewListener(uri)
+	for _, d := range children {
+		switch d.Name {
+		case "tls":
+			var tls TLS
+			if err := d.ParseParams(&tls.CertPath, &tls.KeyPath); err != nil {
+				return l, err
+			}
+			l.TLS = append(l.TLS, tls)
+		case "proxy-protocol":
+			var s string
+			if err := d.ParseParams(&s); err != nil {
+				return l, err
+			}
+			var err error
+			if l.ProxyProtocol, err = strconv.ParseBool(s); err != nil {
+				return l, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+		case "http-origin":
+			l.HTTPOrigins = d.Params
+		case "hostname":
+			if err := d.ParseParams(&l.Hostname); err != nil {
+				return l, err
+			}
+		case "client-host":
+			if err := d.ParseParams(&l.ClientHost); err != nil {
+				return l, err
+			}
+		case "peer-auth":
+			var s string
+			if err := d.ParseParams(&s); err != nil {
+				return l, err
+			}
+			var err error
+			if l.PeerAuth, err = strconv.ParseBool(s); err != nil {
+				return l, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			if l.PeerAuth && !strings.HasPrefix(uri, "unix:") {
+				return l, fmt.Errorf("directive %q: only supported on Unix socket listeners", d.Name)
+			}
+			if l.PeerAuth && strings.HasPrefix(uri, "unix:@") {
+				return l, fmt.Errorf("directive %q: not supported on abstract Unix sockets", d.Name)
+			}
+		default:
+			return l, fmt.Errorf("unknown directive %q", d.Name)
+		}
+	}
+	return l, nil
+}
+
+// parseDuration is like time.ParseDuration, but also accepts a number of days
+// with the "d" suffix.
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	} else if d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// ParseSize parses a size in bytes, with an optional K, M, G or T suffix
+// (powers of 1024). -1 means no limit.
+func ParseSize(s string) (int64, error) {
+	if s == "-1" {
+		return -1, nil
+	}
+
+	mul := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(strings.ToUpper(s), suffix) {
+			mul = 1 << (10 * uint(i+1))
+			s = s[:len(s)-1]
+			break
+		}
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v * mul, nil
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+func parseTestBlock(t *testing.T, s string) scfg.Block {
+	block, err := scfg.Read(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	return block
+}
+
+func TestParseListener(t *testing.T) {
+	testCases := []struct {
+		name string
+		conf string
+		want *Listener // nil if an error is expected
+	}{
+		{
+			name: "bare",
+			conf: "listen ircs://",
+			want: &Listener{URI: "ircs://", ProxyProtocol: true},
+		},
+		{
+			name: "options",
+			conf: `listen wss://0.0.0.0:443 {
+	tls cert.pem key.pem
+	tls cert2.pem key2.pem
+	proxy-protocol false
+	http-origin app.example.org *.example.net
+	hostname irc.example.org
+	client-host users.example.org
+}`,
+			want: &Listener{
+				URI:           "wss://0.0.0.0:443",
+				TLS:           []TLS{{"cert.pem", "key.pem"}, {"cert2.pem", "key2.pem"}},
+				ProxyProtocol: false,
+				HTTPOrigins:   []string{"app.example.org", "*.example.net"},
+				Hostname:      "irc.example.org",
+				ClientHost:    "users.example.org",
+			},
+		},
+		{
+			name: "peer-auth",
+			conf: "listen unix:///run/soju/irc.sock {\n\tpeer-auth true\n}",
+			want: &Listener{URI: "unix:///run/soju/irc.sock", ProxyProtocol: true, PeerAuth: true},
+		},
+		{
+			name: "peer-auth-tcp",
+			conf: "listen ircs:// {\n\tpeer-auth true\n}",
+		},
+		{
+			name: "peer-auth-abstract",
+			conf: "listen unix:@soju {\n\tpeer-auth true\n}",
+		},
+		{
+			name: "invalid-proxy-protocol",
+			conf: "listen ircs:// {\n\tproxy-protocol maybe\n}",
+		},
+		{
+			name: "missing-tls-key",
+			conf: "listen ircs:// {\n\ttls cert.pem\n}",
+		},
+		{
+			name: "unknown-directive",
+			conf: "listen ircs:// {\n\tfoo bar\n}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := parse(parseTestBlock(t, tc.conf))
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", cfg.Listen)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("failed to parse config: %v", err)
+			}
+
+			if len(cfg.Listen) != 1 {
+				t.Fatalf("got %v listeners, want 1", len(cfg.Listen))
+			}
+			if !reflect.DeepEqual(cfg.Listen[0], *tc.want) {
+				t.Errorf("got %+v, want %+v", cfg.Listen[0], *tc.want)
+			}
+		})
+	}
+}
+
+func TestParseACME(t *testing.T) {
+	testCases := []struct {
+		name string
+		conf string
+		want *ACME // nil if an error is expected
+	}{
+		{
+			name: "minimal",
+			conf: "acme {\n\tdomains irc.example.org\n\tstorage /var/lib/soju/acme\n}",
+			want: &ACME{
+				Domains:     []string{"irc.example.org"},
+				StoragePath: "/var/lib/soju/acme",
+			},
+		},
+		{
+			name: "full",
+			conf: `acme {
+	directory https://acme.example.org/directory
+	email admin@example.org
+	domains irc.example.org
+	domains irc.example.net irc.example.com
+	storage /var/lib/soju/acme
+}`,
+			want: &ACME{
+				DirectoryURL: "https://acme.example.org/directory",
+				Email:        "admin@example.org",
+				Domains:      []string{"irc.example.org", "irc.example.net", "irc.example.com"},
+				StoragePath:  "/var/lib/soju/acme",
+			},
+		},
+		{
+			name: "missing-domains",
+			conf: "acme {\n\tstorage /var/lib/soju/acme\n}",
+		},
+		{
+			name: "empty-domains",
+			conf: "acme {\n\tdomains\n\tstorage /var/lib/soju/acme\n}",
+		},
+		{
+			name: "missing-storage",
+			conf: "acme {\n\tdomains irc.example.org\n}",
+		},
+		{
+			name: "unknown-directive",
+			conf: "acme {\n\tdomains irc.example.org\n\tstorage /var/lib/soju/acme\n\tfoo bar\n}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := parse(parseTestBlock(t, tc.conf))
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", cfg.ACME)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("failed to parse config: %v", err)
+			}
+
+			if !reflect.DeepEqual(cfg.ACME, tc.want) {
+				t.Errorf("got %+v, want %+v", cfg.ACME, tc.want)
+			}
+		})
+	}
+}
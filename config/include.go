@@ -0,0 +1,140 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// maxIncludeDepth limits nested include directives, to catch loops.
+const maxIncludeDepth = 16
+
+// loader loads config files, keeping track of the files already loaded.
+type loader struct {
+	visited map[string]bool
+}
+
+// loadBlock loads a config file, replacing include directives with the
+// directives of the included files. Files already loaded are skipped, so
+// that glob patterns matching the including file don't recurse.
+func (l *loader) loadBlock(path string, depth int) (scfg.Block, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("too many nested include directives in %q", path)
+	}
+
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(key); err == nil {
+		key = resolved
+	}
+	if l.visited[key] {
+		return nil, nil
+	}
+	l.visited[key] = true
+
+	block, err := scfg.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	var result scfg.Block
+	for _, d := range block {
+		if d.Name != "include" {
+			if err := substituteDirective(d, dir); err != nil {
+				return nil, err
+			}
+			result = append(result, d)
+			continue
+		}
+
+		var pattern string
+		if err := d.ParseParams(&pattern); err != nil {
+			return nil, err
+		}
+		pattern, err = substitute(pattern, dir)
+		if err != nil {
+			return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+		}
+		// Relative patterns are resolved from the including file
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			included, err := l.loadBlock(match, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load included file %q: %v", match, err)
+			}
+			result = append(result, included...)
+		}
+	}
+	return result, nil
+}
+
+var substitutionRegexp = regexp.MustCompile(`\$(\$?)(ENV|FILE)\{([^}]*)\}`)
+
+// substitute replaces $ENV{name} with the value of an environment variable,
+// and $FILE{path} with the contents of a file without its trailing newline.
+// Relative file paths are resolved from dir. This allows secrets to be kept
+// out of the config file. A leading "$$" escapes the substitution, for
+// instance $$ENV{name} is replaced with the literal $ENV{name}.
+func substitute(s, dir string) (string, error) {
+	var err error
+	s = substitutionRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		m := substitutionRegexp.FindStringSubmatch(match)
+		escaped, kind, name := m[1] != "", m[2], m[3]
+		if escaped {
+			return match[1:]
+		}
+		switch kind {
+		case "ENV":
+			v, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %q is not set", name)
+			}
+			return v
+		case "FILE":
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+			b, readErr := ioutil.ReadFile(name)
+			if readErr != nil && err == nil {
+				err = readErr
+			}
+			return strings.TrimRight(string(b), "\r\n")
+		}
+		return match
+	})
+	return s, err
+}
+
+// substituteDirective applies substitute to the parameters of a directive and
+// its children.
+func substituteDirective(d *scfg.Directive, dir string) error {
+	for i, param := range d.Params {
+		v, err := substitute(param, dir)
+		if err != nil {
+			return fmt.Errorf("directive %q: %v", d.Name, err)
+		}
+		d.Params[i] = v
+	}
+	for _, child := range d.Children {
+		if err := substituteDirective(child, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
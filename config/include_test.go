@@ -0,0 +1,67 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-config-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretPath := filepath.Join(dir, "secret")
+	files := map[string]string{
+		"soju.conf":         "include conf.d/*.conf\ntitle main\n",
+		"conf.d/a.conf":     "hostname $ENV{SOJU_TEST_HOSTNAME}\nlisten ircs://\n",
+		"conf.d/b.conf":     "db postgres \"password=$FILE{" + secretPath + "}\"\n",
+		"conf.d/c.conf":     "include *.conf\nhttp-origin $$ENV{SOJU_TEST_HOSTNAME} $FILE{origin}\n",
+		"conf.d/origin":     "app.example.org\n",
+		"conf.d/ignored.md": "title ignored\n",
+		"secret":            "hunter2\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %q: %v", name, err)
+		}
+	}
+
+	if _, err := Load(filepath.Join(dir, "soju.conf")); err == nil {
+		t.Errorf("expected an error for an unset environment variable")
+	}
+
+	os.Setenv("SOJU_TEST_HOSTNAME", "irc.example.org")
+	defer os.Unsetenv("SOJU_TEST_HOSTNAME")
+
+	cfg, err := Load(filepath.Join(dir, "soju.conf"))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if cfg.Hostname != "irc.example.org" {
+		t.Errorf("hostname = %q, want %q", cfg.Hostname, "irc.example.org")
+	}
+	if cfg.SQLSource != "password=hunter2" {
+		t.Errorf("db source = %q, want %q", cfg.SQLSource, "password=hunter2")
+	}
+	// Relative $FILE{} paths are resolved from the including file, and
+	// $$ENV{} is kept as-is
+	if want := []string{"$ENV{SOJU_TEST_HOSTNAME}", "app.example.org"}; !reflect.DeepEqual(cfg.HTTPOrigins, want) {
+		t.Errorf("http-origin = %q, want %q", cfg.HTTPOrigins, want)
+	}
+	// Files matched again by a glob aren't included twice
+	if len(cfg.Listen) != 1 {
+		t.Errorf("got %v listeners, want 1", len(cfg.Listen))
+	}
+	if cfg.Title != "main" {
+		t.Errorf("title = %q, want %q", cfg.Title, "main")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -34,14 +35,24 @@ func newNetIRCConn(c net.Conn) ircConn {
 	}{irc.NewConn(c), c}
 }
 
+const (
+	websocketSubprotocolText   = "text.ircv3.net"
+	websocketSubprotocolBinary = "binary.ircv3.net"
+)
+
 type websocketIRCConn struct {
 	conn                        *websocket.Conn
 	readDeadline, writeDeadline time.Time
 	remoteAddr                  string
+	binary                      bool
 }
 
 func newWebsocketIRCConn(c *websocket.Conn, remoteAddr string) ircConn {
-	return &websocketIRCConn{conn: c, remoteAddr: remoteAddr}
+	return &websocketIRCConn{
+		conn:       c,
+		remoteAddr: remoteAddr,
+		binary:     c.Subprotocol() == websocketSubprotocolBinary,
+	}
 }
 
 func (wic *websocketIRCConn) ReadMessage() (*irc.Message, error) {
@@ -64,14 +75,21 @@ func (wic *websocketIRCConn) ReadMessage() (*irc.Message, error) {
 }
 
 func (wic *websocketIRCConn) WriteMessage(msg *irc.Message) error {
-	b := []byte(strings.ToValidUTF8(msg.String(), string(unicode.ReplacementChar)))
+	// Text frames must contain valid UTF-8, binary frames are sent as-is
+	typ := websocket.MessageBinary
+	b := []byte(msg.String())
+	if !wic.binary {
+		typ = websocket.MessageText
+		b = []byte(strings.ToValidUTF8(msg.String(), string(unicode.ReplacementChar)))
+	}
+
 	ctx := context.Background()
 	if !wic.writeDeadline.IsZero() {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithDeadline(ctx, wic.writeDeadline)
 		defer cancel()
 	}
-	return wic.conn.Write(ctx, websocket.MessageText, b)
+	return wic.conn.Write(ctx, typ, b)
 }
 
 func isErrWebSocketClosed(err error) bool {
@@ -162,26 +180,33 @@ type connOptions struct {
 	Logger         Logger
 	RateLimitDelay time.Duration
 	RateLimitBurst int
+	Trace          bool
 }
 
 type conn struct {
 	conn   ircConn
 	srv    *Server
 	logger Logger
+	trace  int32 // atomic
 
-	lock     sync.Mutex
-	outgoing chan<- *irc.Message
-	closed   bool
+	lock       sync.Mutex
+	outgoing   chan<- *irc.Message
+	closed     bool
+	detached   chan struct{}
+	writerDone chan struct{}
 }
 
 func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
 	outgoing := make(chan *irc.Message, 64)
 	c := &conn{
-		conn:     ic,
-		srv:      srv,
-		outgoing: outgoing,
-		logger:   options.Logger,
+		conn:       ic,
+		srv:        srv,
+		outgoing:   outgoing,
+		logger:     options.Logger,
+		detached:   make(chan struct{}),
+		writerDone: make(chan struct{}),
 	}
+	c.SetTrace(options.Trace)
 
 	go func() {
 		var rl *rateLimiter
@@ -195,24 +220,29 @@ func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
 				<-rl.C
 			}
 
-			if c.srv.Debug {
-				c.logger.Printf("sent: %v", msg)
-			}
+			c.logTraffic("sent", msg)
 			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 			if err := c.conn.WriteMessage(msg); err != nil {
-				c.logger.Printf("failed to write message: %v", err)
+				c.logger.Errorf("failed to write message: %v", err)
 				break
 			}
 		}
-		if err := c.conn.Close(); err != nil && !isErrClosed(err) {
-			c.logger.Printf("failed to close connection: %v", err)
-		} else {
-			c.logger.Printf("connection closed")
+		select {
+		case <-c.detached:
+			// The underlying connection is used by someone else now
+			c.logger.Printf("connection detached")
+		default:
+			if err := c.conn.Close(); err != nil && !isErrClosed(err) {
+				c.logger.Errorf("failed to close connection: %v", err)
+			} else {
+				c.logger.Printf("connection closed")
+			}
 		}
 		// Drain the outgoing channel to prevent SendMessage from blocking
 		for range outgoing {
 			// This space is intentionally left blank
 		}
+		close(c.writerDone)
 	}()
 
 	c.logger.Printf("new connection")
@@ -240,6 +270,23 @@ func (c *conn) Close() error {
 	return err
 }
 
+// Detach stops using the connection once all queued messages have been sent,
+// without closing the underlying connection. It blocks until then.
+func (c *conn) Detach() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return fmt.Errorf("connection already closed")
+	}
+	c.closed = true
+	close(c.detached)
+	close(c.outgoing)
+	c.lock.Unlock()
+
+	<-c.writerDone
+	return nil
+}
+
 func (c *conn) ReadMessage() (*irc.Message, error) {
 	msg, err := c.conn.ReadMessage()
 	if isErrClosed(err) {
@@ -248,13 +295,30 @@ func (c *conn) ReadMessage() (*irc.Message, error) {
 		return nil, err
 	}
 
-	if c.srv.Debug {
-		c.logger.Printf("received: %v", msg)
-	}
+	c.logTraffic("received", msg)
 
 	return msg, nil
 }
 
+// SetTrace enables or disables logging of the messages sent and received on
+// this connection. It is safe to call from any goroutine.
+func (c *conn) SetTrace(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.trace, v)
+}
+
+func (c *conn) logTraffic(direction string, msg *irc.Message) {
+	if atomic.LoadInt32(&c.trace) != 0 {
+		// Traced connections are logged regardless of the log level
+		c.logger.Log(LogDebug, fmt.Sprintf("%v: %v", direction, msg))
+	} else if c.srv.Config().Debug {
+		c.logger.Debugf("%v: %v", direction, msg)
+	}
+}
+
 // SendMessage queues a new outgoing message. It is safe to call from any
 // goroutine.
 //
@@ -270,6 +334,25 @@ func (c *conn) SendMessage(msg *irc.Message) {
 	c.outgoing <- msg
 }
 
+// CloseWithError sends an ERROR message and closes the connection once all
+// queued messages have been sent. It is safe to call from any goroutine.
+func (c *conn) CloseWithError(text string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return fmt.Errorf("connection already closed")
+	}
+
+	c.outgoing <- &irc.Message{
+		Command: "ERROR",
+		Params:  []string{text},
+	}
+	c.closed = true
+	close(c.outgoing)
+	return nil
+}
+
 func (c *conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
@@ -0,0 +1,57 @@
+package soju
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestWebsocketBinarySubprotocol(t *testing.T) {
+	srv := NewServer(createTempSqliteDB(t))
+	cfg := DefaultConfig()
+	cfg.WebSocketCompression = "context-takeover"
+	srv.SetConfig(cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	httpSrv := httptest.NewServer(srv)
+	defer httpSrv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	url := "ws" + strings.TrimPrefix(httpSrv.URL, "http")
+	c, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		Subprotocols:    []string{websocketSubprotocolBinary},
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if err != nil {
+		t.Fatalf("failed to dial WebSocket server: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	if c.Subprotocol() != websocketSubprotocolBinary {
+		t.Fatalf("negotiated subprotocol %q, want %q", c.Subprotocol(), websocketSubprotocolBinary)
+	}
+
+	if err := c.Write(ctx, websocket.MessageBinary, []byte("CAP REQ :\xff")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	typ, b, err := c.Read(ctx)
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if typ != websocket.MessageBinary {
+		t.Errorf("received message type %v, want binary", typ)
+	}
+	if !strings.HasSuffix(string(b), "\xff") {
+		t.Errorf("invalid UTF-8 was not preserved: %q", b)
+	}
+}
@@ -105,7 +105,7 @@ func main() {
 			log.Printf("user %q: updating existing user", username)
 		} else {
 			// "!!" is an invalid crypt format, thus disables password auth
-			u = &soju.User{Username: username, Password: "!!"}
+			u = &soju.User{Username: username, Password: "!!", Enabled: true}
 			usersCreated++
 			log.Printf("user %q: creating new user", username)
 		}
@@ -26,6 +26,13 @@ type Database interface {
 
 	ListDeliveryReceipts(ctx context.Context, networkID int64) ([]DeliveryReceipt, error)
 	StoreClientDeliveryReceipts(ctx context.Context, networkID int64, client string, receipts []DeliveryReceipt) error
+
+	ListWebhooks(ctx context.Context, userID int64) ([]Webhook, error)
+	StoreWebhook(ctx context.Context, userID int64, webhook *Webhook) error
+	DeleteWebhook(ctx context.Context, id int64) error
+
+	StoreAuditEntry(ctx context.Context, entry *AuditEntry) error
+	ListAuditEntries(ctx context.Context, filter *AuditFilter) ([]AuditEntry, error)
 }
 
 func OpenDB(driver, source string) (Database, error) {
@@ -51,6 +58,26 @@ type User struct {
 	Password string // hashed
 	Realname string
 	Admin    bool
+	Enabled  bool // false if the user is suspended
+
+	// Settings used for channels with default settings
+	ChannelDefaults ChannelSettings
+
+	// Custom highlight patterns, see parseHighlightPattern
+	Highlights []string
+	// Masks of ignored users, see parseIgnoreMask
+	Ignores []string
+
+	Quotas UserQuotas
+}
+
+// UserQuotas contains per-user resource limits. Zero means the server default
+// is used, a negative value means there is no limit.
+type UserQuotas struct {
+	MaxChannels        int   // saved channels per network
+	MaxDownstreams     int   // simultaneous downstream connections
+	MaxLogSize         int64 // message logs disk usage, in bytes
+	MaxConnectCommands int   // connect commands per network
 }
 
 type SASL struct {
@@ -81,6 +108,18 @@ type Network struct {
 	ConnectCommands []string
 	SASL            SASL
 	Enabled         bool
+
+	// Settings used for channels with default settings, overriding the user
+	// defaults
+	ChannelDefaults ChannelSettings
+
+	// Custom highlight patterns and ignore masks, in addition to the user's
+	Highlights []string
+	Ignores    []string
+
+	// Reply to ident queries for connections to this network, overriding
+	// the default derived from the user ID
+	Ident string
 }
 
 func (net *Network) GetName() string {
@@ -132,7 +171,8 @@ func GetRealname(user *User, net *Network) string {
 type MessageFilter int
 
 const (
-	// TODO: use customizable user defaults for FilterDefault
+	// FilterDefault is resolved against the network defaults, then against
+	// the user defaults
 	FilterDefault MessageFilter = iota
 	FilterNone
 	FilterHighlight
@@ -153,6 +193,66 @@ func parseFilter(filter string) (MessageFilter, error) {
 	return 0, fmt.Errorf("unknown filter: %q", filter)
 }
 
+func (filter MessageFilter) String() string {
+	switch filter {
+	case FilterDefault:
+		return "default"
+	case FilterNone:
+		return "none"
+	case FilterHighlight:
+		return "highlight"
+	case FilterMessage:
+		return "message"
+	}
+	return fmt.Sprintf("<unknown filter %d>", int(filter))
+}
+
+// DetachNever is the auto-detach delay which disables auto-detach, overriding
+// the defaults. It's a whole number of seconds so that it can be stored as is.
+const DetachNever = -time.Second
+
+// ChannelSettings contains the per-channel message filters and auto-detach
+// delay. A zero field means the default value is used.
+type ChannelSettings struct {
+	RelayDetached MessageFilter
+	ReattachOn    MessageFilter
+	DetachAfter   time.Duration
+	DetachOn      MessageFilter
+}
+
+// defaultChannelSettings are the settings used when neither the channel, the
+// network nor the user override them.
+var defaultChannelSettings = ChannelSettings{
+	RelayDetached: FilterHighlight,
+	ReattachOn:    FilterNone,
+	DetachAfter:   0,
+	DetachOn:      FilterMessage,
+}
+
+// resolveChannelSettings returns the effective settings from a list of
+// settings ordered from the most specific to the least specific. The
+// settings in defaultChannelSettings are used as a last resort.
+func resolveChannelSettings(l ...ChannelSettings) ChannelSettings {
+	l = append(l, defaultChannelSettings)
+
+	var resolved ChannelSettings
+	for _, s := range l {
+		if resolved.RelayDetached == FilterDefault {
+			resolved.RelayDetached = s.RelayDetached
+		}
+		if resolved.ReattachOn == FilterDefault {
+			resolved.ReattachOn = s.ReattachOn
+		}
+		if resolved.DetachAfter == 0 {
+			resolved.DetachAfter = s.DetachAfter
+		}
+		if resolved.DetachOn == FilterDefault {
+			resolved.DetachOn = s.DetachOn
+		}
+	}
+	return resolved
+}
+
 type Channel struct {
 	ID   int64
 	Name string
@@ -161,10 +261,7 @@ type Channel struct {
 	Detached              bool
 	DetachedInternalMsgID string
 
-	RelayDetached MessageFilter
-	ReattachOn    MessageFilter
-	DetachAfter   time.Duration
-	DetachOn      MessageFilter
+	ChannelSettings
 }
 
 type DeliveryReceipt struct {
@@ -172,4 +269,35 @@ type DeliveryReceipt struct {
 	Target        string // channel or nick
 	Client        string
 	InternalMsgID string
+	UpdatedAt     time.Time // last time the client was seen, may be zero
+}
+
+type Webhook struct {
+	ID     int64
+	URL    string
+	Events []string // empty means all events
+	Secret string   // HMAC-SHA256 key, may be empty
+}
+
+// AuditEntry records an administrative or account action. Users are
+// referenced by name, so that entries are kept after users are deleted.
+type AuditEntry struct {
+	ID      int64
+	Time    time.Time
+	Actor   string // user performing the action, empty for sojuctl
+	Source  string // remote address of the actor, or "sojuctl"
+	Action  string // e.g. "user.create"
+	Target  string // user affected by the action
+	Details string
+	Error   string // empty on success
+}
+
+// AuditFilter selects audit log entries. Zero fields match all entries.
+type AuditFilter struct {
+	Actor  string
+	Target string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
 }
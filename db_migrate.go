@@ -0,0 +1,294 @@
+package soju
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// dbDump holds all of the records of a database.
+type dbDump struct {
+	Users    []userDump
+	AuditLog []AuditEntry // sorted from newest to oldest
+}
+
+type userDump struct {
+	User
+	Networks []networkDump
+	Webhooks []Webhook
+}
+
+type networkDump struct {
+	Network
+	Channels         []Channel
+	DeliveryReceipts []DeliveryReceipt
+}
+
+func (dump *dbDump) counts() map[string]int {
+	counts := map[string]int{
+		"users":             len(dump.Users),
+		"audit log entries": len(dump.AuditLog),
+	}
+	for _, user := range dump.Users {
+		counts["networks"] += len(user.Networks)
+		counts["webhooks"] += len(user.Webhooks)
+		for _, net := range user.Networks {
+			counts["channels"] += len(net.Channels)
+			counts["delivery receipts"] += len(net.DeliveryReceipts)
+		}
+	}
+	return counts
+}
+
+func dumpDB(ctx context.Context, db Database) (*dbDump, error) {
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	var dump dbDump
+	for _, user := range users {
+		ud := userDump{User: user}
+
+		networks, err := db.ListNetworks(ctx, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list networks of user %q: %v", user.Username, err)
+		}
+		for _, net := range networks {
+			nd := networkDump{Network: net}
+			if nd.Channels, err = db.ListChannels(ctx, net.ID); err != nil {
+				return nil, fmt.Errorf("failed to list channels of network %q: %v", net.GetName(), err)
+			}
+			if nd.DeliveryReceipts, err = db.ListDeliveryReceipts(ctx, net.ID); err != nil {
+				return nil, fmt.Errorf("failed to list delivery receipts of network %q: %v", net.GetName(), err)
+			}
+			ud.Networks = append(ud.Networks, nd)
+		}
+
+		if ud.Webhooks, err = db.ListWebhooks(ctx, user.ID); err != nil {
+			return nil, fmt.Errorf("failed to list webhooks of user %q: %v", user.Username, err)
+		}
+
+		dump.Users = append(dump.Users, ud)
+	}
+
+	if dump.AuditLog, err = db.ListAuditEntries(ctx, &AuditFilter{}); err != nil {
+		return nil, fmt.Errorf("failed to list audit log entries: %v", err)
+	}
+
+	return &dump, nil
+}
+
+// recordIDSetter is implemented by databases which can change the ID of a
+// record.
+type recordIDSetter interface {
+	// setRecordID changes the ID of a record which isn't referenced by other
+	// records yet. The table must not allocate the new ID afterwards.
+	setRecordID(ctx context.Context, table string, oldID, newID int64) error
+}
+
+// idSequence inserts records in a database so that they keep their original
+// IDs. Records are inserted with an ID allocated by the database, then their
+// ID is set to the original one before any other record references them.
+// Records must be inserted in increasing ID order.
+//
+// If preserve is false, records are inserted with new IDs.
+type idSequence struct {
+	db       Database
+	table    string
+	preserve bool
+	ids      map[int64]int64 // original ID → new ID
+}
+
+func newIDSequence(db Database, table string, preserve bool) *idSequence {
+	return &idSequence{db: db, table: table, preserve: preserve, ids: make(map[int64]int64)}
+}
+
+// insert stores a record. store inserts the record and returns the ID
+// allocated by the database.
+func (seq *idSequence) insert(ctx context.Context, id int64, store func() (int64, error)) error {
+	newID, err := store()
+	if err != nil {
+		return fmt.Errorf("failed to store %v %v: %v", seq.table, id, err)
+	}
+	if seq.preserve && newID != id {
+		setter, ok := seq.db.(recordIDSetter)
+		if !ok {
+			return fmt.Errorf("the database doesn't support preserving IDs")
+		}
+		if err := setter.setRecordID(ctx, seq.table, newID, id); err != nil {
+			return fmt.Errorf("failed to preserve %v ID %v: %v", seq.table, id, err)
+		}
+		newID = id
+	}
+	seq.ids[id] = newID
+	return nil
+}
+
+// loadDump inserts records in a database. Records are sorted by ID before
+// being inserted.
+func loadDump(ctx context.Context, db Database, dump *dbDump, preserveIDs bool) error {
+	var networks []networkDump
+	networkUsers := make(map[int64]int64)
+	for _, ud := range dump.Users {
+		for _, nd := range ud.Networks {
+			networkUsers[nd.ID] = ud.ID
+		}
+		networks = append(networks, ud.Networks...)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].ID < networks[j].ID
+	})
+
+	var channels []Channel
+	channelNetworks := make(map[int64]int64)
+	for _, nd := range networks {
+		for _, ch := range nd.Channels {
+			channelNetworks[ch.ID] = nd.ID
+		}
+		channels = append(channels, nd.Channels...)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+
+	users := newIDSequence(db, "User", preserveIDs)
+	for _, ud := range dump.Users {
+		err := users.insert(ctx, ud.ID, func() (int64, error) {
+			record := ud.User
+			record.ID = 0
+			err := db.StoreUser(ctx, &record)
+			return record.ID, err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, webhook := range ud.Webhooks {
+			webhook.ID = 0
+			if err := db.StoreWebhook(ctx, users.ids[ud.ID], &webhook); err != nil {
+				return fmt.Errorf("failed to store webhook of user %q: %v", ud.Username, err)
+			}
+		}
+	}
+
+	nets := newIDSequence(db, "Network", preserveIDs)
+	for _, nd := range networks {
+		userID := users.ids[networkUsers[nd.ID]]
+		err := nets.insert(ctx, nd.ID, func() (int64, error) {
+			record := nd.Network
+			record.ID = 0
+			err := db.StoreNetwork(ctx, userID, &record)
+			return record.ID, err
+		})
+		if err != nil {
+			return err
+		}
+
+		// Receipts are stored per client
+		clients := make(map[string][]DeliveryReceipt)
+		for _, rcpt := range nd.DeliveryReceipts {
+			rcpt.ID = 0
+			clients[rcpt.Client] = append(clients[rcpt.Client], rcpt)
+		}
+		for client, receipts := range clients {
+			if err := db.StoreClientDeliveryReceipts(ctx, nets.ids[nd.ID], client, receipts); err != nil {
+				return fmt.Errorf("failed to store delivery receipts of network %q: %v", nd.GetName(), err)
+			}
+		}
+	}
+
+	chans := newIDSequence(db, "Channel", preserveIDs)
+	for _, ch := range channels {
+		networkID := nets.ids[channelNetworks[ch.ID]]
+		err := chans.insert(ctx, ch.ID, func() (int64, error) {
+			record := ch
+			record.ID = 0
+			err := db.StoreChannel(ctx, networkID, &record)
+			return record.ID, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Entries are sorted from newest to oldest
+	for i := len(dump.AuditLog) - 1; i >= 0; i-- {
+		entry := dump.AuditLog[i]
+		entry.ID = 0
+		if err := db.StoreAuditEntry(ctx, &entry); err != nil {
+			return fmt.Errorf("failed to store audit log entry: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// verifyDump checks that a database contains as many records as a dump.
+// prevAuditEntries is the number of audit log entries the database contained
+// before the dump was loaded: unlike other records, they aren't deleted along
+// with users.
+func verifyDump(ctx context.Context, db Database, dump *dbDump, prevAuditEntries int) error {
+	loaded, err := dumpDB(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	want, got := dump.counts(), loaded.counts()
+	want["audit log entries"] += prevAuditEntries
+	for _, kind := range []string{"users", "networks", "channels", "delivery receipts", "webhooks", "audit log entries"} {
+		if want[kind] != got[kind] {
+			return fmt.Errorf("expected %v %v, but the database contains %v", want[kind], kind, got[kind])
+		}
+	}
+	return nil
+}
+
+func countAuditEntries(ctx context.Context, db Database) (int, error) {
+	entries, err := db.ListAuditEntries(ctx, &AuditFilter{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list audit log entries: %v", err)
+	}
+	return len(entries), nil
+}
+
+func isDBEmpty(ctx context.Context, db Database) (bool, error) {
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to list users: %v", err)
+	}
+	return len(users) == 0, nil
+}
+
+// MigrateDB copies all records from a database to another one. User,
+// network and channel IDs are preserved. The destination database must be
+// freshly created. Row counts are checked once the migration is complete.
+func MigrateDB(ctx context.Context, from, to Database) error {
+	if empty, err := isDBEmpty(ctx, to); err != nil {
+		return err
+	} else if !empty {
+		return fmt.Errorf("the destination database isn't empty")
+	}
+
+	prevAuditEntries, err := countAuditEntries(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	dump, err := dumpDB(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	if err := loadDump(ctx, to, dump, true); err != nil {
+		return err
+	}
+
+	if err := verifyDump(ctx, to, dump, prevAuditEntries); err != nil {
+		return fmt.Errorf("failed to verify migration: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package soju
+
+import (
+	"context"
+	"testing"
+)
+
+func testMigrateDB(t *testing.T, from, to Database) {
+	ctx := context.Background()
+
+	var users []*User
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user := &User{Username: name, Enabled: true}
+		if err := from.StoreUser(ctx, user); err != nil {
+			t.Fatalf("failed to store user: %v", err)
+		}
+		users = append(users, user)
+	}
+	// Leave a gap in user IDs
+	if err := from.DeleteUser(ctx, users[1].ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+
+	var networks []*Network
+	for _, addr := range []string{"irc.example.org", "irc.example.com", "irc.example.net"} {
+		net := &Network{Addr: addr, SASL: SASL{Mechanism: "PLAIN"}}
+		net.SASL.Plain.Username = "carol"
+		net.SASL.Plain.Password = "hunter2"
+		if err := from.StoreNetwork(ctx, users[2].ID, net); err != nil {
+			t.Fatalf("failed to store network: %v", err)
+		}
+		networks = append(networks, net)
+	}
+	if err := from.DeleteNetwork(ctx, networks[0].ID); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+
+	ch := &Channel{Name: "#soju", Detached: true}
+	if err := from.StoreChannel(ctx, networks[2].ID, ch); err != nil {
+		t.Fatalf("failed to store channel: %v", err)
+	}
+
+	if err := MigrateDB(ctx, from, to); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	carol, err := to.GetUser(ctx, "carol")
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if carol.ID != users[2].ID {
+		t.Errorf("user ID = %v, want %v", carol.ID, users[2].ID)
+	}
+
+	l, err := to.ListNetworks(ctx, carol.ID)
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+	if len(l) != 2 || l[1].ID != networks[2].ID || l[1].SASL.Plain.Password != "hunter2" {
+		t.Errorf("unexpected migrated networks: %+v", l)
+	}
+
+	channels, err := to.ListChannels(ctx, networks[2].ID)
+	if err != nil {
+		t.Fatalf("failed to list channels: %v", err)
+	}
+	if len(channels) != 1 || channels[0].ID != ch.ID || !channels[0].Detached {
+		t.Errorf("unexpected migrated channels: %+v", channels)
+	}
+
+	// Preserved IDs must not be allocated again
+	dave := &User{Username: "dave", Enabled: true}
+	if err := to.StoreUser(ctx, dave); err != nil {
+		t.Fatalf("failed to store user after migration: %v", err)
+	}
+	if dave.ID <= carol.ID {
+		t.Errorf("new user ID = %v, want greater than %v", dave.ID, carol.ID)
+	}
+
+	if err := MigrateDB(ctx, from, to); err == nil {
+		t.Errorf("expected migration to a non-empty database to fail")
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	t.Run("sqlite-to-sqlite", func(t *testing.T) {
+		testMigrateDB(t, createTempSqliteDB(t), createTempSqliteDB(t))
+	})
+
+	t.Run("sqlite-to-postgres", func(t *testing.T) {
+		to := createTempPostgresDB(t)
+		testMigrateDB(t, createTempSqliteDB(t), to)
+	})
+
+	t.Run("postgres-to-sqlite", func(t *testing.T) {
+		from := createTempPostgresDB(t)
+		testMigrateDB(t, from, createTempSqliteDB(t))
+	})
+}
@@ -28,7 +28,18 @@ CREATE TABLE "User" (
 	username VARCHAR(255) NOT NULL UNIQUE,
 	password VARCHAR(255),
 	admin BOOLEAN NOT NULL DEFAULT FALSE,
-	realname VARCHAR(255)
+	realname VARCHAR(255),
+	relay_detached INTEGER NOT NULL DEFAULT 0,
+	reattach_on INTEGER NOT NULL DEFAULT 0,
+	detach_after INTEGER NOT NULL DEFAULT 0,
+	detach_on INTEGER NOT NULL DEFAULT 0,
+	highlights TEXT,
+	ignores TEXT,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	max_channels INTEGER NOT NULL DEFAULT 0,
+	max_downstreams INTEGER NOT NULL DEFAULT 0,
+	max_log_size BIGINT NOT NULL DEFAULT 0,
+	max_connect_commands INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE "Network" (
@@ -47,6 +58,13 @@ CREATE TABLE "Network" (
 	sasl_external_cert BYTEA,
 	sasl_external_key BYTEA,
 	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	relay_detached INTEGER NOT NULL DEFAULT 0,
+	reattach_on INTEGER NOT NULL DEFAULT 0,
+	detach_after INTEGER NOT NULL DEFAULT 0,
+	detach_on INTEGER NOT NULL DEFAULT 0,
+	highlights TEXT,
+	ignores TEXT,
+	ident VARCHAR(255),
 	UNIQUE("user", addr, nick),
 	UNIQUE("user", name)
 );
@@ -71,13 +89,79 @@ CREATE TABLE "DeliveryReceipt" (
 	target VARCHAR(255) NOT NULL,
 	client VARCHAR(255) NOT NULL DEFAULT '',
 	internal_msgid VARCHAR(255) NOT NULL,
+	updated_at TIMESTAMP WITH TIME ZONE,
 	UNIQUE(network, target, client)
 );
+
+CREATE TABLE "Webhook" (
+	id SERIAL PRIMARY KEY,
+	"user" INTEGER NOT NULL REFERENCES "User"(id) ON DELETE CASCADE,
+	url TEXT NOT NULL,
+	events TEXT,
+	secret TEXT
+);
+
+CREATE TABLE "AuditLog" (
+	id SERIAL PRIMARY KEY,
+	time TIMESTAMP WITH TIME ZONE NOT NULL,
+	actor VARCHAR(255),
+	source VARCHAR(255),
+	action VARCHAR(255) NOT NULL,
+	target VARCHAR(255),
+	details TEXT,
+	error TEXT
+);
 `
 
 var postgresMigrations = []string{
 	"", // migration #0 is reserved for schema initialization
 	`ALTER TABLE "Network" ALTER COLUMN nick DROP NOT NULL`,
+	`
+		ALTER TABLE "User" ADD COLUMN relay_detached INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "User" ADD COLUMN reattach_on INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "User" ADD COLUMN detach_after INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "User" ADD COLUMN detach_on INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN relay_detached INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN reattach_on INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN detach_after INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN detach_on INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE "User" ADD COLUMN highlights TEXT;
+		ALTER TABLE "User" ADD COLUMN ignores TEXT;
+		ALTER TABLE "Network" ADD COLUMN highlights TEXT;
+		ALTER TABLE "Network" ADD COLUMN ignores TEXT;
+	`,
+	`
+		CREATE TABLE "Webhook" (
+			id SERIAL PRIMARY KEY,
+			"user" INTEGER NOT NULL REFERENCES "User"(id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			events TEXT,
+			secret TEXT
+		);
+	`,
+	`ALTER TABLE "DeliveryReceipt" ADD COLUMN updated_at TIMESTAMP WITH TIME ZONE`,
+	`
+		CREATE TABLE "AuditLog" (
+			id SERIAL PRIMARY KEY,
+			time TIMESTAMP WITH TIME ZONE NOT NULL,
+			actor VARCHAR(255),
+			source VARCHAR(255),
+			action VARCHAR(255) NOT NULL,
+			target VARCHAR(255),
+			details TEXT,
+			error TEXT
+		);
+	`,
+	`ALTER TABLE "User" ADD COLUMN enabled BOOLEAN NOT NULL DEFAULT TRUE`,
+	`
+		ALTER TABLE "User" ADD COLUMN max_channels INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "User" ADD COLUMN max_downstreams INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "User" ADD COLUMN max_log_size BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE "User" ADD COLUMN max_connect_commands INTEGER NOT NULL DEFAULT 0;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN ident VARCHAR(255)`,
 }
 
 type PostgresDB struct {
@@ -168,8 +252,12 @@ func (db *PostgresDB) ListUsers(ctx context.Context) ([]User, error) {
 	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
 	defer cancel()
 
-	rows, err := db.db.QueryContext(ctx,
-		`SELECT id, username, password, admin, realname FROM "User"`)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, username, password, admin, realname,
+			relay_detached, reattach_on, detach_after, detach_on,
+			highlights, ignores, enabled, max_channels, max_downstreams,
+			max_log_size, max_connect_commands
+		FROM "User"`)
 	if err != nil {
 		return nil, err
 	}
@@ -178,12 +266,19 @@ func (db *PostgresDB) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		var password, realname sql.NullString
-		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname); err != nil {
+		var password, realname, highlights, ignores sql.NullString
+		var detachAfter int64
+		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname,
+			&user.ChannelDefaults.RelayDetached, &user.ChannelDefaults.ReattachOn, &detachAfter, &user.ChannelDefaults.DetachOn,
+			&highlights, &ignores, &user.Enabled, &user.Quotas.MaxChannels, &user.Quotas.MaxDownstreams,
+			&user.Quotas.MaxLogSize, &user.Quotas.MaxConnectCommands); err != nil {
 			return nil, err
 		}
 		user.Password = password.String
 		user.Realname = realname.String
+		user.ChannelDefaults.DetachAfter = time.Duration(detachAfter) * time.Second
+		user.Highlights = fromNullStringList(highlights)
+		user.Ignores = fromNullStringList(ignores)
 		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
@@ -199,15 +294,27 @@ func (db *PostgresDB) GetUser(ctx context.Context, username string) (*User, erro
 
 	user := &User{Username: username}
 
-	var password, realname sql.NullString
-	row := db.db.QueryRowContext(ctx,
-		`SELECT id, password, admin, realname FROM "User" WHERE username = $1`,
+	var password, realname, highlights, ignores sql.NullString
+	var detachAfter int64
+	row := db.db.QueryRowContext(ctx, `
+		SELECT id, password, admin, realname,
+			relay_detached, reattach_on, detach_after, detach_on,
+			highlights, ignores, enabled, max_channels, max_downstreams,
+			max_log_size, max_connect_commands
+		FROM "User"
+		WHERE username = $1`,
 		username)
-	if err := row.Scan(&user.ID, &password, &user.Admin, &realname); err != nil {
+	if err := row.Scan(&user.ID, &password, &user.Admin, &realname,
+		&user.ChannelDefaults.RelayDetached, &user.ChannelDefaults.ReattachOn, &detachAfter, &user.ChannelDefaults.DetachOn,
+		&highlights, &ignores, &user.Enabled, &user.Quotas.MaxChannels, &user.Quotas.MaxDownstreams,
+		&user.Quotas.MaxLogSize, &user.Quotas.MaxConnectCommands); err != nil {
 		return nil, err
 	}
 	user.Password = password.String
 	user.Realname = realname.String
+	user.ChannelDefaults.DetachAfter = time.Duration(detachAfter) * time.Second
+	user.Highlights = fromNullStringList(highlights)
+	user.Ignores = fromNullStringList(ignores)
 	return user, nil
 }
 
@@ -217,20 +324,38 @@ func (db *PostgresDB) StoreUser(ctx context.Context, user *User) error {
 
 	password := toNullString(user.Password)
 	realname := toNullString(user.Realname)
+	defaults := &user.ChannelDefaults
+	detachAfter := int64(math.Ceil(defaults.DetachAfter.Seconds()))
+	highlights := toNullStringList(user.Highlights)
+	ignores := toNullStringList(user.Ignores)
+	quotas := &user.Quotas
 
 	var err error
 	if user.ID == 0 {
 		err = db.db.QueryRowContext(ctx, `
-			INSERT INTO "User" (username, password, admin, realname)
-			VALUES ($1, $2, $3, $4)
+			INSERT INTO "User" (username, password, admin, realname,
+				relay_detached, reattach_on, detach_after, detach_on,
+				highlights, ignores, enabled, max_channels, max_downstreams,
+				max_log_size, max_connect_commands)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 			RETURNING id`,
-			user.Username, password, user.Admin, realname).Scan(&user.ID)
+			user.Username, password, user.Admin, realname,
+			defaults.RelayDetached, defaults.ReattachOn, detachAfter, defaults.DetachOn,
+			highlights, ignores, user.Enabled, quotas.MaxChannels, quotas.MaxDownstreams,
+			quotas.MaxLogSize, quotas.MaxConnectCommands).Scan(&user.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "User"
-			SET password = $1, admin = $2, realname = $3
-			WHERE id = $4`,
-			password, user.Admin, realname, user.ID)
+			SET password = $1, admin = $2, realname = $3, relay_detached = $4,
+				reattach_on = $5, detach_after = $6, detach_on = $7,
+				highlights = $8, ignores = $9, enabled = $10, max_channels = $11,
+				max_downstreams = $12, max_log_size = $13, max_connect_commands = $14
+			WHERE id = $15`,
+			password, user.Admin, realname, defaults.RelayDetached,
+			defaults.ReattachOn, detachAfter, defaults.DetachOn,
+			highlights, ignores, user.Enabled, quotas.MaxChannels,
+			quotas.MaxDownstreams, quotas.MaxLogSize, quotas.MaxConnectCommands,
+			user.ID)
 	}
 	return err
 }
@@ -249,7 +374,8 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, addr, nick, username, realname, pass, connect_commands, sasl_mechanism,
-			sasl_plain_username, sasl_plain_password, sasl_external_cert, sasl_external_key, enabled
+			sasl_plain_username, sasl_plain_password, sasl_external_cert, sasl_external_key, enabled,
+			relay_detached, reattach_on, detach_after, detach_on, highlights, ignores, ident
 		FROM "Network"
 		WHERE "user" = $1`, userID)
 	if err != nil {
@@ -262,9 +388,13 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 		var net Network
 		var name, nick, username, realname, pass, connectCommands sql.NullString
 		var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+		var highlights, ignores, ident sql.NullString
+		var detachAfter int64
 		err := rows.Scan(&net.ID, &name, &net.Addr, &nick, &username, &realname,
 			&pass, &connectCommands, &saslMechanism, &saslPlainUsername, &saslPlainPassword,
-			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled)
+			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled,
+			&net.ChannelDefaults.RelayDetached, &net.ChannelDefaults.ReattachOn, &detachAfter, &net.ChannelDefaults.DetachOn,
+			&highlights, &ignores, &ident)
 		if err != nil {
 			return nil, err
 		}
@@ -279,6 +409,10 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 		net.SASL.Mechanism = saslMechanism.String
 		net.SASL.Plain.Username = saslPlainUsername.String
 		net.SASL.Plain.Password = saslPlainPassword.String
+		net.ChannelDefaults.DetachAfter = time.Duration(detachAfter) * time.Second
+		net.Highlights = fromNullStringList(highlights)
+		net.Ignores = fromNullStringList(ignores)
+		net.Ident = ident.String
 		networks = append(networks, net)
 	}
 	if err := rows.Err(); err != nil {
@@ -298,6 +432,11 @@ func (db *PostgresDB) StoreNetwork(ctx context.Context, userID int64, network *N
 	realname := toNullString(network.Realname)
 	pass := toNullString(network.Pass)
 	connectCommands := toNullString(strings.Join(network.ConnectCommands, "\r\n"))
+	defaults := &network.ChannelDefaults
+	detachAfter := int64(math.Ceil(defaults.DetachAfter.Seconds()))
+	highlights := toNullStringList(network.Highlights)
+	ignores := toNullStringList(network.Ignores)
+	ident := toNullString(network.Ident)
 
 	var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
 	if network.SASL.Mechanism != "" {
@@ -320,23 +459,28 @@ func (db *PostgresDB) StoreNetwork(ctx context.Context, userID int64, network *N
 		err = db.db.QueryRowContext(ctx, `
 			INSERT INTO "Network" ("user", name, addr, nick, username, realname, pass, connect_commands,
 				sasl_mechanism, sasl_plain_username, sasl_plain_password, sasl_external_cert,
-				sasl_external_key, enabled)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+				sasl_external_key, enabled, relay_detached, reattach_on, detach_after, detach_on,
+				highlights, ignores, ident)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18,
+				$19, $20, $21)
 			RETURNING id`,
 			userID, netName, network.Addr, nick, netUsername, realname, pass, connectCommands,
 			saslMechanism, saslPlainUsername, saslPlainPassword, network.SASL.External.CertBlob,
-			network.SASL.External.PrivKeyBlob, network.Enabled).Scan(&network.ID)
+			network.SASL.External.PrivKeyBlob, network.Enabled, defaults.RelayDetached,
+			defaults.ReattachOn, detachAfter, defaults.DetachOn, highlights, ignores, ident).Scan(&network.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "Network"
 			SET name = $2, addr = $3, nick = $4, username = $5, realname = $6, pass = $7,
 				connect_commands = $8, sasl_mechanism = $9, sasl_plain_username = $10,
 				sasl_plain_password = $11, sasl_external_cert = $12, sasl_external_key = $13,
-				enabled = $14
+				enabled = $14, relay_detached = $15, reattach_on = $16, detach_after = $17,
+				detach_on = $18, highlights = $19, ignores = $20, ident = $21
 			WHERE id = $1`,
 			network.ID, netName, network.Addr, nick, netUsername, realname, pass, connectCommands,
 			saslMechanism, saslPlainUsername, saslPlainPassword, network.SASL.External.CertBlob,
-			network.SASL.External.PrivKeyBlob, network.Enabled)
+			network.SASL.External.PrivKeyBlob, network.Enabled, defaults.RelayDetached,
+			defaults.ReattachOn, detachAfter, defaults.DetachOn, highlights, ignores, ident)
 	}
 	return err
 }
@@ -419,12 +563,36 @@ func (db *PostgresDB) DeleteChannel(ctx context.Context, id int64) error {
 	return err
 }
 
+func (db *PostgresDB) setRecordID(ctx context.Context, table string, oldID, newID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	quoted := `"` + table + `"`
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %v SET id = $1 WHERE id = $2`, quoted), newID, oldID)
+	if err != nil {
+		return err
+	}
+	// Sequences ignore explicit IDs, make sure the new ID won't be allocated
+	// again
+	_, err = tx.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence($1, 'id'), (SELECT MAX(id) FROM `+quoted+`))`, quoted)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (db *PostgresDB) ListDeliveryReceipts(ctx context.Context, networkID int64) ([]DeliveryReceipt, error) {
 	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
 	defer cancel()
 
 	rows, err := db.db.QueryContext(ctx, `
-		SELECT id, target, client, internal_msgid
+		SELECT id, target, client, internal_msgid, updated_at
 		FROM "DeliveryReceipt"
 		WHERE network = $1`, networkID)
 	if err != nil {
@@ -435,9 +603,11 @@ func (db *PostgresDB) ListDeliveryReceipts(ctx context.Context, networkID int64)
 	var receipts []DeliveryReceipt
 	for rows.Next() {
 		var rcpt DeliveryReceipt
-		if err := rows.Scan(&rcpt.ID, &rcpt.Target, &rcpt.Client, &rcpt.InternalMsgID); err != nil {
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&rcpt.ID, &rcpt.Target, &rcpt.Client, &rcpt.InternalMsgID, &updatedAt); err != nil {
 			return nil, err
 		}
+		rcpt.UpdatedAt = updatedAt.Time
 		receipts = append(receipts, rcpt)
 	}
 	if err := rows.Err(); err != nil {
@@ -465,8 +635,8 @@ func (db *PostgresDB) StoreClientDeliveryReceipts(ctx context.Context, networkID
 	}
 
 	stmt, err := tx.PrepareContext(ctx, `
-		INSERT INTO "DeliveryReceipt" (network, target, client, internal_msgid)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO "DeliveryReceipt" (network, target, client, internal_msgid, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id`)
 	if err != nil {
 		return err
@@ -476,7 +646,7 @@ func (db *PostgresDB) StoreClientDeliveryReceipts(ctx context.Context, networkID
 	for i := range receipts {
 		rcpt := &receipts[i]
 		err := stmt.
-			QueryRowContext(ctx, networkID, rcpt.Target, client, rcpt.InternalMsgID).
+			QueryRowContext(ctx, networkID, rcpt.Target, client, rcpt.InternalMsgID, toNullTime(rcpt.UpdatedAt)).
 			Scan(&rcpt.ID)
 		if err != nil {
 			return err
@@ -485,3 +655,144 @@ func (db *PostgresDB) StoreClientDeliveryReceipts(ctx context.Context, networkID
 
 	return tx.Commit()
 }
+
+func (db *PostgresDB) ListWebhooks(ctx context.Context, userID int64) ([]Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, url, events, secret
+		FROM "Webhook"
+		WHERE "user" = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var webhook Webhook
+		var events, secret sql.NullString
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &events, &secret); err != nil {
+			return nil, err
+		}
+		if events.Valid {
+			webhook.Events = strings.Split(events.String, ",")
+		}
+		webhook.Secret = secret.String
+		webhooks = append(webhooks, webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (db *PostgresDB) StoreWebhook(ctx context.Context, userID int64, webhook *Webhook) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	events := toNullString(strings.Join(webhook.Events, ","))
+	secret := toNullString(webhook.Secret)
+
+	var err error
+	if webhook.ID == 0 {
+		err = db.db.QueryRowContext(ctx, `
+			INSERT INTO "Webhook" ("user", url, events, secret)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id`,
+			userID, webhook.URL, events, secret).Scan(&webhook.ID)
+	} else {
+		_, err = db.db.ExecContext(ctx, `
+			UPDATE "Webhook"
+			SET url = $2, events = $3, secret = $4
+			WHERE id = $1`,
+			webhook.ID, webhook.URL, events, secret)
+	}
+	return err
+}
+
+func (db *PostgresDB) DeleteWebhook(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Webhook" WHERE id = $1`, id)
+	return err
+}
+
+func (db *PostgresDB) StoreAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	return db.db.QueryRowContext(ctx, `
+		INSERT INTO "AuditLog" (time, actor, source, action, target, details, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		entry.Time, toNullString(entry.Actor), toNullString(entry.Source),
+		entry.Action, toNullString(entry.Target), toNullString(entry.Details),
+		toNullString(entry.Error)).Scan(&entry.ID)
+}
+
+func (db *PostgresDB) ListAuditEntries(ctx context.Context, filter *AuditFilter) ([]AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	var conds []string
+	var args []interface{}
+	addCond := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.Actor != "" {
+		addCond("actor = $%d", filter.Actor)
+	}
+	if filter.Target != "" {
+		addCond("target = $%d", filter.Target)
+	}
+	if filter.Action != "" {
+		addCond("action = $%d", filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		addCond("time >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		addCond("time < $%d", filter.Until)
+	}
+
+	query := `SELECT id, time, actor, source, action, target, details, error FROM "AuditLog"`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var actor, source, target, details, errStr sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Time, &actor, &source, &entry.Action, &target, &details, &errStr); err != nil {
+			return nil, err
+		}
+		entry.Actor = actor.String
+		entry.Source = source.String
+		entry.Target = target.String
+		entry.Details = details.String
+		entry.Error = errStr.String
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -20,7 +20,18 @@ CREATE TABLE User (
 	username TEXT NOT NULL UNIQUE,
 	password TEXT,
 	admin INTEGER NOT NULL DEFAULT 0,
-	realname TEXT
+	realname TEXT,
+	relay_detached INTEGER NOT NULL DEFAULT 0,
+	reattach_on INTEGER NOT NULL DEFAULT 0,
+	detach_after INTEGER NOT NULL DEFAULT 0,
+	detach_on INTEGER NOT NULL DEFAULT 0,
+	highlights TEXT,
+	ignores TEXT,
+	enabled INTEGER NOT NULL DEFAULT 1,
+	max_channels INTEGER NOT NULL DEFAULT 0,
+	max_downstreams INTEGER NOT NULL DEFAULT 0,
+	max_log_size INTEGER NOT NULL DEFAULT 0,
+	max_connect_commands INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE Network (
@@ -39,6 +50,13 @@ CREATE TABLE Network (
 	sasl_external_cert BLOB,
 	sasl_external_key BLOB,
 	enabled INTEGER NOT NULL DEFAULT 1,
+	relay_detached INTEGER NOT NULL DEFAULT 0,
+	reattach_on INTEGER NOT NULL DEFAULT 0,
+	detach_after INTEGER NOT NULL DEFAULT 0,
+	detach_on INTEGER NOT NULL DEFAULT 0,
+	highlights TEXT,
+	ignores TEXT,
+	ident TEXT,
 	FOREIGN KEY(user) REFERENCES User(id),
 	UNIQUE(user, addr, nick),
 	UNIQUE(user, name)
@@ -65,9 +83,30 @@ CREATE TABLE DeliveryReceipt (
 	target TEXT NOT NULL,
 	client TEXT,
 	internal_msgid TEXT NOT NULL,
+	updated_at TEXT,
 	FOREIGN KEY(network) REFERENCES Network(id),
 	UNIQUE(network, target, client)
 );
+
+CREATE TABLE Webhook (
+	id INTEGER PRIMARY KEY,
+	user INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	events TEXT,
+	secret TEXT,
+	FOREIGN KEY(user) REFERENCES User(id)
+);
+
+CREATE TABLE AuditLog (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	actor TEXT,
+	source TEXT,
+	action TEXT NOT NULL,
+	target TEXT,
+	details TEXT,
+	error TEXT
+);
 `
 
 var sqliteMigrations = []string{
@@ -168,6 +207,53 @@ var sqliteMigrations = []string{
 		DROP TABLE Network;
 		ALTER TABLE NetworkNew RENAME TO Network;
 	`,
+	`
+		ALTER TABLE User ADD COLUMN relay_detached INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN reattach_on INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN detach_after INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN detach_on INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN relay_detached INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN reattach_on INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN detach_after INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN detach_on INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE User ADD COLUMN highlights TEXT;
+		ALTER TABLE User ADD COLUMN ignores TEXT;
+		ALTER TABLE Network ADD COLUMN highlights TEXT;
+		ALTER TABLE Network ADD COLUMN ignores TEXT;
+	`,
+	`
+		CREATE TABLE Webhook (
+			id INTEGER PRIMARY KEY,
+			user INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			events TEXT,
+			secret TEXT,
+			FOREIGN KEY(user) REFERENCES User(id)
+		);
+	`,
+	"ALTER TABLE DeliveryReceipt ADD COLUMN updated_at TEXT",
+	`
+		CREATE TABLE AuditLog (
+			id INTEGER PRIMARY KEY,
+			time TEXT NOT NULL,
+			actor TEXT,
+			source TEXT,
+			action TEXT NOT NULL,
+			target TEXT,
+			details TEXT,
+			error TEXT
+		);
+	`,
+	"ALTER TABLE User ADD COLUMN enabled INTEGER NOT NULL DEFAULT 1",
+	`
+		ALTER TABLE User ADD COLUMN max_channels INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN max_downstreams INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN max_log_size INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN max_connect_commands INTEGER NOT NULL DEFAULT 0;
+	`,
+	"ALTER TABLE Network ADD COLUMN ident TEXT",
 }
 
 type SqliteDB struct {
@@ -264,6 +350,33 @@ func toNullString(s string) sql.NullString {
 	}
 }
 
+func toNullStringList(l []string) sql.NullString {
+	return toNullString(strings.Join(l, "\r\n"))
+}
+
+func fromNullStringList(s sql.NullString) []string {
+	if !s.Valid {
+		return nil
+	}
+	return strings.Split(s.String, "\r\n")
+}
+
+func toNullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{
+		Time:  t,
+		Valid: !t.IsZero(),
+	}
+}
+
+// formatSqliteTime formats a timestamp for a TEXT column, or returns NULL if
+// the timestamp is zero.
+func formatSqliteTime(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+	return toNullString(t.UTC().Format(time.RFC3339))
+}
+
 func (db *SqliteDB) ListUsers(ctx context.Context) ([]User, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
@@ -271,8 +384,12 @@ func (db *SqliteDB) ListUsers(ctx context.Context) ([]User, error) {
 	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
 	defer cancel()
 
-	rows, err := db.db.QueryContext(ctx,
-		"SELECT id, username, password, admin, realname FROM User")
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, username, password, admin, realname,
+			relay_detached, reattach_on, detach_after, detach_on,
+			highlights, ignores, enabled, max_channels, max_downstreams,
+			max_log_size, max_connect_commands
+		FROM User`)
 	if err != nil {
 		return nil, err
 	}
@@ -281,12 +398,19 @@ func (db *SqliteDB) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		var password, realname sql.NullString
-		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname); err != nil {
+		var password, realname, highlights, ignores sql.NullString
+		var detachAfter int64
+		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname,
+			&user.ChannelDefaults.RelayDetached, &user.ChannelDefaults.ReattachOn, &detachAfter, &user.ChannelDefaults.DetachOn,
+			&highlights, &ignores, &user.Enabled, &user.Quotas.MaxChannels, &user.Quotas.MaxDownstreams,
+			&user.Quotas.MaxLogSize, &user.Quotas.MaxConnectCommands); err != nil {
 			return nil, err
 		}
 		user.Password = password.String
 		user.Realname = realname.String
+		user.ChannelDefaults.DetachAfter = time.Duration(detachAfter) * time.Second
+		user.Highlights = fromNullStringList(highlights)
+		user.Ignores = fromNullStringList(ignores)
 		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
@@ -305,15 +429,27 @@ func (db *SqliteDB) GetUser(ctx context.Context, username string) (*User, error)
 
 	user := &User{Username: username}
 
-	var password, realname sql.NullString
-	row := db.db.QueryRowContext(ctx,
-		"SELECT id, password, admin, realname FROM User WHERE username = ?",
+	var password, realname, highlights, ignores sql.NullString
+	var detachAfter int64
+	row := db.db.QueryRowContext(ctx, `
+		SELECT id, password, admin, realname,
+			relay_detached, reattach_on, detach_after, detach_on,
+			highlights, ignores, enabled, max_channels, max_downstreams,
+			max_log_size, max_connect_commands
+		FROM User
+		WHERE username = ?`,
 		username)
-	if err := row.Scan(&user.ID, &password, &user.Admin, &realname); err != nil {
+	if err := row.Scan(&user.ID, &password, &user.Admin, &realname,
+		&user.ChannelDefaults.RelayDetached, &user.ChannelDefaults.ReattachOn, &detachAfter, &user.ChannelDefaults.DetachOn,
+		&highlights, &ignores, &user.Enabled, &user.Quotas.MaxChannels, &user.Quotas.MaxDownstreams,
+		&user.Quotas.MaxLogSize, &user.Quotas.MaxConnectCommands); err != nil {
 		return nil, err
 	}
 	user.Password = password.String
 	user.Realname = realname.String
+	user.ChannelDefaults.DetachAfter = time.Duration(detachAfter) * time.Second
+	user.Highlights = fromNullStringList(highlights)
+	user.Ignores = fromNullStringList(ignores)
 	return user, nil
 }
 
@@ -329,20 +465,44 @@ func (db *SqliteDB) StoreUser(ctx context.Context, user *User) error {
 		sql.Named("password", toNullString(user.Password)),
 		sql.Named("admin", user.Admin),
 		sql.Named("realname", toNullString(user.Realname)),
+		sql.Named("relay_detached", user.ChannelDefaults.RelayDetached),
+		sql.Named("reattach_on", user.ChannelDefaults.ReattachOn),
+		sql.Named("detach_after", int64(math.Ceil(user.ChannelDefaults.DetachAfter.Seconds()))),
+		sql.Named("detach_on", user.ChannelDefaults.DetachOn),
+		sql.Named("highlights", toNullStringList(user.Highlights)),
+		sql.Named("ignores", toNullStringList(user.Ignores)),
+		sql.Named("enabled", user.Enabled),
+		sql.Named("max_channels", user.Quotas.MaxChannels),
+		sql.Named("max_downstreams", user.Quotas.MaxDownstreams),
+		sql.Named("max_log_size", user.Quotas.MaxLogSize),
+		sql.Named("max_connect_commands", user.Quotas.MaxConnectCommands),
 	}
 
 	var err error
 	if user.ID != 0 {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE User SET password = :password, admin = :admin,
-				realname = :realname WHERE username = :username`,
+				realname = :realname, relay_detached = :relay_detached,
+				reattach_on = :reattach_on, detach_after = :detach_after,
+				detach_on = :detach_on, highlights = :highlights,
+				ignores = :ignores, enabled = :enabled,
+				max_channels = :max_channels, max_downstreams = :max_downstreams,
+				max_log_size = :max_log_size,
+				max_connect_commands = :max_connect_commands
+			WHERE username = :username`,
 			args...)
 	} else {
 		var res sql.Result
 		res, err = db.db.ExecContext(ctx, `
 			INSERT INTO
-			User(username, password, admin, realname)
-			VALUES (:username, :password, :admin, :realname)`,
+			User(username, password, admin, realname, relay_detached,
+				reattach_on, detach_after, detach_on, highlights, ignores,
+				enabled, max_channels, max_downstreams, max_log_size,
+				max_connect_commands)
+			VALUES (:username, :password, :admin, :realname, :relay_detached,
+				:reattach_on, :detach_after, :detach_on, :highlights, :ignores,
+				:enabled, :max_channels, :max_downstreams, :max_log_size,
+				:max_connect_commands)`,
 			args...)
 		if err != nil {
 			return err
@@ -393,6 +553,11 @@ func (db *SqliteDB) DeleteUser(ctx context.Context, id int64) error {
 		return err
 	}
 
+	_, err = tx.ExecContext(ctx, "DELETE FROM Webhook WHERE user = ?", id)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.ExecContext(ctx, "DELETE FROM User WHERE id = ?", id)
 	if err != nil {
 		return err
@@ -411,7 +576,9 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, addr, nick, username, realname, pass,
 			connect_commands, sasl_mechanism, sasl_plain_username, sasl_plain_password,
-			sasl_external_cert, sasl_external_key, enabled
+			sasl_external_cert, sasl_external_key, enabled,
+			relay_detached, reattach_on, detach_after, detach_on,
+			highlights, ignores, ident
 		FROM Network
 		WHERE user = ?`,
 		userID)
@@ -425,9 +592,13 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 		var net Network
 		var name, nick, username, realname, pass, connectCommands sql.NullString
 		var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+		var highlights, ignores, ident sql.NullString
+		var detachAfter int64
 		err := rows.Scan(&net.ID, &name, &net.Addr, &nick, &username, &realname,
 			&pass, &connectCommands, &saslMechanism, &saslPlainUsername, &saslPlainPassword,
-			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled)
+			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled,
+			&net.ChannelDefaults.RelayDetached, &net.ChannelDefaults.ReattachOn, &detachAfter, &net.ChannelDefaults.DetachOn,
+			&highlights, &ignores, &ident)
 		if err != nil {
 			return nil, err
 		}
@@ -442,6 +613,10 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 		net.SASL.Mechanism = saslMechanism.String
 		net.SASL.Plain.Username = saslPlainUsername.String
 		net.SASL.Plain.Password = saslPlainPassword.String
+		net.ChannelDefaults.DetachAfter = time.Duration(detachAfter) * time.Second
+		net.Highlights = fromNullStringList(highlights)
+		net.Ignores = fromNullStringList(ignores)
+		net.Ident = ident.String
 		networks = append(networks, net)
 	}
 	if err := rows.Err(); err != nil {
@@ -488,6 +663,13 @@ func (db *SqliteDB) StoreNetwork(ctx context.Context, userID int64, network *Net
 		sql.Named("sasl_external_cert", network.SASL.External.CertBlob),
 		sql.Named("sasl_external_key", network.SASL.External.PrivKeyBlob),
 		sql.Named("enabled", network.Enabled),
+		sql.Named("relay_detached", network.ChannelDefaults.RelayDetached),
+		sql.Named("reattach_on", network.ChannelDefaults.ReattachOn),
+		sql.Named("detach_after", int64(math.Ceil(network.ChannelDefaults.DetachAfter.Seconds()))),
+		sql.Named("detach_on", network.ChannelDefaults.DetachOn),
+		sql.Named("highlights", toNullStringList(network.Highlights)),
+		sql.Named("ignores", toNullStringList(network.Ignores)),
+		sql.Named("ident", toNullString(network.Ident)),
 
 		sql.Named("id", network.ID), // only for UPDATE
 		sql.Named("user", userID),   // only for INSERT
@@ -501,17 +683,23 @@ func (db *SqliteDB) StoreNetwork(ctx context.Context, userID int64, network *Net
 				realname = :realname, pass = :pass, connect_commands = :connect_commands,
 				sasl_mechanism = :sasl_mechanism, sasl_plain_username = :sasl_plain_username, sasl_plain_password = :sasl_plain_password,
 				sasl_external_cert = :sasl_external_cert, sasl_external_key = :sasl_external_key,
-				enabled = :enabled
+				enabled = :enabled, relay_detached = :relay_detached, reattach_on = :reattach_on,
+				detach_after = :detach_after, detach_on = :detach_on,
+				highlights = :highlights, ignores = :ignores, ident = :ident
 			WHERE id = :id`, args...)
 	} else {
 		var res sql.Result
 		res, err = db.db.ExecContext(ctx, `
 			INSERT INTO Network(user, name, addr, nick, username, realname, pass,
 				connect_commands, sasl_mechanism, sasl_plain_username,
-				sasl_plain_password, sasl_external_cert, sasl_external_key, enabled)
+				sasl_plain_password, sasl_external_cert, sasl_external_key, enabled,
+				relay_detached, reattach_on, detach_after, detach_on, highlights, ignores,
+				ident)
 			VALUES (:user, :name, :addr, :nick, :username, :realname, :pass,
 				:connect_commands, :sasl_mechanism, :sasl_plain_username,
-				:sasl_plain_password, :sasl_external_cert, :sasl_external_key, :enabled)`,
+				:sasl_plain_password, :sasl_external_cert, :sasl_external_key, :enabled,
+				:relay_detached, :reattach_on, :detach_after, :detach_on, :highlights, :ignores,
+				:ident)`,
 			args...)
 		if err != nil {
 			return err
@@ -640,6 +828,19 @@ func (db *SqliteDB) DeleteChannel(ctx context.Context, id int64) error {
 	return err
 }
 
+func (db *SqliteDB) setRecordID(ctx context.Context, table string, oldID, newID int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	// Rows without an explicit ID get the largest ID plus one, so the new ID
+	// won't be allocated again
+	_, err := db.db.ExecContext(ctx, fmt.Sprintf("UPDATE %v SET id = ? WHERE id = ?", table), newID, oldID)
+	return err
+}
+
 func (db *SqliteDB) ListDeliveryReceipts(ctx context.Context, networkID int64) ([]DeliveryReceipt, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
@@ -648,7 +849,7 @@ func (db *SqliteDB) ListDeliveryReceipts(ctx context.Context, networkID int64) (
 	defer cancel()
 
 	rows, err := db.db.QueryContext(ctx, `
-		SELECT id, target, client, internal_msgid
+		SELECT id, target, client, internal_msgid, updated_at
 		FROM DeliveryReceipt
 		WHERE network = ?`, networkID)
 	if err != nil {
@@ -659,11 +860,17 @@ func (db *SqliteDB) ListDeliveryReceipts(ctx context.Context, networkID int64) (
 	var receipts []DeliveryReceipt
 	for rows.Next() {
 		var rcpt DeliveryReceipt
-		var client sql.NullString
-		if err := rows.Scan(&rcpt.ID, &rcpt.Target, &client, &rcpt.InternalMsgID); err != nil {
+		var client, updatedAt sql.NullString
+		if err := rows.Scan(&rcpt.ID, &rcpt.Target, &client, &rcpt.InternalMsgID, &updatedAt); err != nil {
 			return nil, err
 		}
 		rcpt.Client = client.String
+		if updatedAt.Valid {
+			rcpt.UpdatedAt, err = time.Parse(time.RFC3339, updatedAt.String)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delivery receipt timestamp: %v", err)
+			}
+		}
 		receipts = append(receipts, rcpt)
 	}
 	if err := rows.Err(); err != nil {
@@ -696,12 +903,13 @@ func (db *SqliteDB) StoreClientDeliveryReceipts(ctx context.Context, networkID i
 		rcpt := &receipts[i]
 
 		res, err := tx.ExecContext(ctx, `
-			INSERT INTO DeliveryReceipt(network, target, client, internal_msgid)
-			VALUES (:network, :target, :client, :internal_msgid)`,
+			INSERT INTO DeliveryReceipt(network, target, client, internal_msgid, updated_at)
+			VALUES (:network, :target, :client, :internal_msgid, :updated_at)`,
 			sql.Named("network", networkID),
 			sql.Named("target", rcpt.Target),
 			sql.Named("client", toNullString(client)),
-			sql.Named("internal_msgid", rcpt.InternalMsgID))
+			sql.Named("internal_msgid", rcpt.InternalMsgID),
+			sql.Named("updated_at", formatSqliteTime(rcpt.UpdatedAt)))
 		if err != nil {
 			return err
 		}
@@ -713,3 +921,180 @@ func (db *SqliteDB) StoreClientDeliveryReceipts(ctx context.Context, networkID i
 
 	return tx.Commit()
 }
+
+func (db *SqliteDB) ListWebhooks(ctx context.Context, userID int64) ([]Webhook, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, url, events, secret
+		FROM Webhook
+		WHERE user = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var webhook Webhook
+		var events, secret sql.NullString
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &events, &secret); err != nil {
+			return nil, err
+		}
+		if events.Valid {
+			webhook.Events = strings.Split(events.String, ",")
+		}
+		webhook.Secret = secret.String
+		webhooks = append(webhooks, webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (db *SqliteDB) StoreWebhook(ctx context.Context, userID int64, webhook *Webhook) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	args := []interface{}{
+		sql.Named("url", webhook.URL),
+		sql.Named("events", toNullString(strings.Join(webhook.Events, ","))),
+		sql.Named("secret", toNullString(webhook.Secret)),
+
+		sql.Named("id", webhook.ID), // only for UPDATE
+		sql.Named("user", userID),   // only for INSERT
+	}
+
+	var err error
+	if webhook.ID != 0 {
+		_, err = db.db.ExecContext(ctx, `
+			UPDATE Webhook SET url = :url, events = :events, secret = :secret
+			WHERE id = :id`, args...)
+	} else {
+		var res sql.Result
+		res, err = db.db.ExecContext(ctx, `
+			INSERT INTO Webhook(user, url, events, secret)
+			VALUES (:user, :url, :events, :secret)`, args...)
+		if err != nil {
+			return err
+		}
+		webhook.ID, err = res.LastInsertId()
+	}
+	return err
+}
+
+func (db *SqliteDB) DeleteWebhook(ctx context.Context, id int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, "DELETE FROM Webhook WHERE id = ?", id)
+	return err
+}
+
+func (db *SqliteDB) StoreAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	res, err := db.db.ExecContext(ctx, `
+		INSERT INTO AuditLog(time, actor, source, action, target, details, error)
+		VALUES (:time, :actor, :source, :action, :target, :details, :error)`,
+		sql.Named("time", formatSqliteTime(entry.Time)),
+		sql.Named("actor", toNullString(entry.Actor)),
+		sql.Named("source", toNullString(entry.Source)),
+		sql.Named("action", entry.Action),
+		sql.Named("target", toNullString(entry.Target)),
+		sql.Named("details", toNullString(entry.Details)),
+		sql.Named("error", toNullString(entry.Error)))
+	if err != nil {
+		return err
+	}
+	entry.ID, err = res.LastInsertId()
+	return err
+}
+
+func (db *SqliteDB) ListAuditEntries(ctx context.Context, filter *AuditFilter) ([]AuditEntry, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	var conds []string
+	var args []interface{}
+	if filter.Actor != "" {
+		conds = append(conds, "actor = :actor")
+		args = append(args, sql.Named("actor", filter.Actor))
+	}
+	if filter.Target != "" {
+		conds = append(conds, "target = :target")
+		args = append(args, sql.Named("target", filter.Target))
+	}
+	if filter.Action != "" {
+		conds = append(conds, "action = :action")
+		args = append(args, sql.Named("action", filter.Action))
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "time >= :since")
+		args = append(args, sql.Named("since", formatSqliteTime(filter.Since)))
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "time < :until")
+		args = append(args, sql.Named("until", formatSqliteTime(filter.Until)))
+	}
+
+	query := "SELECT id, time, actor, source, action, target, details, error FROM AuditLog"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT :limit"
+		args = append(args, sql.Named("limit", filter.Limit))
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var t string
+		var actor, source, target, details, errStr sql.NullString
+		if err := rows.Scan(&entry.ID, &t, &actor, &source, &entry.Action, &target, &details, &errStr); err != nil {
+			return nil, err
+		}
+		entry.Time, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audit log timestamp: %v", err)
+		}
+		entry.Actor = actor.String
+		entry.Source = source.String
+		entry.Target = target.String
+		entry.Details = details.String
+		entry.Error = errStr.String
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
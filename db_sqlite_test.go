@@ -1,8 +1,10 @@
 package soju
 
 import (
+	"context"
 	"database/sql"
 	"testing"
+	"time"
 )
 
 // SQLite version 0 schema. DO NOT EDIT.
@@ -57,3 +59,43 @@ func TestSqliteMigrations(t *testing.T) {
 		t.Fatalf("SqliteDB.Upgrade() failed: %v", err)
 	}
 }
+
+func TestSqliteAuditLog(t *testing.T) {
+	db, err := OpenSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create temporary SQLite database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	entries := []AuditEntry{
+		{Time: now.Add(-2 * time.Hour), Actor: "admin", Action: "user.create", Target: "jim"},
+		{Time: now.Add(-time.Hour), Actor: "jim", Action: "network.create", Target: "jim", Details: `network "libera"`},
+		{Time: now, Actor: "admin", Action: "user.delete", Target: "jim", Error: "database is locked"},
+	}
+	for i := range entries {
+		if err := db.StoreAuditEntry(ctx, &entries[i]); err != nil {
+			t.Fatalf("StoreAuditEntry() = %v", err)
+		}
+	}
+
+	l, err := db.ListAuditEntries(ctx, &AuditFilter{Actor: "admin"})
+	if err != nil {
+		t.Fatalf("ListAuditEntries() = %v", err)
+	}
+	if len(l) != 2 || l[0].Action != "user.delete" || l[1].Action != "user.create" {
+		t.Errorf("ListAuditEntries(actor) = %v, want user.delete and user.create", l)
+	}
+	if !l[0].Time.Equal(now) || l[0].Error != "database is locked" {
+		t.Errorf("ListAuditEntries(actor) returned %+v, want time %v and error", l[0], now)
+	}
+
+	l, err = db.ListAuditEntries(ctx, &AuditFilter{Since: now.Add(-90 * time.Minute), Limit: 1})
+	if err != nil {
+		t.Fatalf("ListAuditEntries() = %v", err)
+	}
+	if len(l) != 1 || l[0].Action != "user.delete" {
+		t.Errorf("ListAuditEntries(since, limit) = %v, want user.delete", l)
+	}
+}
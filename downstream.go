@@ -3,11 +3,13 @@ package soju
 import (
 	"context"
 	"crypto/tls"
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -59,6 +61,16 @@ var errAuthFailed = ircError{&irc.Message{
 	Params:  []string{"*", "Invalid username or password"},
 }}
 
+var errAuthSuspended = ircError{&irc.Message{
+	Command: irc.ERR_PASSWDMISMATCH,
+	Params:  []string{"*", "This account has been suspended, please contact the bouncer administrator"},
+}}
+
+var errAuthLockedOut = ircError{&irc.Message{
+	Command: irc.ERR_PASSWDMISMATCH,
+	Params:  []string{"*", "Too many failed login attempts, try again later"},
+}}
+
 func parseBouncerNetID(subcommand, s string) (int64, error) {
 	id, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
@@ -243,7 +255,8 @@ var passthroughIsupport = map[string]bool{
 type downstreamConn struct {
 	conn
 
-	id uint64
+	id       uint64
+	listener *ListenerConfig // can be nil
 
 	registered  bool
 	user        *user
@@ -255,6 +268,7 @@ type downstreamConn struct {
 	realname    string
 	hostname    string
 	password    string   // empty after authentication
+	peerUser    string   // Unix user authenticated via the socket, if any
 	network     *network // can be nil
 
 	negotiatingCaps bool
@@ -265,31 +279,54 @@ type downstreamConn struct {
 	lastBatchRef uint64
 
 	saslServer sasl.Server
+
+	connectedAt time.Time
 }
 
-func newDownstreamConn(srv *Server, ic ircConn, id uint64) *downstreamConn {
+func newDownstreamConn(srv *Server, ic ircConn, id uint64, lcfg *ListenerConfig) *downstreamConn {
 	remoteAddr := ic.RemoteAddr().String()
-	logger := &prefixLogger{srv.Logger, fmt.Sprintf("downstream %q: ", remoteAddr)}
+	logger := srv.Logger.With("conn", id).With("remote", remoteAddr)
 	options := connOptions{Logger: logger}
 	dc := &downstreamConn{
 		conn:          *newConn(srv, ic, &options),
 		id:            id,
+		listener:      lcfg,
 		supportedCaps: make(map[string]string),
 		caps:          make(map[string]bool),
+		connectedAt:   time.Now(),
 	}
 	dc.hostname = remoteAddr
 	if host, _, err := net.SplitHostPort(dc.hostname); err == nil {
 		dc.hostname = host
 	}
+	if lcfg != nil && lcfg.ClientHost != "" {
+		dc.hostname = lcfg.ClientHost
+	} else if dc.transport() == "unix" {
+		// Unix socket addresses don't identify the client
+		dc.hostname = "localhost"
+	}
 	for k, v := range permanentDownstreamCaps {
 		dc.supportedCaps[k] = v
 	}
-	if srv.LogPath != "" {
+	if srv.Config().LogPath != "" {
 		dc.supportedCaps["draft/chathistory"] = ""
 	}
 	return dc
 }
 
+// transport returns the kind of connection used by the client: "tcp", "ws" or
+// "unix".
+func (dc *downstreamConn) transport() string {
+	switch dc.conn.conn.LocalAddr().Network() {
+	case "ws":
+		return "ws"
+	case "unix":
+		return "unix"
+	default:
+		return "tcp"
+	}
+}
+
 func (dc *downstreamConn) prefix() *irc.Prefix {
 	return &irc.Prefix{
 		Name: dc.nick,
@@ -298,6 +335,18 @@ func (dc *downstreamConn) prefix() *irc.Prefix {
 	}
 }
 
+// srvHostname returns the bouncer hostname advertised to the client.
+func (dc *downstreamConn) srvHostname() string {
+	if dc.listener != nil && dc.listener.Hostname != "" {
+		return dc.listener.Hostname
+	}
+	return dc.srv.Config().Hostname
+}
+
+func (dc *downstreamConn) srvPrefix() *irc.Prefix {
+	return &irc.Prefix{Name: dc.srvHostname()}
+}
+
 func (dc *downstreamConn) forEachNetwork(f func(*network)) {
 	if dc.network != nil {
 		f(dc.network)
@@ -498,7 +547,7 @@ func (dc *downstreamConn) SendBatch(typ string, params []string, tags irc.Tags,
 	if dc.caps["batch"] {
 		dc.SendMessage(&irc.Message{
 			Tags:    tags,
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: "BATCH",
 			Params:  append([]string{"+" + ref, typ}, params...),
 		})
@@ -508,7 +557,7 @@ func (dc *downstreamConn) SendBatch(typ string, params []string, tags irc.Tags,
 
 	if dc.caps["batch"] {
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: "BATCH",
 			Params:  []string{"-" + ref},
 		})
@@ -541,7 +590,7 @@ func (dc *downstreamConn) advanceMessageWithID(msg *irc.Message, id string) {
 func (dc *downstreamConn) ackMsgID(id string) {
 	netID, entity, err := parseMsgID(id, nil)
 	if err != nil {
-		dc.logger.Printf("failed to ACK message ID %q: %v", id, err)
+		dc.logger.Errorf("failed to ACK message ID %q: %v", id, err)
 		return
 	}
 
@@ -720,7 +769,7 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 				}}
 			}
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.ERR_SASLFAIL,
 				Params:  []string{"*", "SASL error"},
 			})
@@ -728,12 +777,12 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 		} else if done {
 			dc.saslServer = nil
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_LOGGEDIN,
 				Params:  []string{dc.nick, dc.prefix().String(), dc.user.Username, "You are now logged in"},
 			})
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_SASLSUCCESS,
 				Params:  []string{dc.nick, "SASL authentication successful"},
 			})
@@ -745,7 +794,7 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 
 			// TODO: multi-line messages
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "AUTHENTICATE",
 				Params:  []string{challengeStr},
 			})
@@ -791,7 +840,7 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 			dc.networkName = match.GetName()
 		}
 	default:
-		dc.logger.Printf("unhandled message: %v", msg)
+		dc.logger.Debugf("unhandled message: %v", msg)
 		return newUnknownCommandError(msg.Command)
 	}
 	if dc.rawUsername != "" && dc.nick != "" && !dc.negotiatingCaps {
@@ -836,7 +885,7 @@ func (dc *downstreamConn) handleCapCommand(cmd string, args []string) error {
 
 		// TODO: multi-line replies
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: "CAP",
 			Params:  []string{replyTo, "LS", strings.Join(caps, " ")},
 		})
@@ -859,7 +908,7 @@ func (dc *downstreamConn) handleCapCommand(cmd string, args []string) error {
 
 		// TODO: multi-line replies
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: "CAP",
 			Params:  []string{replyTo, "LIST", strings.Join(caps, " ")},
 		})
@@ -905,7 +954,7 @@ func (dc *downstreamConn) handleCapCommand(cmd string, args []string) error {
 			reply = "ACK"
 		}
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: "CAP",
 			Params:  []string{replyTo, reply, args[0]},
 		})
@@ -944,7 +993,7 @@ func (dc *downstreamConn) setSupportedCap(name, value string) {
 	}
 
 	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
+		Prefix:  dc.srvPrefix(),
 		Command: "CAP",
 		Params:  []string{replyTo, "NEW", cap},
 	})
@@ -965,7 +1014,7 @@ func (dc *downstreamConn) unsetSupportedCap(name string) {
 	}
 
 	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
+		Prefix:  dc.srvPrefix(),
 		Command: "CAP",
 		Params:  []string{replyTo, "DEL", name},
 	})
@@ -990,7 +1039,7 @@ func (dc *downstreamConn) updateSupportedCaps() {
 		}
 	}
 
-	if dc.srv.LogPath != "" && dc.network != nil {
+	if dc.user.msgStore != nil && dc.network != nil {
 		dc.setSupportedCap("draft/event-playback", "")
 	} else {
 		dc.unsetSupportedCap("draft/event-playback")
@@ -1058,33 +1107,105 @@ func unmarshalUsername(rawUsername string) (username, client, network string) {
 func (dc *downstreamConn) authenticate(username, password string) error {
 	username, clientName, networkName := unmarshalUsername(username)
 
-	u, err := dc.srv.db.GetUser(context.TODO(), username)
+	ip := dc.srv.clientIP(dc.RemoteAddr())
+	if dc.srv.loginLimiter.IsLockedOut(username, ip) {
+		dc.logger.Printf("refused authentication for %q: locked out", username)
+		return errAuthLockedOut
+	}
+
+	record, err := dc.checkPassword(username, password)
 	if err != nil {
-		dc.logger.Printf("failed authentication for %q: user not found: %v", username, err)
-		return errAuthFailed
+		dc.recordAuthFailure(username, ip)
+		return err
 	}
+	dc.srv.loginLimiter.RecordSuccess(username, ip)
 
-	// Password auth disabled
-	if u.Password == "" {
+	return dc.login(record, clientName, networkName)
+}
+
+// authenticatePeer logs in as the user named after the Unix user of the
+// client. The username sent by the client is only used for the client and
+// network suffixes.
+func (dc *downstreamConn) authenticatePeer(rawUsername string) error {
+	_, clientName, networkName := unmarshalUsername(rawUsername)
+	username := dc.peerUser
+
+	record, err := dc.srv.db.GetUser(context.TODO(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		dc.logger.Printf("failed peer authentication for %q: user not found", username)
+		return errAuthFailed
+	} else if err != nil {
+		dc.logger.Errorf("failed peer authentication for %q: failed to get user: %v", username, err)
 		return errAuthFailed
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
-	if err != nil {
-		dc.logger.Printf("failed authentication for %q: wrong password: %v", username, err)
-		return errAuthFailed
+	return dc.login(record, clientName, networkName)
+}
+
+// login binds the connection to an authenticated user.
+func (dc *downstreamConn) login(record *User, clientName, networkName string) error {
+	if !record.Enabled {
+		dc.logger.Printf("failed authentication for %q: user suspended", record.Username)
+		return errAuthSuspended
 	}
 
-	dc.user = dc.srv.getUser(username)
+	dc.user = dc.srv.getUser(record.Username)
 	if dc.user == nil {
-		dc.logger.Printf("failed authentication for %q: user not active", username)
+		dc.logger.Errorf("failed authentication for %q: user not active", record.Username)
 		return errAuthFailed
 	}
 	dc.clientName = clientName
 	dc.networkName = networkName
+	dc.logger = dc.logger.With("user", record.Username)
+	if networkName != "" {
+		dc.logger = dc.logger.With("network", networkName)
+	}
 	return nil
 }
 
+func (dc *downstreamConn) recordAuthFailure(username, ip string) {
+	userLocked, ipLocked := dc.srv.loginLimiter.RecordFailure(username, ip, dc.srv.Config().LoginMaxFailures, dc.srv.Config().LoginLockout)
+
+	var locked []string
+	if userLocked {
+		locked = append(locked, fmt.Sprintf("username %q", username))
+	}
+	if ipLocked {
+		locked = append(locked, fmt.Sprintf("IP address %v", ip))
+	}
+	if len(locked) == 0 {
+		return
+	}
+
+	text := fmt.Sprintf("too many failed login attempts, locked out %v for %v", strings.Join(locked, " and "), dc.srv.Config().LoginLockout)
+	dc.logger.Print(text)
+	go dc.srv.notifyAdmins(text)
+}
+
+func (dc *downstreamConn) checkPassword(username, password string) (*User, error) {
+	u, err := dc.srv.db.GetUser(context.TODO(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		dc.logger.Printf("failed authentication for %q: user not found", username)
+		return nil, errAuthFailed
+	} else if err != nil {
+		dc.logger.Errorf("failed authentication for %q: failed to get user: %v", username, err)
+		return nil, errAuthFailed
+	}
+
+	// Password auth disabled
+	if u.Password == "" {
+		return nil, errAuthFailed
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	if err != nil {
+		dc.logger.Printf("failed authentication for %q: wrong password", username)
+		return nil, errAuthFailed
+	}
+
+	return u, nil
+}
+
 func (dc *downstreamConn) register() error {
 	if dc.registered {
 		return fmt.Errorf("tried to register twice")
@@ -1092,7 +1213,11 @@ func (dc *downstreamConn) register() error {
 
 	password := dc.password
 	dc.password = ""
-	if dc.user == nil {
+	if dc.user == nil && password == "" && dc.peerUser != "" {
+		if err := dc.authenticatePeer(dc.rawUsername); err != nil {
+			return err
+		}
+	} else if dc.user == nil {
 		if err := dc.authenticate(dc.rawUsername, password); err != nil {
 			return err
 		}
@@ -1100,6 +1225,9 @@ func (dc *downstreamConn) register() error {
 
 	if dc.clientName == "" && dc.networkName == "" {
 		_, dc.clientName, dc.networkName = unmarshalUsername(dc.rawUsername)
+		if dc.networkName != "" {
+			dc.logger = dc.logger.With("network", dc.networkName)
+		}
 	}
 
 	dc.registered = true
@@ -1121,7 +1249,7 @@ func (dc *downstreamConn) loadNetwork() error {
 
 		dc.logger.Printf("trying to connect to new network %q", addr)
 		if err := sanityCheckServer(addr); err != nil {
-			dc.logger.Printf("failed to connect to %q: %v", addr, err)
+			dc.logger.Errorf("failed to connect to %q: %v", addr, err)
 			return ircError{&irc.Message{
 				Command: irc.ERR_PASSWDMISMATCH,
 				Params:  []string{"*", fmt.Sprintf("Failed to connect to %q", dc.networkName)},
@@ -1169,8 +1297,8 @@ func (dc *downstreamConn) welcome() error {
 	if dc.network != nil {
 		isupport = append(isupport, fmt.Sprintf("BOUNCER_NETID=%v", dc.network.ID))
 	}
-	if dc.network == nil && dc.srv.Title != "" {
-		isupport = append(isupport, "NETWORK="+encodeISUPPORT(dc.srv.Title))
+	if dc.network == nil && dc.srv.Config().Title != "" {
+		isupport = append(isupport, "NETWORK="+encodeISUPPORT(dc.srv.Config().Title))
 	}
 	if dc.network == nil && dc.caps["soju.im/bouncer-networks"] {
 		isupport = append(isupport, "WHOX")
@@ -1191,40 +1319,40 @@ func (dc *downstreamConn) welcome() error {
 	}
 
 	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
+		Prefix:  dc.srvPrefix(),
 		Command: irc.RPL_WELCOME,
 		Params:  []string{dc.nick, "Welcome to soju, " + dc.nick},
 	})
 	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
+		Prefix:  dc.srvPrefix(),
 		Command: irc.RPL_YOURHOST,
-		Params:  []string{dc.nick, "Your host is " + dc.srv.Hostname},
+		Params:  []string{dc.nick, "Your host is " + dc.srvHostname()},
 	})
 	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
+		Prefix:  dc.srvPrefix(),
 		Command: irc.RPL_MYINFO,
-		Params:  []string{dc.nick, dc.srv.Hostname, "soju", "aiwroO", "OovaimnqpsrtklbeI"},
+		Params:  []string{dc.nick, dc.srvHostname(), "soju", "aiwroO", "OovaimnqpsrtklbeI"},
 	})
-	for _, msg := range generateIsupport(dc.srv.prefix(), dc.nick, isupport) {
+	for _, msg := range generateIsupport(dc.srvPrefix(), dc.nick, isupport) {
 		dc.SendMessage(msg)
 	}
 	if uc := dc.upstream(); uc != nil {
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_UMODEIS,
 			Params:  []string{dc.nick, "+" + string(uc.modes)},
 		})
 	}
 	if dc.network == nil && dc.caps["soju.im/bouncer-networks"] && dc.user.Admin {
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_UMODEIS,
 			Params:  []string{dc.nick, "+o"},
 		})
 	}
 
 	if motd := dc.user.srv.MOTD(); motd != "" && dc.network == nil {
-		for _, msg := range generateMOTD(dc.srv.prefix(), dc.nick, motd) {
+		for _, msg := range generateMOTD(dc.srvPrefix(), dc.nick, motd) {
 			dc.SendMessage(msg)
 		}
 	} else {
@@ -1233,7 +1361,7 @@ func (dc *downstreamConn) welcome() error {
 			motdHint = "Use /motd to read the message of the day"
 		}
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.ERR_NOMOTD,
 			Params:  []string{dc.nick, motdHint},
 		})
@@ -1250,7 +1378,7 @@ func (dc *downstreamConn) welcome() error {
 				attrs := getNetworkAttrs(network)
 				dc.SendMessage(&irc.Message{
 					Tags:    irc.Tags{"batch": batchRef},
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: "BOUNCER",
 					Params:  []string{"NETWORK", idStr, attrs.String()},
 				})
@@ -1305,7 +1433,7 @@ func (dc *downstreamConn) welcome() error {
 				targetCM := net.casemap(target)
 				lastID, err := dc.user.msgStore.LastMsgID(&net.Network, targetCM, time.Now())
 				if err != nil {
-					dc.logger.Printf("failed to get last message ID: %v", err)
+					dc.logger.Errorf("failed to get last message ID: %v", err)
 					return
 				}
 				net.delivered.StoreID(target, dc.clientName, lastID)
@@ -1325,10 +1453,22 @@ func (dc *downstreamConn) messageSupportsBacklog(msg *irc.Message) bool {
 	switch msg.Command {
 	case "PRIVMSG", "NOTICE":
 		return true
+	case "JOIN", "PART", "KICK", "QUIT", "NICK", "TOPIC", "MODE":
+		return dc.backlogEventPlayback()
 	}
 	return false
 }
 
+// backlogEventPlayback checks whether events (JOIN, PART, and so on) can be
+// sent as part of an history batch.
+//
+// Clients supporting event-playback know that events in a chathistory batch
+// describe past changes, and won't apply them on top of the channel state we
+// send when joining.
+func (dc *downstreamConn) backlogEventPlayback() bool {
+	return dc.caps["draft/event-playback"] && dc.caps["batch"]
+}
+
 func (dc *downstreamConn) sendTargetBacklog(net *network, target, msgID string) {
 	if dc.caps["draft/chathistory"] || dc.user.msgStore == nil {
 		return
@@ -1340,9 +1480,9 @@ func (dc *downstreamConn) sendTargetBacklog(net *network, target, msgID string)
 	defer cancel()
 
 	targetCM := net.casemap(target)
-	history, err := dc.user.msgStore.LoadLatestID(ctx, &net.Network, targetCM, msgID, backlogLimit)
+	history, err := dc.user.msgStore.LoadLatestID(ctx, &net.Network, targetCM, msgID, backlogLimit, dc.backlogEventPlayback())
 	if err != nil {
-		dc.logger.Printf("failed to send backlog for %q: %v", target, err)
+		dc.logger.Errorf("failed to send backlog for %q: %v", target, err)
 		return
 	}
 
@@ -1383,7 +1523,7 @@ func (dc *downstreamConn) runUntilRegistered() error {
 
 		err = dc.handleMessage(msg)
 		if ircErr, ok := err.(ircError); ok {
-			ircErr.Message.Prefix = dc.srv.prefix()
+			ircErr.Message.Prefix = dc.srvPrefix()
 			dc.SendMessage(ircErr.Message)
 		} else if err != nil {
 			return fmt.Errorf("failed to handle IRC command %q: %v", msg, err)
@@ -1414,16 +1554,16 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		if len(msg.Params) > 1 {
 			destination = msg.Params[1]
 		}
-		if destination != "" && destination != dc.srv.Hostname {
+		if destination != "" && destination != dc.srvHostname() {
 			return ircError{&irc.Message{
 				Command: irc.ERR_NOSUCHSERVER,
 				Params:  []string{dc.nick, destination, "No such server"},
 			}}
 		}
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: "PONG",
-			Params:  []string{dc.srv.Hostname, source},
+			Params:  []string{dc.srvHostname(), source},
 		})
 		return nil
 	case "PONG":
@@ -1523,7 +1663,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 
 				n.Realname = storeRealname
 				if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &n.Network); err != nil {
-					dc.logger.Printf("failed to store network realname: %v", err)
+					dc.logger.Errorf("failed to store network realname: %v", err)
 					storeErr = err
 				}
 				return
@@ -1538,7 +1678,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		// mutates the original list
 		for _, record := range needUpdate {
 			if _, err := dc.user.updateNetwork(ctx, &record); err != nil {
-				dc.logger.Printf("failed to update network realname: %v", err)
+				dc.logger.Errorf("failed to update network realname: %v", err)
 				storeErr = err
 			}
 		}
@@ -1580,13 +1720,22 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 
 			if !uc.isChannel(upstreamName) {
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: irc.ERR_NOSUCHCHANNEL,
 					Params:  []string{name, "Not a channel name"},
 				})
 				continue
 			}
 
+			if uc.network.channelQuotaExceeded(upstreamName) {
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.srvPrefix(),
+					Command: irc.ERR_TOOMANYCHANNELS,
+					Params:  []string{dc.nick, name, "You have joined too many channels"},
+				})
+				continue
+			}
+
 			params := []string{upstreamName}
 			if key != "" {
 				params = append(params, key)
@@ -1612,7 +1761,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 				uc.network.channels.SetValue(upstreamName, ch)
 			}
 			if err := dc.srv.db.StoreChannel(ctx, uc.network.ID, ch); err != nil {
-				dc.logger.Printf("failed to create or update channel %q: %v", upstreamName, err)
+				dc.logger.Errorf("failed to create or update channel %q: %v", upstreamName, err)
 			}
 		}
 	case "PART":
@@ -1633,6 +1782,15 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			}
 
 			if strings.EqualFold(reason, "detach") {
+				if uc.network.channelQuotaExceeded(upstreamName) {
+					dc.SendMessage(&irc.Message{
+						Prefix:  dc.srvPrefix(),
+						Command: irc.ERR_TOOMANYCHANNELS,
+						Params:  []string{dc.nick, name, "You have saved too many channels"},
+					})
+					continue
+				}
+
 				ch := uc.network.channels.Value(upstreamName)
 				if ch != nil {
 					uc.network.detach(ch)
@@ -1644,7 +1802,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 					uc.network.channels.SetValue(upstreamName, ch)
 				}
 				if err := dc.srv.db.StoreChannel(ctx, uc.network.ID, ch); err != nil {
-					dc.logger.Printf("failed to create or update channel %q: %v", upstreamName, err)
+					dc.logger.Errorf("failed to create or update channel %q: %v", upstreamName, err)
 				}
 			} else {
 				params := []string{upstreamName}
@@ -1657,7 +1815,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 				})
 
 				if err := uc.network.deleteChannel(ctx, upstreamName); err != nil {
-					dc.logger.Printf("failed to delete channel %q: %v", upstreamName, err)
+					dc.logger.Errorf("failed to delete channel %q: %v", upstreamName, err)
 				}
 			}
 		}
@@ -1737,7 +1895,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 					})
 				} else {
 					dc.SendMessage(&irc.Message{
-						Prefix:  dc.srv.prefix(),
+						Prefix:  dc.srvPrefix(),
 						Command: irc.ERR_UMODEUNKNOWNFLAG,
 						Params:  []string{dc.nick, "Cannot change user mode in multi-upstream mode"},
 					})
@@ -1749,7 +1907,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 				}
 
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: irc.RPL_UMODEIS,
 					Params:  []string{dc.nick, "+" + userMode},
 				})
@@ -1796,13 +1954,13 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			params = append(params, modeParams...)
 
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_CHANNELMODEIS,
 				Params:  params,
 			})
 			if ch.creationTime != "" {
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: rpl_creationtime,
 					Params:  []string{dc.nick, name, ch.creationTime},
 				})
@@ -1846,7 +2004,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		}
 		if network == nil {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_LISTEND,
 				Params:  []string{dc.nick, "LIST without a network suffix is not supported in multi-upstream mode"},
 			})
@@ -1856,7 +2014,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		uc := network.conn
 		if uc == nil {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_LISTEND,
 				Params:  []string{dc.nick, "Disconnected from upstream server"},
 			})
@@ -1867,7 +2025,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 	case "NAMES":
 		if len(msg.Params) == 0 {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_ENDOFNAMES,
 				Params:  []string{dc.nick, "*", "End of /NAMES list"},
 			})
@@ -1900,7 +2058,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		if len(msg.Params) == 0 {
 			// TODO: support WHO without parameters
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_ENDOFWHO,
 				Params:  []string{dc.nick, "*", "End of /WHO list"},
 			})
@@ -1940,15 +2098,15 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 				Token:    whoxToken,
 				Username: dc.user.Username,
 				Hostname: dc.hostname,
-				Server:   dc.srv.Hostname,
+				Server:   dc.srvHostname(),
 				Nickname: dc.nick,
 				Flags:    flags,
 				Account:  dc.user.Username,
 				Realname: dc.realname,
 			}
-			dc.SendMessage(generateWHOXReply(dc.srv.prefix(), dc.nick, fields, &info))
+			dc.SendMessage(generateWHOXReply(dc.srvPrefix(), dc.nick, fields, &info))
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_ENDOFWHO,
 				Params:  []string{dc.nick, endOfWhoToken, "End of /WHO list"},
 			})
@@ -1959,15 +2117,15 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 				Token:    whoxToken,
 				Username: servicePrefix.User,
 				Hostname: servicePrefix.Host,
-				Server:   dc.srv.Hostname,
+				Server:   dc.srvHostname(),
 				Nickname: serviceNick,
 				Flags:    "H*",
 				Account:  serviceNick,
 				Realname: serviceRealname,
 			}
-			dc.SendMessage(generateWHOXReply(dc.srv.prefix(), dc.nick, fields, &info))
+			dc.SendMessage(generateWHOXReply(dc.srvPrefix(), dc.nick, fields, &info))
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_ENDOFWHO,
 				Params:  []string{dc.nick, endOfWhoToken, "End of /WHO list"},
 			})
@@ -2012,29 +2170,29 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 
 		if dc.network == nil && casemapASCII(mask) == dc.nickCM {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISUSER,
 				Params:  []string{dc.nick, dc.nick, dc.user.Username, dc.hostname, "*", dc.realname},
 			})
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISSERVER,
-				Params:  []string{dc.nick, dc.nick, dc.srv.Hostname, "soju"},
+				Params:  []string{dc.nick, dc.nick, dc.srvHostname(), "soju"},
 			})
 			if dc.user.Admin {
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: irc.RPL_WHOISOPERATOR,
 					Params:  []string{dc.nick, dc.nick, "is a bouncer administrator"},
 				})
 			}
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: rpl_whoisaccount,
 				Params:  []string{dc.nick, dc.nick, dc.user.Username, "is logged in as"},
 			})
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_ENDOFWHOIS,
 				Params:  []string{dc.nick, dc.nick, "End of /WHOIS list"},
 			})
@@ -2042,27 +2200,27 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		}
 		if casemapASCII(mask) == serviceNickCM {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISUSER,
 				Params:  []string{dc.nick, serviceNick, servicePrefix.User, servicePrefix.Host, "*", serviceRealname},
 			})
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISSERVER,
-				Params:  []string{dc.nick, serviceNick, dc.srv.Hostname, "soju"},
+				Params:  []string{dc.nick, serviceNick, dc.srvHostname(), "soju"},
 			})
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISOPERATOR,
 				Params:  []string{dc.nick, serviceNick, "is the bouncer service"},
 			})
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: rpl_whoisaccount,
 				Params:  []string{dc.nick, serviceNick, serviceNick, "is logged in as"},
 			})
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_ENDOFWHOIS,
 				Params:  []string{dc.nick, serviceNick, "End of /WHOIS list"},
 			})
@@ -2098,12 +2256,12 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		tags := copyClientTags(msg.Tags)
 
 		for _, name := range strings.Split(targetsStr, ",") {
-			if name == "$"+dc.srv.Hostname || (name == "$*" && dc.network == nil) {
+			if name == "$"+dc.srvHostname() || (name == "$*" && dc.network == nil) {
 				// "$" means a server mask follows. If it's the bouncer's
 				// hostname, broadcast the message to all bouncer users.
 				if !dc.user.Admin {
 					return ircError{&irc.Message{
-						Prefix:  dc.srv.prefix(),
+						Prefix:  dc.srvPrefix(),
 						Command: irc.ERR_BADMASK,
 						Params:  []string{dc.nick, name, "Permission denied to broadcast message to all bouncer users"},
 					}}
@@ -2295,12 +2453,6 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			}}
 		}
 
-		network, entity, err := dc.unmarshalEntityNetwork(target)
-		if err != nil {
-			return err
-		}
-		entity = network.casemap(entity)
-
 		// TODO: support msgid criteria
 		var bounds [2]time.Time
 		bounds[0] = parseChatHistoryBound(boundsStr[0])
@@ -2331,48 +2483,85 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 
 		eventPlayback := dc.caps["draft/event-playback"]
 
-		var history []*irc.Message
-		switch subcommand {
-		case "BEFORE":
-			history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], time.Time{}, limit, eventPlayback)
-		case "AFTER":
-			history, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0], time.Now(), limit, eventPlayback)
-		case "BETWEEN":
-			if bounds[0].Before(bounds[1]) {
-				history, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0], bounds[1], limit, eventPlayback)
-			} else {
-				history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], bounds[1], limit, eventPlayback)
+		if subcommand == "TARGETS" {
+			type networkTarget struct {
+				chatHistoryTarget
+				network *network
 			}
-		case "TARGETS":
-			// TODO: support TARGETS in multi-upstream mode
-			targets, err := store.ListTargets(ctx, &network.Network, bounds[0], bounds[1], limit, eventPlayback)
+
+			var targets []networkTarget
+			var err error
+			dc.forEachNetwork(func(network *network) {
+				if err != nil {
+					return
+				}
+
+				var l []chatHistoryTarget
+				l, err = store.ListTargets(ctx, &network.Network, bounds[0], bounds[1], limit, eventPlayback)
+				for _, target := range l {
+					if ch := network.channels.Value(target.Name); ch != nil && ch.Detached {
+						continue
+					}
+					targets = append(targets, networkTarget{target, network})
+				}
+			})
 			if err != nil {
-				dc.logger.Printf("failed fetching targets for chathistory: %v", err)
+				dc.logger.Errorf("failed fetching targets for chathistory: %v", err)
 				return ircError{&irc.Message{
 					Command: "FAIL",
 					Params:  []string{"CHATHISTORY", "MESSAGE_ERROR", subcommand, "Failed to retrieve targets"},
 				}}
 			}
 
+			// Merge the targets of all networks, sorted by latest message
+			// time in the same order as the time bounds
+			sort.SliceStable(targets, func(i, j int) bool {
+				t1, t2 := targets[i].LatestMessage, targets[j].LatestMessage
+				if bounds[0].Before(bounds[1]) {
+					return t1.Before(t2)
+				} else {
+					return t1.After(t2)
+				}
+			})
+			if len(targets) > limit {
+				targets = targets[:limit]
+			}
+
 			dc.SendBatch("draft/chathistory-targets", nil, nil, func(batchRef irc.TagValue) {
 				for _, target := range targets {
-					if ch := network.channels.Value(target.Name); ch != nil && ch.Detached {
-						continue
-					}
-
 					dc.SendMessage(&irc.Message{
 						Tags:    irc.Tags{"batch": batchRef},
-						Prefix:  dc.srv.prefix(),
+						Prefix:  dc.srvPrefix(),
 						Command: "CHATHISTORY",
-						Params:  []string{"TARGETS", target.Name, target.LatestMessage.UTC().Format(serverTimeLayout)},
+						Params:  []string{"TARGETS", dc.marshalEntity(target.network, target.Name), target.LatestMessage.UTC().Format(serverTimeLayout)},
 					})
 				}
 			})
 
 			return nil
 		}
+
+		network, entity, err := dc.unmarshalEntityNetwork(target)
+		if err != nil {
+			return err
+		}
+		entity = network.casemap(entity)
+
+		var history []*irc.Message
+		switch subcommand {
+		case "BEFORE":
+			history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], time.Time{}, limit, eventPlayback)
+		case "AFTER":
+			history, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0], time.Now(), limit, eventPlayback)
+		case "BETWEEN":
+			if bounds[0].Before(bounds[1]) {
+				history, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0], bounds[1], limit, eventPlayback)
+			} else {
+				history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], bounds[1], limit, eventPlayback)
+			}
+		}
 		if err != nil {
-			dc.logger.Printf("failed fetching %q messages for chathistory: %v", target, err)
+			dc.logger.Errorf("failed fetching %q messages for chathistory: %v", target, err)
 			return newChatHistoryError(subcommand, target)
 		}
 
@@ -2401,7 +2590,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 					attrs := getNetworkAttrs(network)
 					dc.SendMessage(&irc.Message{
 						Tags:    irc.Tags{"batch": batchRef},
-						Prefix:  dc.srv.prefix(),
+						Prefix:  dc.srvPrefix(),
 						Command: "BOUNCER",
 						Params:  []string{"NETWORK", idStr, attrs.String()},
 					})
@@ -2435,7 +2624,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			}
 
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "BOUNCER",
 				Params:  []string{"ADDNETWORK", fmt.Sprintf("%v", network.ID)},
 			})
@@ -2479,7 +2668,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			}
 
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "BOUNCER",
 				Params:  []string{"CHANGENETWORK", idStr},
 			})
@@ -2506,7 +2695,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			}
 
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "BOUNCER",
 				Params:  []string{"DELNETWORK", idStr},
 			})
@@ -2517,7 +2706,7 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			}}
 		}
 	default:
-		dc.logger.Printf("unhandled message: %v", msg)
+		dc.logger.Debugf("unhandled message: %v", msg)
 
 		// Only forward unknown commands in single-upstream mode
 		uc := dc.upstream()
@@ -2548,7 +2737,7 @@ func (dc *downstreamConn) handleNickServPRIVMSG(ctx context.Context, uc *upstrea
 	n.SASL.Plain.Username = username
 	n.SASL.Plain.Password = password
 	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &n.Network); err != nil {
-		dc.logger.Printf("failed to save NickServ credentials: %v", err)
+		dc.logger.Errorf("failed to save NickServ credentials: %v", err)
 	}
 }
 
@@ -0,0 +1,457 @@
+package soju
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// UpstreamHandover contains an upstream connection and its state, so that
+// another soju process can take it over without reconnecting.
+//
+// Only plain-text connections can be handed over: the state of a TLS session
+// can't be transferred.
+type UpstreamHandover struct {
+	File *os.File `json:"-"`
+
+	User      string
+	NetworkID int64
+
+	// Data received from the server but not processed yet
+	Buffered []byte
+
+	ServerName         string
+	AvailableUserModes string
+	ISupport           []string
+	SupportedCaps      map[string]string
+	Caps               []string
+	Nick               string
+	Username           string
+	Realname           string
+	Modes              string
+	Away               bool
+	Account            string
+	Channels           []ChannelHandover
+}
+
+// ChannelHandover contains the state of a joined channel.
+type ChannelHandover struct {
+	Name         string
+	Topic        string
+	TopicWho     string
+	TopicTime    time.Time
+	Status       string
+	Modes        map[string]string
+	CreationTime string
+	Members      map[string]string // nickname to membership prefixes
+}
+
+// bufferedIRCConn is an ircConn which gives access to the data received but
+// not parsed yet. Unlike irc.Conn, it doesn't lose partial lines when a read
+// is interrupted by a deadline.
+type bufferedIRCConn struct {
+	net.Conn
+	pending *bytes.Reader
+	br      *bufio.Reader
+	partial []byte
+}
+
+func newBufferedIRCConn(c net.Conn, buffered []byte) *bufferedIRCConn {
+	pending := bytes.NewReader(buffered)
+	return &bufferedIRCConn{
+		Conn:    c,
+		pending: pending,
+		br:      bufio.NewReader(io.MultiReader(pending, c)),
+	}
+}
+
+func (c *bufferedIRCConn) ReadMessage() (*irc.Message, error) {
+	for {
+		b, err := c.br.ReadSlice('\n')
+		c.partial = append(c.partial, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		line := string(c.partial)
+		c.partial = c.partial[:0]
+
+		msg, err := irc.ParseMessage(line)
+		if err == irc.ErrZeroLengthMessage {
+			continue
+		}
+		return msg, err
+	}
+}
+
+func (c *bufferedIRCConn) WriteMessage(msg *irc.Message) error {
+	_, err := c.Conn.Write([]byte(msg.String() + "\r\n"))
+	return err
+}
+
+// Buffered returns the data received but not parsed yet. It must not be
+// called while a read is in progress.
+func (c *bufferedIRCConn) Buffered() []byte {
+	b := append([]byte(nil), c.partial...)
+	if n := c.br.Buffered(); n > 0 {
+		peeked, _ := c.br.Peek(n)
+		b = append(b, peeked...)
+	}
+	rest, _ := ioutil.ReadAll(c.pending)
+	return append(b, rest...)
+}
+
+func (uc *upstreamConn) isHandingOver() bool {
+	return atomic.LoadInt32(&uc.handingOver) != 0
+}
+
+// checkHandover checks whether the connection can be handed over to another
+// process. TLS connections and connections in the middle of a command can't.
+func (uc *upstreamConn) checkHandover() error {
+	switch uc.netConn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		// ok
+	case *tls.Conn:
+		return fmt.Errorf("TLS connections can't be handed over")
+	default:
+		return fmt.Errorf("unsupported connection type %T", uc.netConn)
+	}
+	if len(uc.batches) > 0 {
+		return fmt.Errorf("a batch is in progress")
+	}
+	for _, l := range uc.pendingCmds {
+		if len(l) > 0 {
+			return fmt.Errorf("a command is in progress")
+		}
+	}
+	return nil
+}
+
+// handover detaches the connection and returns its state. The network
+// goroutine must have stopped reading.
+func (uc *upstreamConn) handover() (*UpstreamHandover, error) {
+	h := &UpstreamHandover{
+		User:               uc.user.Username,
+		NetworkID:          uc.network.ID,
+		ServerName:         uc.serverName,
+		AvailableUserModes: uc.availableUserModes,
+		SupportedCaps:      uc.supportedCaps,
+		Nick:               uc.nick,
+		Username:           uc.username,
+		Realname:           uc.realname,
+		Modes:              string(uc.modes),
+		Away:               uc.away,
+		Account:            uc.account,
+	}
+	for k, v := range uc.isupport {
+		if v != nil {
+			k += "=" + *v
+		}
+		h.ISupport = append(h.ISupport, k)
+	}
+	sort.Strings(h.ISupport)
+	for name, enabled := range uc.caps {
+		if enabled {
+			h.Caps = append(h.Caps, name)
+		}
+	}
+	sort.Strings(h.Caps)
+
+	for _, entry := range uc.channels.innerMap {
+		uch := entry.value.(*upstreamChannel)
+		ch := ChannelHandover{
+			Name:         uch.Name,
+			Topic:        uch.Topic,
+			TopicTime:    uch.TopicTime,
+			Modes:        make(map[string]string, len(uch.modes)),
+			CreationTime: uch.creationTime,
+			Members:      make(map[string]string, uch.Members.Len()),
+		}
+		if uch.TopicWho != nil {
+			ch.TopicWho = uch.TopicWho.String()
+		}
+		if uch.Status != 0 {
+			ch.Status = string(uch.Status)
+		}
+		for mode, value := range uch.modes {
+			ch.Modes[string(mode)] = value
+		}
+		for _, entry := range uch.Members.innerMap {
+			var prefixes []byte
+			for _, m := range *entry.value.(*memberships) {
+				prefixes = append(prefixes, m.Prefix)
+			}
+			ch.Members[entry.originalKey] = string(prefixes)
+		}
+		h.Channels = append(h.Channels, ch)
+	}
+
+	if err := uc.conn.Detach(); err != nil {
+		return nil, err
+	}
+	h.Buffered = uc.ircConn.Buffered()
+
+	fc, ok := uc.netConn.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		uc.netConn.Close()
+		return nil, fmt.Errorf("connection of type %T can't be handed over", uc.netConn)
+	}
+	f, err := fc.File()
+	uc.netConn.Close()
+	if err != nil {
+		return nil, err
+	}
+	h.File = f
+	return h, nil
+}
+
+// restore applies the state of a connection handed over by another process.
+func (uc *upstreamConn) restore(h *UpstreamHandover) error {
+	uc.serverName = h.ServerName
+	uc.availableUserModes = h.AvailableUserModes
+	uc.nick = h.Nick
+	uc.username = h.Username
+	uc.realname = h.Realname
+	uc.modes = userModes(h.Modes)
+	uc.away = h.Away
+	uc.account = h.Account
+	for k, v := range h.SupportedCaps {
+		uc.supportedCaps[k] = v
+	}
+	for _, name := range h.Caps {
+		uc.caps[name] = true
+	}
+
+	if _, err := uc.handleIsupport(h.ISupport); err != nil {
+		return err
+	}
+	if !uc.casemapIsSet {
+		uc.casemapIsSet = true
+		uc.network.updateCasemapping(casemapRFC1459)
+	}
+	uc.nickCM = uc.network.casemap(uc.nick)
+	uc.channels.SetCasemapping(uc.network.casemap)
+
+	prefixes := make(map[byte]membership, len(uc.availableMemberships))
+	for _, m := range uc.availableMemberships {
+		prefixes[m.Prefix] = m
+	}
+
+	for _, ch := range h.Channels {
+		uch := &upstreamChannel{
+			Name:         ch.Name,
+			conn:         uc,
+			Topic:        ch.Topic,
+			TopicTime:    ch.TopicTime,
+			modes:        make(channelModes, len(ch.Modes)),
+			creationTime: ch.CreationTime,
+			Members:      membershipsCasemapMap{newCasemapMap(len(ch.Members))},
+			complete:     true,
+		}
+		uch.Members.casemap = uc.network.casemap
+		if ch.TopicWho != "" {
+			uch.TopicWho = irc.ParsePrefix(ch.TopicWho)
+		}
+		if ch.Status != "" {
+			status, err := parseChannelStatus(ch.Status)
+			if err != nil {
+				return err
+			}
+			uch.Status = status
+		}
+		for mode, value := range ch.Modes {
+			if len(mode) != 1 {
+				return fmt.Errorf("invalid mode %q for channel %q", mode, ch.Name)
+			}
+			uch.modes[mode[0]] = value
+		}
+		for nick, s := range ch.Members {
+			var ms memberships
+			for i := 0; i < len(s); i++ {
+				m, ok := prefixes[s[i]]
+				if !ok {
+					return fmt.Errorf("unknown membership prefix %q for channel %q", s[i], ch.Name)
+				}
+				ms.Add(uc.availableMemberships, m)
+			}
+			uch.Members.SetValue(nick, &ms)
+		}
+
+		uc.channels.SetValue(ch.Name, uch)
+		uc.updateChannelAutoDetach(ch.Name)
+	}
+
+	uc.registered = true
+	uc.gotMotd = true
+	return nil
+}
+
+// adoptUpstream creates an upstream connection from one handed over by
+// another process.
+func adoptUpstream(network *network, h *UpstreamHandover) (*upstreamConn, error) {
+	netConn, err := net.FileConn(h.File)
+	h.File.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := newUpstreamLogger(network)
+	logger.Printf("adopting connection to %v", netConn.RemoteAddr())
+
+	uc := newUpstreamConn(network, netConn, h.Buffered, logger)
+	if err := uc.restore(h); err != nil {
+		uc.Close()
+		return nil, err
+	}
+	return uc, nil
+}
+
+func (u *user) startHandover(done chan<- []*UpstreamHandover) {
+	u.handoverDone = done
+	for _, net := range u.networks {
+		uc := net.conn
+		if uc == nil {
+			continue
+		}
+		if err := uc.checkHandover(); err != nil {
+			uc.logger.Printf("connection will be closed and opened again by the new process: %v", err)
+			continue
+		}
+		// Interrupt the network goroutine, it'll send eventUpstreamHandover
+		atomic.StoreInt32(&uc.handingOver, 1)
+		uc.netConn.SetReadDeadline(time.Now())
+		u.handoverPending++
+	}
+	if u.handoverPending == 0 {
+		done <- nil
+	}
+}
+
+func (u *user) handleUpstreamHandover(uc *upstreamConn) {
+	uc.network.conn = nil
+	for _, entry := range uc.channels.innerMap {
+		uch := entry.value.(*upstreamChannel)
+		uch.updateAutoDetach(0)
+	}
+
+	h, err := uc.handover()
+	if err != nil {
+		uc.logger.Errorf("failed to hand over connection: %v", err)
+	} else {
+		uc.logger.Printf("handing over connection")
+		u.handovers = append(u.handovers, h)
+	}
+
+	u.handoverPending--
+	if u.handoverPending == 0 {
+		u.handoverDone <- u.handovers
+		u.handovers = nil
+	}
+}
+
+// HandoverUpstreams detaches the upstream connections which can be handed over
+// to another process. The returned connections are no longer used by the
+// server. Other upstream connections are left untouched.
+func (s *Server) HandoverUpstreams(timeout time.Duration) []*UpstreamHandover {
+	s.lock.Lock()
+	var dones []chan []*UpstreamHandover
+	for _, u := range s.users {
+		done := make(chan []*UpstreamHandover, 1)
+		u.events <- eventHandover{done}
+		dones = append(dones, done)
+	}
+	s.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var l []*UpstreamHandover
+	for _, done := range dones {
+		select {
+		case handovers := <-done:
+			l = append(l, handovers...)
+		case <-timer.C:
+			s.Logger.Errorf("timed out waiting for upstream connections to be handed over")
+			return l
+		}
+	}
+	return l
+}
+
+// AdoptUpstreams registers upstream connections handed over by another
+// process. It must be called before Start.
+func (s *Server) AdoptUpstreams(l []*UpstreamHandover) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.handovers == nil {
+		s.handovers = make(map[string]map[int64]*UpstreamHandover)
+	}
+	for _, h := range l {
+		m := s.handovers[h.User]
+		if m == nil {
+			m = make(map[int64]*UpstreamHandover)
+			s.handovers[h.User] = m
+		}
+		if prev := m[h.NetworkID]; prev != nil {
+			prev.File.Close()
+		}
+		m[h.NetworkID] = h
+	}
+}
+
+func (s *Server) takeHandover(username string, networkID int64) *UpstreamHandover {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h := s.handovers[username][networkID]
+	if h != nil {
+		delete(s.handovers[username], networkID)
+	}
+	return h
+}
+
+// discardHandovers closes the connections handed over for a user which don't
+// belong to any of the user's networks.
+func (s *Server) discardHandovers(u *user) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, h := range s.handovers[u.Username] {
+		if u.getNetworkByID(id) != nil {
+			continue
+		}
+		u.logger.Printf("discarding upstream connection handed over for unknown network %v", id)
+		h.File.Close()
+		delete(s.handovers[u.Username], id)
+	}
+}
+
+// discardHandoversLocked closes the connections handed over for users which
+// aren't running.
+func (s *Server) discardHandoversLocked() {
+	for username, m := range s.handovers {
+		if _, ok := s.users[username]; ok {
+			continue
+		}
+		s.Logger.Printf("discarding upstream connections handed over for inactive user %q", username)
+		for _, h := range m {
+			h.File.Close()
+		}
+		delete(s.handovers, username)
+	}
+}
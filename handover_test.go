@@ -0,0 +1,110 @@
+package soju
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+func expectMessageSkip(t *testing.T, c ircConn, cmd string) *irc.Message {
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message (want %q): %v", cmd, err)
+		}
+		if msg.Command == cmd {
+			return msg
+		}
+	}
+}
+
+func TestServerHandover(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	self := &irc.Prefix{Name: testUsername, User: testUsername, Host: "localhost"}
+	uc.WriteMessage(&irc.Message{Prefix: self, Command: "JOIN", Params: []string{"#soju"}})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_NAMREPLY,
+		Params:  []string{testUsername, "=", "#soju", "@" + testUsername + " alice"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_ENDOFNAMES,
+		Params:  []string{testUsername, "#soju", "End of /NAMES list"},
+	})
+	expectMessageSkip(t, dc, irc.RPL_ENDOFNAMES)
+
+	// Partial lines must not be lost
+	upstreamConn := uc.(interface{ Write([]byte) (int, error) })
+	if _, err := upstreamConn.Write([]byte("PING :hand")); err != nil {
+		t.Fatalf("failed to write partial line: %v", err)
+	}
+
+	handovers := srv.HandoverUpstreams(5 * time.Second)
+	if len(handovers) != 1 {
+		t.Fatalf("got %v handed over connections, want 1", len(handovers))
+	}
+	h := handovers[0]
+	if h.NetworkID != network.ID || h.Nick != testUsername || len(h.Channels) != 1 {
+		t.Fatalf("unexpected handed over state: %+v", h)
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("failed to marshal handover: %v", err)
+	}
+	var adopted UpstreamHandover
+	if err := json.Unmarshal(b, &adopted); err != nil {
+		t.Fatalf("failed to unmarshal handover: %v", err)
+	}
+	adopted.File = h.File
+
+	if _, err := upstreamConn.Write([]byte("over\r\n")); err != nil {
+		t.Fatalf("failed to write partial line: %v", err)
+	}
+
+	srv2 := NewServer(db)
+	srv2.AdoptUpstreams([]*UpstreamHandover{&adopted})
+	if err := srv2.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv2.Shutdown()
+
+	msg := expectMessageSkip(t, uc, "PONG")
+	if msg.Params[len(msg.Params)-1] != "handover" {
+		t.Errorf("unexpected PONG: %v", msg)
+	}
+
+	dc2 := createTestDownstream(t, srv2)
+	defer dc2.Close()
+	registerDownstreamConn(t, dc2, network)
+
+	msg = expectMessageSkip(t, dc2, "JOIN")
+	if msg.Params[0] != "#soju" {
+		t.Errorf("unexpected JOIN: %v", msg)
+	}
+	msg = expectMessageSkip(t, dc2, irc.RPL_NAMREPLY)
+	if names := msg.Params[len(msg.Params)-1]; names != "@"+testUsername+" alice" && names != "alice @"+testUsername {
+		t.Errorf("unexpected names: %q", names)
+	}
+}
@@ -0,0 +1,116 @@
+package soju
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// webClientConfigPath is the path of the generated web client configuration,
+// in the format expected by gamja.
+const webClientConfigPath = "/config.json"
+
+func isWebSocketRequest(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// serveStatic serves the files in HTTPRoot. If the directory doesn't contain
+// a web client configuration file, one is generated.
+func (s *Server) serveStatic(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if req.URL.Path == webClientConfigPath {
+		_, err := os.Stat(filepath.Join(s.Config().HTTPRoot, filepath.FromSlash(webClientConfigPath)))
+		if os.IsNotExist(err) {
+			s.serveWebClientConfig(w, req)
+			return
+		}
+	}
+
+	http.FileServer(staticDir{http.Dir(s.Config().HTTPRoot)}).ServeHTTP(w, req)
+}
+
+// staticDir is a http.FileSystem which hides dotfiles (e.g. a .git
+// directory) and directories without an index.html file, so that their
+// contents aren't listed.
+type staticDir struct {
+	http.Dir
+}
+
+func (dir staticDir) Open(name string) (http.File, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+
+	f, err := dir.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		index, err := dir.Dir.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+type webClientConfig struct {
+	Server webClientServerConfig `json:"server"`
+}
+
+type webClientServerConfig struct {
+	URL  string `json:"url"`
+	Auth string `json:"auth"`
+}
+
+// serveWebClientConfig generates a web client configuration pointing to the
+// WebSocket endpoint on the same origin as the request.
+func (s *Server) serveWebClientConfig(w http.ResponseWriter, req *http.Request) {
+	scheme := "ws"
+	if req.TLS != nil {
+		scheme = "wss"
+	}
+	host := req.Host
+	if s.isProxy(req) {
+		forwarded := parseForwarded(req.Header)
+		switch forwarded["proto"] {
+		case "https":
+			scheme = "wss"
+		case "http":
+			scheme = "ws"
+		}
+		if forwarded["host"] != "" {
+			host = forwarded["host"]
+		}
+	}
+
+	cfg := webClientConfig{
+		Server: webClientServerConfig{
+			URL:  scheme + "://" + host + "/socket",
+			Auth: "mandatory",
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(&cfg); err != nil {
+		s.Logger.Errorf("failed to write web client configuration: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package soju
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeStatic(t *testing.T) {
+	root, err := ioutil.TempDir("", "soju-http-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "index.html"), []byte("gamja"), 0644); err != nil {
+		t.Fatalf("failed to write index.html: %v", err)
+	}
+
+	srv := NewServer(nil)
+	cfg := DefaultConfig()
+	cfg.HTTPRoot = root
+	srv.SetConfig(cfg)
+
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.org/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "gamja" {
+		t.Errorf("unexpected response for index: %v %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	srv.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.org/config.json", nil))
+	var clientCfg webClientConfig
+	if err := json.NewDecoder(rr.Body).Decode(&clientCfg); err != nil {
+		t.Fatalf("failed to decode web client configuration: %v", err)
+	}
+	if want := "ws://example.org/socket"; clientCfg.Server.URL != want {
+		t.Errorf("server URL = %q, want %q", clientCfg.Server.URL, want)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "assets"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, ".htpasswd"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("failed to write dotfile: %v", err)
+	}
+	for _, p := range []string{"/assets/", "/.htpasswd", "/assets/../.htpasswd"} {
+		rr = httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.org"+p, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status for %v: %v", p, rr.Code)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	srv.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "http://example.org/", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for POST request: %v", rr.Code)
+	}
+}
@@ -2,8 +2,14 @@ package soju
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,12 +18,42 @@ import (
 
 var identdTimeout = 10 * time.Second
 
+const maxIdentLen = 64
+
+// checkIdent checks that an ident can be sent in RFC 1413 replies and in
+// oidentd configuration files.
+func checkIdent(ident string) error {
+	if ident == "" || len(ident) > maxIdentLen {
+		return fmt.Errorf("ident must be between 1 and %v characters long", maxIdentLen)
+	}
+	for _, ch := range ident {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-' || ch == '_' || ch == '.':
+		default:
+			return fmt.Errorf("ident contains invalid character %q", ch)
+		}
+	}
+	// Don't allow impersonating the default ident of another user
+	if len(ident) == 32 {
+		if _, err := hex.DecodeString(ident); err == nil {
+			return fmt.Errorf("ident must not look like a default ident")
+		}
+	}
+	return nil
+}
+
 type identKey struct {
 	remoteHost string
 	remotePort int
 	localPort  int
 }
 
+type identEntry struct {
+	localHost string
+	ident     string
+}
+
 func newIdentKey(remoteAddr, localAddr string) (*identKey, error) {
 	remoteHost, remotePort, err := splitHostPort(remoteAddr)
 	if err != nil {
@@ -28,12 +64,35 @@ func newIdentKey(remoteAddr, localAddr string) (*identKey, error) {
 		return nil, err
 	}
 	return &identKey{
-		remoteHost: remoteHost,
+		remoteHost: normalizeIdentHost(remoteHost),
 		remotePort: remotePort,
 		localPort:  localPort,
 	}, nil
 }
 
+// normalizeIdentHost returns the canonical form of an IP address, so that the
+// address of an upstream connection matches the address of the ident queries
+// coming from the same server. IPv4-mapped IPv6 addresses are converted to
+// IPv4, zones are preserved since link-local addresses are only unique
+// within a zone.
+func normalizeIdentHost(host string) string {
+	var zone string
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	if zone != "" {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
+}
+
 func splitHostPort(addr string) (host string, port int, err error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -44,33 +103,122 @@ func splitHostPort(addr string) (host string, port int, err error) {
 }
 
 // Identd implements an ident server, as described in RFC 1413.
+//
+// Alternatively, the idents can be written to an oidentd user configuration
+// file, for hosts where another ident server owns the ident port.
 type Identd struct {
-	entries map[identKey]string
-	lock    sync.RWMutex
+	entries     map[identKey]identEntry
+	oidentdPath string
+	lock        sync.RWMutex
 }
 
 func NewIdentd() *Identd {
-	return &Identd{entries: make(map[identKey]string)}
+	return &Identd{entries: make(map[identKey]identEntry)}
+}
+
+// SetOidentdPath sets the path of the oidentd user configuration file to
+// keep up to date, see oidentd.conf(5). An empty path disables the file.
+func (s *Identd) SetOidentdPath(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev := s.oidentdPath
+	s.oidentdPath = path
+	if prev != "" && prev != path {
+		// Don't leave stale entries behind in the previous file
+		if err := os.Truncate(prev, 0); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear oidentd configuration: %v", err)
+		}
+	}
+	return s.writeOidentd()
 }
 
-func (s *Identd) Store(remoteAddr, localAddr, ident string) {
+// Store records the ident of a connection. Connections which aren't over TCP
+// can't be queried via ident and are ignored.
+func (s *Identd) Store(remoteAddr, localAddr, ident string) error {
 	k, err := newIdentKey(remoteAddr, localAddr)
 	if err != nil {
-		return
+		return nil
 	}
+	localHost, _, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return nil
+	}
+
 	s.lock.Lock()
-	s.entries[*k] = ident
-	s.lock.Unlock()
+	defer s.lock.Unlock()
+
+	s.entries[*k] = identEntry{
+		localHost: normalizeIdentHost(localHost),
+		ident:     ident,
+	}
+	return s.writeOidentd()
 }
 
-func (s *Identd) Delete(remoteAddr, localAddr string) {
+func (s *Identd) Delete(remoteAddr, localAddr string) error {
 	k, err := newIdentKey(remoteAddr, localAddr)
 	if err != nil {
-		return
+		return nil
 	}
+
 	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	delete(s.entries, *k)
-	s.lock.Unlock()
+	return s.writeOidentd()
+}
+
+// writeOidentd replaces the oidentd configuration file, if enabled. The
+// file is replaced atomically, since oidentd reads it on each query. It must
+// be called with the lock held.
+func (s *Identd) writeOidentd() error {
+	if s.oidentdPath == "" {
+		return nil
+	}
+
+	keys := make([]identKey, 0, len(s.entries))
+	for k := range s.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].remoteHost != keys[j].remoteHost {
+			return keys[i].remoteHost < keys[j].remoteHost
+		}
+		if keys[i].remotePort != keys[j].remotePort {
+			return keys[i].remotePort < keys[j].remotePort
+		}
+		return keys[i].localPort < keys[j].localPort
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("# This file is generated by soju, do not edit\n")
+	for _, k := range keys {
+		e := s.entries[k]
+		fmt.Fprintf(&buf, "to %v fport %v from %v lport %v {\n\treply %q\n}\n",
+			k.remoteHost, k.remotePort, e.localHost, k.localPort, e.ident)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.oidentdPath), ".soju-oidentd-")
+	if err != nil {
+		return fmt.Errorf("failed to write oidentd configuration: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write oidentd configuration: %v", err)
+	}
+	// oidentd runs as another user and needs to read the file
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write oidentd configuration: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write oidentd configuration: %v", err)
+	}
+	if err := os.Rename(f.Name(), s.oidentdPath); err != nil {
+		return fmt.Errorf("failed to write oidentd configuration: %v", err)
+	}
+	return nil
 }
 
 func (s *Identd) Serve(ln net.Listener) error {
@@ -112,13 +260,13 @@ func (s *Identd) handle(c net.Conn) {
 		}
 
 		k := identKey{
-			remoteHost: remoteHost,
+			remoteHost: normalizeIdentHost(remoteHost),
 			remotePort: remotePort,
 			localPort:  localPort,
 		}
 
 		s.lock.RLock()
-		ident := s.entries[k]
+		ident := s.entries[k].ident
 		s.lock.RUnlock()
 
 		if ident == "" {
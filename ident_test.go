@@ -0,0 +1,101 @@
+package soju
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewIdentKey(t *testing.T) {
+	testCases := []struct {
+		remoteAddr, localAddr string
+		want                  identKey
+	}{
+		{"192.0.2.1:6667", "192.0.2.2:45678", identKey{"192.0.2.1", 6667, 45678}},
+		{"[::ffff:192.0.2.1]:6667", "[::ffff:192.0.2.2]:45678", identKey{"192.0.2.1", 6667, 45678}},
+		{"[2001:DB8::1]:6697", "[2001:db8::2]:45678", identKey{"2001:db8::1", 6697, 45678}},
+		{"[fe80::1%eth0]:6667", "[fe80::2%eth0]:45678", identKey{"fe80::1%eth0", 6667, 45678}},
+	}
+	for _, tc := range testCases {
+		k, err := newIdentKey(tc.remoteAddr, tc.localAddr)
+		if err != nil {
+			t.Errorf("newIdentKey(%q, %q) = %v", tc.remoteAddr, tc.localAddr, err)
+			continue
+		}
+		if *k != tc.want {
+			t.Errorf("newIdentKey(%q, %q) = %+v, want %+v", tc.remoteAddr, tc.localAddr, *k, tc.want)
+		}
+	}
+}
+
+func TestIdentdOidentd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soju-ident-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oidentd.conf")
+
+	identd := NewIdentd()
+	if err := identd.SetOidentdPath(path); err != nil {
+		t.Fatalf("SetOidentdPath() = %v", err)
+	}
+	if err := identd.Store("[::ffff:192.0.2.1]:6667", "192.0.2.2:45678", "alice"); err != nil {
+		t.Fatalf("Store() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read oidentd configuration: %v", err)
+	}
+	want := "to 192.0.2.1 fport 6667 from 192.0.2.2 lport 45678 {\n\treply \"alice\"\n}\n"
+	if !strings.HasSuffix(string(b), want) {
+		t.Errorf("unexpected oidentd configuration: %q", string(b))
+	}
+
+	if err := identd.Delete("192.0.2.1:6667", "192.0.2.2:45678"); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	b, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read oidentd configuration: %v", err)
+	}
+	if strings.Contains(string(b), "reply") {
+		t.Errorf("oidentd configuration still contains an entry: %q", string(b))
+	}
+
+	if err := identd.Store("192.0.2.1:6667", "192.0.2.2:45678", "alice"); err != nil {
+		t.Fatalf("Store() = %v", err)
+	}
+	if err := identd.SetOidentdPath(""); err != nil {
+		t.Fatalf("SetOidentdPath() = %v", err)
+	}
+	b, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read oidentd configuration: %v", err)
+	}
+	if len(b) != 0 {
+		t.Errorf("oidentd configuration not cleared when disabled: %q", string(b))
+	}
+}
+
+func TestCheckIdent(t *testing.T) {
+	generated := userIdent(&User{ID: 42})
+	for ident, valid := range map[string]bool{
+		"alice":                    true,
+		"a.l-i_c3":                 true,
+		"":                         false,
+		strings.Repeat("a", 65):    false,
+		"al ice":                   false,
+		"alice\n":                  false,
+		generated:                  false,
+		strings.ToUpper(generated): false,
+		strings.Repeat("z", 32):    true,
+	} {
+		if err := checkIdent(ident); (err == nil) != valid {
+			t.Errorf("checkIdent(%q) = %v, want valid = %v", ident, err, valid)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package soju
 
 import (
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -668,6 +669,85 @@ func isHighlight(text, nick string) bool {
 	}
 }
 
+// highlightPattern is a custom highlight pattern. It's either a word, matched
+// case-insensitively at word boundaries, or a regular expression written as
+// "/regexp/".
+type highlightPattern struct {
+	word string
+	re   *regexp.Regexp
+}
+
+func parseHighlightPattern(s string) (*highlightPattern, error) {
+	if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid highlight regexp %q: %v", s, err)
+		}
+		return &highlightPattern{re: re}, nil
+	}
+	if s == "" || strings.ContainsAny(s, " \r\n") {
+		return nil, fmt.Errorf("invalid highlight word %q", s)
+	}
+	return &highlightPattern{word: strings.ToLower(s)}, nil
+}
+
+func (p *highlightPattern) match(text string) bool {
+	if p.re != nil {
+		return p.re.MatchString(text)
+	}
+	return isHighlight(strings.ToLower(text), p.word)
+}
+
+// matchMask checks whether a string matches a mask containing "*" and "?"
+// wildcards. The caller is responsible for case-mapping.
+func matchMask(mask, s string) bool {
+	// Iterative matching: on mismatch, backtrack to the last "*" and let it
+	// consume one more character. Earlier "*" never need to be revisited,
+	// which keeps this linear in len(mask) * len(s).
+	m, i := 0, 0
+	star, starI := -1, 0 // position after the last "*", and where it stopped in s
+	for i < len(s) {
+		switch {
+		case m < len(mask) && mask[m] == '*':
+			m++
+			star, starI = m, i
+		case m < len(mask) && mask[m] == '?':
+			_, size := utf8.DecodeRuneInString(s[i:])
+			m, i = m+1, i+size
+		case m < len(mask) && mask[m] == s[i]:
+			m, i = m+1, i+1
+		case star >= 0:
+			_, size := utf8.DecodeRuneInString(s[starI:])
+			starI += size
+			m, i = star, starI
+		default:
+			return false
+		}
+	}
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+	return m == len(mask)
+}
+
+// parseIgnoreMask normalizes an ignore mask to the nick!user@host form.
+func parseIgnoreMask(s string) (string, error) {
+	if s == "" || strings.ContainsAny(s, " \r\n") {
+		return "", fmt.Errorf("invalid mask %q", s)
+	}
+	hasUser := strings.Contains(s, "!")
+	hasHost := strings.Contains(s, "@")
+	switch {
+	case !hasUser && !hasHost:
+		s += "!*@*"
+	case !hasUser:
+		s = "*!" + s
+	case !hasHost:
+		s += "@*"
+	}
+	return s, nil
+}
+
 // parseChatHistoryBound parses the given CHATHISTORY parameter as a bound.
 // The zero time is returned on error.
 func parseChatHistoryBound(param string) time.Time {
@@ -0,0 +1,51 @@
+package soju
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchMask(t *testing.T) {
+	testCases := []struct {
+		mask, s string
+		want    bool
+	}{
+		{"*!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick2!user@host", false},
+		{"*!*@*.example.org", "nick!user@irc.example.org", true},
+		{"*!*@*.example.org", "nick!user@example.org", false},
+		{"n?ck!user@host", "nick!user@host", true},
+		{"n?ck!user@host", "nck!user@host", false},
+		{"*a*b", "aaab", true},
+		{"*?!*@*", "\u00e9!user@host", true},
+		{"*!*@*.org*", "nick!user@example.org", true},
+		{strings.Repeat("*a", 32) + "*b", strings.Repeat("a", 64), false},
+	}
+	for _, tc := range testCases {
+		if got := matchMask(tc.mask, tc.s); got != tc.want {
+			t.Errorf("matchMask(%q, %q) = %v, want %v", tc.mask, tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestHighlightPattern(t *testing.T) {
+	testCases := []struct {
+		pattern, text string
+		want          bool
+	}{
+		{"soju", "have you tried Soju?", true},
+		{"soju", "sojuctl is broken", false},
+		{"/soju(ctl)?/", "sojuctl is broken", true},
+		{"/^!deploy/", "please !deploy", false},
+	}
+	for _, tc := range testCases {
+		p, err := parseHighlightPattern(tc.pattern)
+		if err != nil {
+			t.Fatalf("parseHighlightPattern(%q) = %v", tc.pattern, err)
+		}
+		if got := p.match(tc.text); got != tc.want {
+			t.Errorf("pattern %q matching %q = %v, want %v", tc.pattern, tc.text, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package soju
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogError:
+		return "error"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(level))
+	}
+}
+
+// ParseLogLevel parses a log level name: "debug", "info" or "error".
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch s {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	case "error":
+		return LogError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// LogFormat is the encoding of log messages.
+type LogFormat int
+
+const (
+	// LogText writes one human-readable line per message, with the fields
+	// appended as key=value pairs.
+	LogText LogFormat = iota
+	// LogJSON writes one JSON object per line.
+	LogJSON
+)
+
+// ParseLogFormat parses a log format name: "text" or "json".
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch s {
+	case "text":
+		return LogText, nil
+	case "json":
+		return LogJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown log format %q", s)
+	}
+}
+
+// Logger writes leveled log messages. Messages are annotated with the fields
+// added via With.
+type Logger interface {
+	// Print and Printf log a message with the info level.
+	Print(v ...interface{})
+	Printf(format string, v ...interface{})
+	Debugf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+	// Log writes a message regardless of its level.
+	Log(level LogLevel, msg string)
+	// With returns a logger which annotates messages with an additional
+	// field.
+	With(key string, value interface{}) Logger
+}
+
+// LogWriter encodes log messages and writes them to an io.Writer. It is safe
+// to use from multiple goroutines.
+type LogWriter struct {
+	lock   sync.Mutex
+	w      io.Writer
+	level  LogLevel
+	format LogFormat
+}
+
+// NewLogWriter creates a LogWriter writing info messages and above in the
+// text format.
+func NewLogWriter(w io.Writer) *LogWriter {
+	return &LogWriter{w: w, level: LogInfo}
+}
+
+// SetLevel sets the minimum level of the messages written.
+func (lw *LogWriter) SetLevel(level LogLevel) {
+	lw.lock.Lock()
+	lw.level = level
+	lw.lock.Unlock()
+}
+
+// SetFormat sets the encoding of the messages written.
+func (lw *LogWriter) SetFormat(format LogFormat) {
+	lw.lock.Lock()
+	lw.format = format
+	lw.lock.Unlock()
+}
+
+// Logger returns a logger without any field writing to lw.
+func (lw *LogWriter) Logger() Logger {
+	return &fieldLogger{writer: lw}
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+func (lw *LogWriter) write(level LogLevel, force bool, msg string, fields []logField) {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+
+	if !force && level < lw.level {
+		return
+	}
+
+	now := time.Now()
+	var buf bytes.Buffer
+	switch lw.format {
+	case LogJSON:
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for _, f := range fields {
+			buf.WriteByte(',')
+			writeJSON(&buf, f.key)
+			buf.WriteByte(':')
+			writeJSON(&buf, f.value)
+		}
+		buf.WriteString("}\n")
+	default:
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(level.String())
+		buf.WriteString(": ")
+		buf.WriteString(msg)
+		for _, f := range fields {
+			buf.WriteByte(' ')
+			buf.WriteString(f.key)
+			buf.WriteByte('=')
+			buf.WriteString(formatLogValue(f.value))
+		}
+		buf.WriteByte('\n')
+	}
+
+	lw.w.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func formatLogValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+type fieldLogger struct {
+	writer *LogWriter
+	fields []logField
+}
+
+var _ Logger = (*fieldLogger)(nil)
+
+func (l *fieldLogger) Print(v ...interface{}) {
+	l.writer.write(LogInfo, false, fmt.Sprint(v...), l.fields)
+}
+
+func (l *fieldLogger) Printf(format string, v ...interface{}) {
+	l.writer.write(LogInfo, false, fmt.Sprintf(format, v...), l.fields)
+}
+
+func (l *fieldLogger) Debugf(format string, v ...interface{}) {
+	l.writer.write(LogDebug, false, fmt.Sprintf(format, v...), l.fields)
+}
+
+func (l *fieldLogger) Errorf(format string, v ...interface{}) {
+	l.writer.write(LogError, false, fmt.Sprintf(format, v...), l.fields)
+}
+
+func (l *fieldLogger) Log(level LogLevel, msg string) {
+	l.writer.write(level, true, msg, l.fields)
+}
+
+func (l *fieldLogger) With(key string, value interface{}) Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &fieldLogger{
+		writer: l.writer,
+		fields: append(fields, logField{key, value}),
+	}
+}
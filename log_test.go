@@ -0,0 +1,32 @@
+package soju
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	lw := NewLogWriter(&buf)
+	logger := lw.Logger().With("user", "alice").With("network", "Libera Chat")
+
+	logger.Debugf("dropped")
+	logger.Printf("connection %v", "closed")
+	line := buf.String()
+	if !strings.HasSuffix(line, ` info: connection closed user=alice network="Libera Chat"`+"\n") {
+		t.Errorf("unexpected text output: %q", line)
+	}
+
+	buf.Reset()
+	lw.SetFormat(LogJSON)
+	logger.Log(LogDebug, "sent: PING")
+	var entry map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode JSON output %q: %v", buf.String(), err)
+	}
+	if entry["level"] != "debug" || entry["msg"] != "sent: PING" || entry["user"] != "alice" || entry["network"] != "Libera Chat" {
+		t.Errorf("unexpected JSON output: %v", entry)
+	}
+}
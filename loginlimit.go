@@ -0,0 +1,209 @@
+package soju
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter keeps track of failed login attempts, and temporarily locks out
+// the usernames and IP addresses with too many failures.
+type loginLimiter struct {
+	lock  sync.Mutex
+	users map[string]*loginFailures
+	ips   map[string]*loginFailures
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		users: make(map[string]*loginFailures),
+		ips:   make(map[string]*loginFailures),
+	}
+}
+
+func isLockedOut(m map[string]*loginFailures, key string, now time.Time) bool {
+	f, ok := m[key]
+	return ok && f.lockedUntil.After(now)
+}
+
+// IsLockedOut checks whether login attempts for a username or from an IP
+// address are currently refused. ip may be empty.
+func (ll *loginLimiter) IsLockedOut(username, ip string) bool {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	now := time.Now()
+	return isLockedOut(ll.users, username, now) || (ip != "" && isLockedOut(ll.ips, ip, now))
+}
+
+// recordFailure increments the failure counter for a key. It returns true if
+// the key has just been locked out.
+func recordFailure(m map[string]*loginFailures, key string, max int, lockout time.Duration, now time.Time) bool {
+	// Forget about old failures
+	for k, f := range m {
+		if now.Sub(f.last) > lockout && !f.lockedUntil.After(now) {
+			delete(m, k)
+		}
+	}
+
+	f, ok := m[key]
+	if !ok {
+		f = new(loginFailures)
+		m[key] = f
+	}
+
+	f.count++
+	f.last = now
+	if f.count < max {
+		return false
+	}
+
+	f.count = 0
+	f.lockedUntil = now.Add(lockout)
+	return true
+}
+
+// RecordFailure records a failed login attempt. It returns whether the
+// username and the IP address have just been locked out.
+func (ll *loginLimiter) RecordFailure(username, ip string, max int, lockout time.Duration) (userLocked, ipLocked bool) {
+	if max <= 0 {
+		return false, false
+	}
+
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	now := time.Now()
+	userLocked = recordFailure(ll.users, username, max, lockout, now)
+	if ip != "" {
+		ipLocked = recordFailure(ll.ips, ip, max, lockout, now)
+	}
+	return userLocked, ipLocked
+}
+
+// RecordSuccess resets the failure counters after a successful login.
+func (ll *loginLimiter) RecordSuccess(username, ip string) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	delete(ll.users, username)
+	if ip != "" {
+		delete(ll.ips, ip)
+	}
+}
+
+type loginLockout struct {
+	Username, IP string // only one of these is set
+	Until        time.Time
+}
+
+// Lockouts returns the list of active lockouts.
+func (ll *loginLimiter) Lockouts() []loginLockout {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	now := time.Now()
+	var l []loginLockout
+	for username, f := range ll.users {
+		if f.lockedUntil.After(now) {
+			l = append(l, loginLockout{Username: username, Until: f.lockedUntil})
+		}
+	}
+	for ip, f := range ll.ips {
+		if f.lockedUntil.After(now) {
+			l = append(l, loginLockout{IP: ip, Until: f.lockedUntil})
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Until.Before(l[j].Until)
+	})
+	return l
+}
+
+// connLimiter counts the unregistered and registered connections per IP
+// address.
+type connLimiter struct {
+	lock         sync.Mutex
+	unregistered map[string]int
+	registered   map[string]int
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		unregistered: make(map[string]int),
+		registered:   make(map[string]int),
+	}
+}
+
+// Acquire increments the connection count for an IP address, unless the
+// count would exceed max. A negative max means no limit. Connections without
+// an IP address are never limited.
+func (cl *connLimiter) Acquire(ip string, registered bool, max int) bool {
+	if ip == "" {
+		return true
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	m := cl.unregistered
+	if registered {
+		m = cl.registered
+	}
+	if max >= 0 && m[ip] >= max {
+		return false
+	}
+	m[ip]++
+	return true
+}
+
+func (cl *connLimiter) Release(ip string, registered bool) {
+	if ip == "" {
+		return
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	m := cl.unregistered
+	if registered {
+		m = cl.registered
+	}
+	m[ip]--
+	if m[ip] <= 0 {
+		delete(m, ip)
+	}
+}
+
+// clientIP returns the IP address used to enforce per-IP limits for a remote
+// address. It returns an empty string if the address doesn't identify a
+// single client: Unix sockets, and trusted proxies which didn't forward the
+// client address (all clients would share the proxy address).
+func (s *Server) clientIP(addr net.Addr) string {
+	ip := remoteIP(addr)
+	if ip != "" && s.Config().AcceptProxyIPs.Contains(net.ParseIP(ip)) {
+		return ""
+	}
+	return ip
+}
+
+// remoteIP returns the IP address of a remote address, or an empty string if
+// the address isn't an IP address (e.g. for Unix sockets).
+func remoteIP(addr net.Addr) string {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
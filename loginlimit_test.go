@@ -0,0 +1,44 @@
+package soju
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	ll := newLoginLimiter()
+
+	for i := 0; i < 2; i++ {
+		if userLocked, ipLocked := ll.RecordFailure("jim", "192.0.2.1", 3, time.Minute); userLocked || ipLocked {
+			t.Fatalf("locked out after %v failures, want 3", i+1)
+		}
+	}
+	if ll.IsLockedOut("jim", "192.0.2.1") {
+		t.Errorf("IsLockedOut() = true before reaching the limit")
+	}
+
+	ll.RecordSuccess("jim", "192.0.2.1")
+	for i := 0; i < 2; i++ {
+		ll.RecordFailure("jim", "192.0.2.1", 3, time.Minute)
+	}
+	if ll.IsLockedOut("jim", "192.0.2.1") {
+		t.Errorf("IsLockedOut() = true, but failures should have been reset after a success")
+	}
+
+	userLocked, ipLocked := ll.RecordFailure("jim", "192.0.2.1", 3, time.Minute)
+	if !userLocked || !ipLocked {
+		t.Fatalf("RecordFailure() = %v, %v, want true, true", userLocked, ipLocked)
+	}
+	if !ll.IsLockedOut("jim", "") {
+		t.Errorf("username not locked out")
+	}
+	if !ll.IsLockedOut("dwight", "192.0.2.1") {
+		t.Errorf("IP address not locked out")
+	}
+	if ll.IsLockedOut("dwight", "192.0.2.2") {
+		t.Errorf("unrelated username and IP address locked out")
+	}
+	if l := ll.Lockouts(); len(l) != 2 {
+		t.Errorf("Lockouts() = %v, want 2 entries", l)
+	}
+}
@@ -18,9 +18,10 @@ type messageStore interface {
 	// date. The message ID returned may not refer to a valid message, but can be
 	// used in history queries.
 	LastMsgID(network *Network, entity string, t time.Time) (string, error)
-	// LoadLatestID queries the latest non-event messages for the given network,
-	// entity and date, up to a count of limit messages, sorted from oldest to newest.
-	LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int) ([]*irc.Message, error)
+	// LoadLatestID queries the latest messages for the given network, entity
+	// and date, up to a count of limit messages, sorted from oldest to newest.
+	// If events is false, only PRIVMSG/NOTICE messages are considered.
+	LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int, events bool) ([]*irc.Message, error)
 	Append(network *Network, entity string, msg *irc.Message) (id string, err error)
 }
 
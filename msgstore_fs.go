@@ -3,6 +3,7 @@ package soju
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -83,16 +84,52 @@ type fsMessageStore struct {
 
 	// Write-only files used by Append
 	files map[string]*fsMessageStoreFile // indexed by entity
+
+	maxSize int64 // negative means no limit
+	size    int64 // negative if unknown
 }
 
+// errMessageStoreFull is returned by Append when the maximum disk usage is
+// reached.
+var errMessageStoreFull = errors.New("message log quota exceeded")
+
 var _ messageStore = (*fsMessageStore)(nil)
 var _ chatHistoryMessageStore = (*fsMessageStore)(nil)
 
 func newFSMessageStore(root, username string) *fsMessageStore {
 	return &fsMessageStore{
-		root:  filepath.Join(root, escapeFilename(username)),
-		files: make(map[string]*fsMessageStoreFile),
+		root:    filepath.Join(root, escapeFilename(username)),
+		files:   make(map[string]*fsMessageStoreFile),
+		maxSize: -1,
+		size:    -1,
+	}
+}
+
+// SetMaxSize sets the maximum disk usage of the store, in bytes. A negative
+// value means no limit.
+func (ms *fsMessageStore) SetMaxSize(maxSize int64) {
+	ms.maxSize = maxSize
+}
+
+// DiskUsage computes the disk space used by the message logs, in bytes.
+func (ms *fsMessageStore) DiskUsage() (int64, error) {
+	var size int64
+	err := filepath.Walk(ms.root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute message logs disk usage: %v", err)
 	}
+	ms.size = size
+	return size, nil
 }
 
 func (ms *fsMessageStore) logPath(network *Network, entity string, t time.Time) string {
@@ -139,6 +176,17 @@ func (ms *fsMessageStore) Append(network *Network, entity string, msg *irc.Messa
 		t = time.Now()
 	}
 
+	if ms.maxSize >= 0 {
+		if ms.size < 0 {
+			if _, err := ms.DiskUsage(); err != nil {
+				return "", err
+			}
+		}
+		if ms.size >= ms.maxSize {
+			return "", errMessageStoreFull
+		}
+	}
+
 	f := ms.files[entity]
 
 	// TODO: handle non-monotonic clock behaviour
@@ -184,10 +232,13 @@ func (ms *fsMessageStore) Append(network *Network, entity string, msg *irc.Messa
 		return "", fmt.Errorf("failed to generate message ID: %v", err)
 	}
 
-	_, err = fmt.Fprintf(f, "[%02d:%02d:%02d] %s\n", t.Hour(), t.Minute(), t.Second(), s)
+	n, err := fmt.Fprintf(f, "[%02d:%02d:%02d] %s\n", t.Hour(), t.Minute(), t.Second(), s)
 	if err != nil {
 		return "", fmt.Errorf("failed to log message to %q: %v", f.Name(), err)
 	}
+	if ms.size >= 0 {
+		ms.size += int64(n)
+	}
 
 	return msgID, nil
 }
@@ -534,7 +585,7 @@ func (ms *fsMessageStore) LoadAfterTime(ctx context.Context, network *Network, e
 	return history, nil
 }
 
-func (ms *fsMessageStore) LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int) ([]*irc.Message, error) {
+func (ms *fsMessageStore) LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int, events bool) ([]*irc.Message, error) {
 	var afterTime time.Time
 	var afterOffset int64
 	if id != "" {
@@ -560,7 +611,7 @@ func (ms *fsMessageStore) LoadLatestID(ctx context.Context, network *Network, en
 			offset = afterOffset
 		}
 
-		buf, err := ms.parseMessagesBefore(network, entity, t, time.Time{}, false, remaining, offset)
+		buf, err := ms.parseMessagesBefore(network, entity, t, time.Time{}, events, remaining, offset)
 		if err != nil {
 			return nil, err
 		}
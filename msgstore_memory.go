@@ -77,8 +77,8 @@ func (ms *memoryMessageStore) LastMsgID(network *Network, entity string, t time.
 func (ms *memoryMessageStore) Append(network *Network, entity string, msg *irc.Message) (string, error) {
 	switch msg.Command {
 	case "PRIVMSG", "NOTICE":
-		// Only append these messages, because LoadLatestID shouldn't return
-		// other kinds of message.
+	case "JOIN", "PART", "KICK", "QUIT", "NICK", "TOPIC", "MODE":
+		// Events are only returned by LoadLatestID on request
 	default:
 		return "", nil
 	}
@@ -94,7 +94,7 @@ func (ms *memoryMessageStore) Append(network *Network, entity string, msg *irc.M
 	return formatMemoryMsgID(network.ID, entity, seq), nil
 }
 
-func (ms *memoryMessageStore) LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int) ([]*irc.Message, error) {
+func (ms *memoryMessageStore) LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int, events bool) ([]*irc.Message, error) {
 	_, _, seq, err := parseMemoryMsgID(id)
 	if err != nil {
 		return nil, err
@@ -106,55 +106,103 @@ func (ms *memoryMessageStore) LoadLatestID(ctx context.Context, network *Network
 		return nil, nil
 	}
 
-	return rb.LoadLatestSeq(seq, limit)
+	return rb.LoadLatestSeq(seq, limit, events)
 }
 
+// messageRingBuffer stores the latest messages of a conversation. Events
+// (JOIN, PART, etc.) are kept in a separate ring, so that they don't push
+// messages out of the backlog. Both rings share the same sequence numbers.
 type messageRingBuffer struct {
-	buf []*irc.Message
-	cur uint64
+	messages, events messageRing
+	cur              uint64
 }
 
 func newMessageRingBuffer(capacity int) *messageRingBuffer {
 	return &messageRingBuffer{
-		buf: make([]*irc.Message, capacity),
-		cur: 1,
+		messages: newMessageRing(capacity),
+		events:   newMessageRing(capacity),
+		cur:      1,
 	}
 }
 
-func (rb *messageRingBuffer) cap() uint64 {
-	return uint64(len(rb.buf))
-}
-
 func (rb *messageRingBuffer) Append(msg *irc.Message) uint64 {
 	seq := rb.cur
-	i := int(seq % rb.cap())
-	rb.buf[i] = msg
+	if msg.Command == "PRIVMSG" || msg.Command == "NOTICE" {
+		rb.messages.Append(seq, msg)
+	} else {
+		rb.events.Append(seq, msg)
+	}
 	rb.cur++
 	return seq
 }
 
-func (rb *messageRingBuffer) LoadLatestSeq(seq uint64, limit int) ([]*irc.Message, error) {
+func (rb *messageRingBuffer) LoadLatestSeq(seq uint64, limit int, events bool) ([]*irc.Message, error) {
 	if seq > rb.cur {
 		return nil, fmt.Errorf("loading messages from sequence number (%v) greater than current (%v)", seq, rb.cur)
 	} else if seq == rb.cur {
 		return nil, nil
 	}
 
-	// The query excludes the message with the sequence number seq
-	diff := rb.cur - seq - 1
-	if diff > rb.cap() {
-		// We dropped diff - cap entries
-		diff = rb.cap()
-	}
-	if int(diff) > limit {
-		diff = uint64(limit)
+	// Walk backwards from the latest entry of both rings, merging them by
+	// sequence number. The query excludes the message with the sequence
+	// number seq.
+	var l []*irc.Message
+	i, j := 1, 1
+	for len(l) < limit {
+		msg := rb.messages.Latest(i, seq)
+		var ev *messageRingEntry
+		if events {
+			ev = rb.events.Latest(j, seq)
+		}
+
+		var e *messageRingEntry
+		if msg != nil && (ev == nil || msg.seq > ev.seq) {
+			e = msg
+			i++
+		} else if ev != nil {
+			e = ev
+			j++
+		} else {
+			break
+		}
+		l = append(l, e.msg.Copy())
 	}
 
-	l := make([]*irc.Message, int(diff))
-	for i := 0; i < int(diff); i++ {
-		j := int((rb.cur - diff + uint64(i)) % rb.cap())
-		l[i] = rb.buf[j]
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
 	}
 
 	return l, nil
 }
+
+type messageRingEntry struct {
+	seq uint64
+	msg *irc.Message
+}
+
+type messageRing struct {
+	buf []messageRingEntry
+	n   uint64 // number of entries appended so far
+}
+
+func newMessageRing(capacity int) messageRing {
+	return messageRing{buf: make([]messageRingEntry, capacity)}
+}
+
+func (r *messageRing) Append(seq uint64, msg *irc.Message) {
+	r.buf[r.n%uint64(len(r.buf))] = messageRingEntry{seq, msg}
+	r.n++
+}
+
+// Latest returns the i-th latest entry (starting from 1), or nil if it has
+// been dropped or its sequence number isn't greater than after.
+func (r *messageRing) Latest(i int, after uint64) *messageRingEntry {
+	if uint64(i) > r.n || i > len(r.buf) {
+		return nil
+	}
+	e := &r.buf[(r.n-uint64(i))%uint64(len(r.buf))]
+	if e.seq <= after {
+		return nil
+	}
+	return e
+}
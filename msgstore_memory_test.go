@@ -0,0 +1,66 @@
+package soju
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/irc.v3"
+)
+
+func TestMessageRingBufferEvents(t *testing.T) {
+	rb := newMessageRingBuffer(8)
+	seq := rb.cur
+	rb.Append(&irc.Message{Command: "PRIVMSG", Params: []string{"#soju", "hi"}})
+	rb.Append(&irc.Message{Command: "JOIN", Params: []string{"#soju"}})
+	rb.Append(&irc.Message{Command: "NOTICE", Params: []string{"#soju", "hello"}})
+	rb.Append(&irc.Message{Command: "PART", Params: []string{"#soju"}})
+
+	l, err := rb.LoadLatestSeq(seq-1, 10, false)
+	if err != nil {
+		t.Fatalf("LoadLatestSeq() = %v", err)
+	}
+	if len(l) != 2 || l[0].Command != "PRIVMSG" || l[1].Command != "NOTICE" {
+		t.Errorf("LoadLatestSeq(events = false) = %v, want PRIVMSG and NOTICE", l)
+	}
+
+	l, err = rb.LoadLatestSeq(seq-1, 3, true)
+	if err != nil {
+		t.Fatalf("LoadLatestSeq() = %v", err)
+	}
+	if len(l) != 3 || l[0].Command != "JOIN" || l[1].Command != "NOTICE" || l[2].Command != "PART" {
+		t.Errorf("LoadLatestSeq(events = true) = %v, want JOIN, NOTICE and PART", l)
+	}
+}
+
+func TestMessageRingBufferEventsFull(t *testing.T) {
+	rb := newMessageRingBuffer(4)
+	seq := rb.cur
+	for i := 0; i < 4; i++ {
+		rb.Append(&irc.Message{Command: "PRIVMSG", Params: []string{"#soju", fmt.Sprint(i)}})
+	}
+	for i := 0; i < 16; i++ {
+		rb.Append(&irc.Message{Command: "JOIN", Params: []string{"#soju"}})
+	}
+	rb.Append(&irc.Message{Command: "PRIVMSG", Params: []string{"#soju", "4"}})
+
+	l, err := rb.LoadLatestSeq(seq-1, 10, false)
+	if err != nil {
+		t.Fatalf("LoadLatestSeq() = %v", err)
+	}
+	var texts []string
+	for _, msg := range l {
+		texts = append(texts, msg.Params[1])
+	}
+	if got, want := strings.Join(texts, ","), "1,2,3,4"; got != want {
+		t.Errorf("LoadLatestSeq(events = false) = %v, want %v", got, want)
+	}
+
+	l, err = rb.LoadLatestSeq(seq-1, 10, true)
+	if err != nil {
+		t.Fatalf("LoadLatestSeq() = %v", err)
+	}
+	if len(l) != 8 || l[0].Command != "PRIVMSG" || l[3].Command != "JOIN" || l[7].Command != "PRIVMSG" {
+		t.Errorf("LoadLatestSeq(events = true) = %v, want 4 messages and 4 events interleaved by sequence", l)
+	}
+}
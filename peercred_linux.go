@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package soju
+
+import (
+	"fmt"
+	"net"
+	osuser "os/user"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// unixPeerUser returns the name of the Unix user on the other end of a Unix
+// socket connection.
+func unixPeerUser(c net.Conn) (string, error) {
+	// Connections may be wrapped, e.g. by a PROXY protocol listener
+	if rc, ok := c.(interface{ Raw() net.Conn }); ok {
+		c = rc.Raw()
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return "", fmt.Errorf("not a Unix socket connection")
+	}
+
+	rawConn, err := uc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return "", err
+	} else if credErr != nil {
+		return "", fmt.Errorf("failed to get peer credentials: %v", credErr)
+	}
+
+	u, err := osuser.LookupId(strconv.FormatUint(uint64(cred.Uid), 10))
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
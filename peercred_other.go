@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package soju
+
+import (
+	"fmt"
+	"net"
+)
+
+func unixPeerUser(c net.Conn) (string, error) {
+	return "", fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -13,7 +13,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"gopkg.in/irc.v3"
 	"nhooyr.io/websocket"
 
 	"git.sr.ht/~emersion/soju/config"
@@ -29,65 +28,128 @@ var backlogTimeout = 10 * time.Second
 var handleDownstreamMessageTimeout = 10 * time.Second
 var chatHistoryLimit = 1000
 var backlogLimit = 4000
-
-type Logger interface {
-	Print(v ...interface{})
-	Printf(format string, v ...interface{})
+var clientExpiryInterval = time.Hour
+
+// Config contains the server settings which can be changed while the server
+// is running.
+type Config struct {
+	Hostname    string
+	Title       string
+	LogPath     string
+	Debug       bool
+	HTTPOrigins []string
+	HTTPRoot    string // directory served to non-WebSocket HTTP requests
+	// WebSocket permessage-deflate mode: "disabled", "no-context-takeover"
+	// or "context-takeover"
+	WebSocketCompression string
+	AcceptProxyIPs       config.IPSet
+	MaxUserNetworks      int
+
+	// Default per-user quotas, -1 means no limit, see UserQuotas
+	MaxUserChannels        int
+	MaxUserDownstreams     int
+	MaxUserLogSize         int64
+	MaxUserConnectCommands int
+
+	ClientExpiry time.Duration // zero means never
+
+	// Failed login attempts before a lockout, zero disables lockouts
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+	// Maximum number of connections per IP address, -1 means no limit
+	MaxIPUnregisteredConns int
+	MaxIPConns             int
 }
 
-type prefixLogger struct {
-	logger Logger
-	prefix string
-}
+// DefaultConfig returns the default server settings.
+func DefaultConfig() *Config {
+	return &Config{
+		MaxUserNetworks: -1,
 
-var _ Logger = (*prefixLogger)(nil)
+		MaxUserChannels:        -1,
+		MaxUserDownstreams:     -1,
+		MaxUserLogSize:         -1,
+		MaxUserConnectCommands: -1,
 
-func (l *prefixLogger) Print(v ...interface{}) {
-	v = append([]interface{}{l.prefix}, v...)
-	l.logger.Print(v...)
+		LoginMaxFailures:       0,
+		LoginLockout:           15 * time.Minute,
+		MaxIPUnregisteredConns: -1,
+		MaxIPConns:             -1,
+	}
 }
 
-func (l *prefixLogger) Printf(format string, v ...interface{}) {
-	v = append([]interface{}{l.prefix}, v...)
-	l.logger.Printf("%v"+format, v...)
+// ListenerConfig contains per-listener settings. Empty fields fall back to the
+// server settings.
+type ListenerConfig struct {
+	Hostname    string
+	HTTPOrigins []string
+
+	// ClientHost is the host shown to clients in their own prefix, instead
+	// of their address
+	ClientHost string
+	// PeerAuth allows clients connecting via a Unix socket to log in without
+	// a password as the user named after their Unix user
+	PeerAuth bool
 }
 
 type Server struct {
-	Hostname        string
-	Title           string
-	Logger          Logger
-	LogPath         string
-	Debug           bool
-	HTTPOrigins     []string
-	AcceptProxyIPs  config.IPSet
-	MaxUserNetworks int
-	Identd          *Identd // can be nil
+	Logger Logger
+	Identd *Identd // can be nil
 
 	db        Database
 	stopWG    sync.WaitGroup
 	connCount int64 // atomic
 
+	loginLimiter *loginLimiter
+	connLimiter  *connLimiter
+
 	lock      sync.Mutex
 	listeners map[net.Listener]struct{}
 	users     map[string]*user
+	handovers map[string]map[int64]*UpstreamHandover // by username and network ID
 
-	motd atomic.Value // string
+	config atomic.Value // *Config
+	motd   atomic.Value // string
 }
 
 func NewServer(db Database) *Server {
 	srv := &Server{
-		Logger:          log.New(log.Writer(), "", log.LstdFlags),
-		MaxUserNetworks: -1,
-		db:              db,
-		listeners:       make(map[net.Listener]struct{}),
-		users:           make(map[string]*user),
+		Logger:       NewLogWriter(log.Writer()).Logger(),
+		loginLimiter: newLoginLimiter(),
+		connLimiter:  newConnLimiter(),
+		db:           db,
+		listeners:    make(map[net.Listener]struct{}),
+		users:        make(map[string]*user),
 	}
+	srv.config.Store(DefaultConfig())
 	srv.motd.Store("")
 	return srv
 }
 
-func (s *Server) prefix() *irc.Prefix {
-	return &irc.Prefix{Name: s.Hostname}
+// Config returns the current server settings. The returned value must not be
+// modified.
+func (s *Server) Config() *Config {
+	return s.config.Load().(*Config)
+}
+
+// SetConfig replaces the server settings. Running users are notified so that
+// they can pick up the new settings.
+func (s *Server) SetConfig(cfg *Config) {
+	s.config.Store(cfg)
+
+	var users []*user
+	s.forEachUser(func(u *user) {
+		users = append(users, u)
+	})
+	for _, u := range users {
+		// Don't block the caller on a busy user
+		go func(u *user) {
+			select {
+			case u.events <- eventConfigUpdate{}:
+			case <-u.done:
+			}
+		}(u)
+	}
 }
 
 func (s *Server) Start() error {
@@ -98,8 +160,13 @@ func (s *Server) Start() error {
 
 	s.lock.Lock()
 	for i := range users {
+		if !users[i].Enabled {
+			s.Logger.Printf("not starting bouncer for suspended user %q", users[i].Username)
+			continue
+		}
 		s.addUserLocked(&users[i])
 	}
+	s.discardHandoversLocked()
 	s.lock.Unlock()
 
 	return nil
@@ -109,7 +176,7 @@ func (s *Server) Shutdown() {
 	s.lock.Lock()
 	for ln := range s.listeners {
 		if err := ln.Close(); err != nil {
-			s.Logger.Printf("failed to stop listener: %v", err)
+			s.Logger.Errorf("failed to stop listener: %v", err)
 		}
 	}
 	for _, u := range s.users {
@@ -120,7 +187,7 @@ func (s *Server) Shutdown() {
 	s.stopWG.Wait()
 
 	if err := s.db.Close(); err != nil {
-		s.Logger.Printf("failed to close DB: %v", err)
+		s.Logger.Errorf("failed to close DB: %v", err)
 	}
 }
 
@@ -166,7 +233,10 @@ func (s *Server) addUserLocked(user *User) *user {
 		u.run()
 
 		s.lock.Lock()
-		delete(s.users, u.Username)
+		// The user may have been re-started in the meantime
+		if s.users[u.Username] == u {
+			delete(s.users, u.Username)
+		}
 		s.lock.Unlock()
 
 		s.stopWG.Done()
@@ -175,28 +245,122 @@ func (s *Server) addUserLocked(user *User) *user {
 	return u
 }
 
-var lastDownstreamID uint64 = 0
+// suspendUser stops the bouncer for a user and marks the user as disabled.
+// The user's data is kept.
+func (s *Server) suspendUser(ctx context.Context, username string) error {
+	record, err := s.db.GetUser(ctx, username)
+	if err != nil {
+		return fmt.Errorf("unknown username %q", username)
+	}
+	if !record.Enabled {
+		return fmt.Errorf("user %q is already suspended", username)
+	}
+
+	// Stop the user first, so that the user goroutine doesn't overwrite the
+	// updated record
+	if u := s.getUser(username); u != nil {
+		u.stop()
+	}
+
+	record.Enabled = false
+	if err := s.db.StoreUser(ctx, record); err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+	return nil
+}
+
+// resumeUser marks a suspended user as enabled and starts the bouncer for
+// the user.
+func (s *Server) resumeUser(ctx context.Context, username string) error {
+	record, err := s.db.GetUser(ctx, username)
+	if err != nil {
+		return fmt.Errorf("unknown username %q", username)
+	}
+	if record.Enabled {
+		return fmt.Errorf("user %q isn't suspended", username)
+	}
 
-func (s *Server) handle(ic ircConn) {
+	record.Enabled = true
+	if err := s.db.StoreUser(ctx, record); err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.users[username]; !ok {
+		s.addUserLocked(record)
+	}
+	return nil
+}
+
+// lastConnID is the last ID given to a downstream or upstream connection.
+var lastConnID uint64 = 0
+
+// handle serves a downstream connection. peerUser is the Unix user of the
+// client if it has been authenticated via the socket.
+func (s *Server) handle(ic ircConn, lcfg *ListenerConfig, peerUser string) {
 	atomic.AddInt64(&s.connCount, 1)
-	id := atomic.AddUint64(&lastDownstreamID, 1)
-	dc := newDownstreamConn(s, ic, id)
-	if err := dc.runUntilRegistered(); err != nil {
+	id := atomic.AddUint64(&lastConnID, 1)
+	dc := newDownstreamConn(s, ic, id, lcfg)
+	dc.peerUser = peerUser
+	defer func() {
+		dc.Close()
+		atomic.AddInt64(&s.connCount, -1)
+	}()
+
+	ip := s.clientIP(ic.RemoteAddr())
+	if !s.connLimiter.Acquire(ip, false, s.Config().MaxIPUnregisteredConns) {
+		dc.logger.Printf("too many unregistered connections from %v", ip)
+		dc.CloseWithError("Too many connections from your IP address")
+		return
+	}
+	err := dc.runUntilRegistered()
+	s.connLimiter.Release(ip, false)
+	if err != nil {
 		if !errors.Is(err, io.EOF) {
 			dc.logger.Print(err)
 		}
-	} else {
-		dc.user.events <- eventDownstreamConnected{dc}
-		if err := dc.readMessages(dc.user.events); err != nil {
-			dc.logger.Print(err)
+		return
+	}
+
+	if !s.connLimiter.Acquire(ip, true, s.Config().MaxIPConns) {
+		dc.logger.Printf("too many connections from %v", ip)
+		dc.CloseWithError("Too many connections from your IP address")
+		return
+	}
+	defer s.connLimiter.Release(ip, true)
+
+	if !dc.user.acquireDownstream() {
+		dc.logger.Printf("too many connections for user %q", dc.user.Username)
+		dc.CloseWithError("Too many connections for this user")
+		return
+	}
+	defer dc.user.releaseDownstream()
+
+	dc.user.events <- eventDownstreamConnected{dc}
+	if err := dc.readMessages(dc.user.events); err != nil {
+		dc.logger.Print(err)
+	}
+	dc.user.events <- eventDownstreamDisconnected{dc}
+}
+
+// notifyAdmins sends a notice to all connected admin users.
+func (s *Server) notifyAdmins(text string) {
+	var users []*user
+	s.forEachUser(func(u *user) {
+		users = append(users, u)
+	})
+
+	for _, u := range users {
+		select {
+		case u.events <- eventAdminNotice{text}:
+		case <-u.done:
 		}
-		dc.user.events <- eventDownstreamDisconnected{dc}
 	}
-	dc.Close()
-	atomic.AddInt64(&s.connCount, -1)
 }
 
-func (s *Server) Serve(ln net.Listener) error {
+// Serve accepts IRC connections on a listener. lcfg can be nil.
+func (s *Server) Serve(ln net.Listener, lcfg *ListenerConfig) error {
 	s.lock.Lock()
 	s.listeners[ln] = struct{}{}
 	s.lock.Unlock()
@@ -219,38 +383,90 @@ func (s *Server) Serve(ln net.Listener) error {
 			return fmt.Errorf("failed to accept connection: %v", err)
 		}
 
-		go s.handle(newNetIRCConn(conn))
+		go func() {
+			var peerUser string
+			if lcfg != nil && lcfg.PeerAuth {
+				var err error
+				if peerUser, err = unixPeerUser(conn); err != nil {
+					s.Logger.Errorf("failed to authenticate Unix socket peer: %v", err)
+				}
+			}
+			s.handle(newNetIRCConn(conn), lcfg, peerUser)
+		}()
 	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.serveHTTP(w, req, nil)
+}
+
+type listenerHandler struct {
+	srv  *Server
+	lcfg *ListenerConfig
+}
+
+func (h listenerHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.srv.serveHTTP(w, req, h.lcfg)
+}
+
+// Handler returns an HTTP handler for a listener.
+func (s *Server) Handler(lcfg *ListenerConfig) http.Handler {
+	return listenerHandler{s, lcfg}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request, lcfg *ListenerConfig) {
+	if s.Config().HTTPRoot != "" && !isWebSocketRequest(req) {
+		s.serveStatic(w, req)
+		return
+	}
+
+	origins := s.Config().HTTPOrigins
+	if lcfg != nil && lcfg.HTTPOrigins != nil {
+		origins = lcfg.HTTPOrigins
+	}
+
 	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{
-		Subprotocols:   []string{"text.ircv3.net"}, // non-compliant, fight me
-		OriginPatterns: s.HTTPOrigins,
+		// non-compliant, fight me
+		Subprotocols:    []string{websocketSubprotocolBinary, websocketSubprotocolText},
+		OriginPatterns:  origins,
+		CompressionMode: websocketCompressionMode(s.Config().WebSocketCompression),
 	})
 	if err != nil {
-		s.Logger.Printf("failed to serve HTTP connection: %v", err)
+		s.Logger.Errorf("failed to serve HTTP connection: %v", err)
 		return
 	}
 
-	isProxy := false
-	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if ip := net.ParseIP(host); ip != nil {
-			isProxy = s.AcceptProxyIPs.Contains(ip)
-		}
-	}
-
 	// Only trust the Forwarded header field if this is a trusted proxy IP
 	// to prevent users from spoofing the remote address
 	remoteAddr := req.RemoteAddr
-	if isProxy {
+	if s.isProxy(req) {
 		forwarded := parseForwarded(req.Header)
 		if forwarded["for"] != "" {
 			remoteAddr = forwarded["for"]
 		}
 	}
 
-	s.handle(newWebsocketIRCConn(conn, remoteAddr))
+	s.handle(newWebsocketIRCConn(conn, remoteAddr), lcfg, "")
+}
+
+func websocketCompressionMode(mode string) websocket.CompressionMode {
+	switch mode {
+	case "no-context-takeover":
+		return websocket.CompressionNoContextTakeover
+	case "context-takeover":
+		return websocket.CompressionContextTakeover
+	default:
+		return websocket.CompressionDisabled
+	}
+}
+
+func (s *Server) isProxy(req *http.Request) bool {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return s.Config().AcceptProxyIPs.Contains(ip)
+		}
+	}
+	return false
 }
 
 func parseForwarded(h http.Header) map[string]string {
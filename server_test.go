@@ -43,7 +43,7 @@ func createTestUser(t *testing.T, db Database) *User {
 		t.Fatalf("failed to generate bcrypt hash: %v", err)
 	}
 
-	record := &User{Username: testUsername, Password: string(hashed)}
+	record := &User{Username: testUsername, Password: string(hashed), Enabled: true}
 	if err := db.StoreUser(context.TODO(), record); err != nil {
 		t.Fatalf("failed to store test user: %v", err)
 	}
@@ -53,7 +53,7 @@ func createTestUser(t *testing.T, db Database) *User {
 
 func createTestDownstream(t *testing.T, srv *Server) ircConn {
 	c1, c2 := net.Pipe()
-	go srv.handle(newNetIRCConn(c1))
+	go srv.handle(newNetIRCConn(c1), nil, "")
 	return newNetIRCConn(c2)
 }
 
@@ -205,3 +205,88 @@ func TestServer(t *testing.T) {
 		testServer(t, db)
 	})
 }
+
+func TestServerSuspendedUser(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	user.Enabled = false
+	if err := db.StoreUser(context.TODO(), user); err != nil {
+		t.Fatalf("failed to suspend test user: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PASS",
+		Params:  []string{testPassword},
+	})
+	dc.WriteMessage(&irc.Message{
+		Command: "NICK",
+		Params:  []string{testUsername},
+	})
+	dc.WriteMessage(&irc.Message{
+		Command: "USER",
+		Params:  []string{testUsername, "0", "*", testUsername},
+	})
+
+	msg := expectMessage(t, dc, irc.ERR_PASSWDMISMATCH)
+	if msg.Params[1] != errAuthSuspended.Message.Params[1] {
+		t.Errorf("invalid authentication error: want %q, got: %v", errAuthSuspended.Message.Params[1], msg)
+	}
+}
+
+func TestServerChannelQuota(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	user.Quotas.MaxChannels = 1
+	if err := db.StoreUser(context.TODO(), user); err != nil {
+		t.Fatalf("failed to update test user: %v", err)
+	}
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	dc.WriteMessage(&irc.Message{Command: "JOIN", Params: []string{"#soju"}})
+	if msg := expectMessageSkip(t, uc, "JOIN"); msg.Params[0] != "#soju" {
+		t.Fatalf("invalid JOIN: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{Command: "JOIN", Params: []string{"#other"}})
+	if msg := expectMessageSkip(t, dc, irc.ERR_TOOMANYCHANNELS); msg.Params[1] != "#other" {
+		t.Errorf("invalid ERR_TOOMANYCHANNELS: %v", msg)
+	}
+
+	// Detaching a channel saves it as well
+	dc.WriteMessage(&irc.Message{Command: "PART", Params: []string{"#other", "detach"}})
+	if msg := expectMessageSkip(t, dc, irc.ERR_TOOMANYCHANNELS); msg.Params[1] != "#other" {
+		t.Errorf("invalid ERR_TOOMANYCHANNELS: %v", msg)
+	}
+
+	channels, err := db.ListChannels(context.TODO(), network.ID)
+	if err != nil {
+		t.Fatalf("failed to list channels: %v", err)
+	}
+	if len(channels) != 1 || channels[0].Name != "#soju" {
+		t.Errorf("got saved channels %+v, want #soju only", channels)
+	}
+}
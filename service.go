@@ -2,6 +2,7 @@ package soju
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
@@ -10,14 +11,20 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/irc.v3"
+
+	"git.sr.ht/~emersion/soju/config"
 )
 
 const serviceNick = "BouncerServ"
@@ -34,14 +41,27 @@ var servicePrefix = &irc.Prefix{
 	Host: serviceNick,
 }
 
+// serviceContext is the context in which a service command runs. The user
+// the command operates on is usually the one owning the downstream
+// connection, but admins can run some commands on behalf of other users.
+type serviceContext struct {
+	*downstreamConn // the connection the command has been received on
+
+	user    *user
+	network *network // can be nil
+}
+
 type serviceCommandSet map[string]*serviceCommand
 
 type serviceCommand struct {
 	usage    string
 	desc     string
-	handle   func(ctx context.Context, dc *downstreamConn, params []string) error
+	handle   func(ctx context.Context, dc *serviceContext, params []string) error
 	children serviceCommandSet
 	admin    bool
+	// allowUser indicates that admins can run the command on behalf of
+	// another user with the -user flag
+	allowUser bool
 }
 
 func sendServiceNOTICE(dc *downstreamConn, text string) {
@@ -52,7 +72,7 @@ func sendServiceNOTICE(dc *downstreamConn, text string) {
 	})
 }
 
-func sendServicePRIVMSG(dc *downstreamConn, text string) {
+func sendServicePRIVMSG(dc *serviceContext, text string) {
 	dc.SendMessage(&irc.Message{
 		Prefix:  servicePrefix,
 		Command: "PRIVMSG",
@@ -113,7 +133,13 @@ func splitWords(s string) ([]string, error) {
 	return words, nil
 }
 
-func handleServicePRIVMSG(ctx context.Context, dc *downstreamConn, text string) {
+func handleServicePRIVMSG(ctx context.Context, downstream *downstreamConn, text string) {
+	dc := &serviceContext{
+		downstreamConn: downstream,
+		user:           downstream.user,
+		network:        downstream.network,
+	}
+
 	words, err := splitWords(text)
 	if err != nil {
 		sendServicePRIVMSG(dc, fmt.Sprintf(`error: failed to parse command: %v`, err))
@@ -130,6 +156,17 @@ func handleServicePRIVMSG(ctx context.Context, dc *downstreamConn, text string)
 		return
 	}
 
+	var username string
+	if cmd.allowUser {
+		username, params = popUserFlag(params)
+	}
+	if username != "" && username != dc.user.Username {
+		if err := runServiceCommandAsUser(ctx, dc, username, cmd, params); err != nil {
+			sendServicePRIVMSG(dc, fmt.Sprintf("error: %v", err))
+		}
+		return
+	}
+
 	if cmd.handle == nil {
 		if len(cmd.children) > 0 {
 			var l []string
@@ -149,6 +186,87 @@ func handleServicePRIVMSG(ctx context.Context, dc *downstreamConn, text string)
 	}
 }
 
+// popUserFlag extracts the -user flag from command parameters. The flag is
+// only recognized as the first parameter, so that it can't be confused with
+// a positional argument or the value of another flag.
+func popUserFlag(params []string) (username string, rest []string) {
+	if len(params) == 0 {
+		return "", params
+	}
+	param := params[0]
+	switch {
+	case (param == "-user" || param == "--user") && len(params) > 1:
+		return params[1], params[2:]
+	case strings.HasPrefix(param, "-user="):
+		return strings.TrimPrefix(param, "-user="), params[1:]
+	case strings.HasPrefix(param, "--user="):
+		return strings.TrimPrefix(param, "--user="), params[1:]
+	default:
+		return "", params
+	}
+}
+
+// runServiceCommandAsUser runs a command on behalf of another user. The
+// command is executed in the goroutine of the target user.
+func runServiceCommandAsUser(ctx context.Context, dc *serviceContext, username string, cmd *serviceCommand, params []string) error {
+	if !dc.user.Admin {
+		return fmt.Errorf("you must be an admin to use the -user flag")
+	}
+
+	u := dc.srv.getUser(username)
+	if u == nil {
+		return fmt.Errorf("unknown username %q", username)
+	}
+
+	done := make(chan error, 1)
+	event := eventServiceCommand{
+		ctx:        ctx,
+		downstream: dc.downstreamConn,
+		handle:     cmd.handle,
+		params:     params,
+		state:      new(int32),
+		done:       done,
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case u.events <- event:
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-u.done:
+		return waitServiceCommand(username, done, u.done)
+	case <-ctx.Done():
+		// Don't wait any longer for the target goroutine to pick up the
+		// command: it may itself be waiting for ours. If the command has
+		// already started, it uses our downstream connection: wait for it to
+		// complete, so that it never runs concurrently with our goroutine.
+		if atomic.CompareAndSwapInt32(event.state, serviceCommandPending, serviceCommandCanceled) {
+			return fmt.Errorf("timed out waiting for user %q", username)
+		}
+		return waitServiceCommand(username, done, u.done)
+	}
+}
+
+// waitServiceCommand waits for a command sent to another user goroutine to
+// complete.
+func waitServiceCommand(username string, done <-chan error, userDone <-chan struct{}) error {
+	select {
+	case err := <-done:
+		return err
+	case <-userDone:
+		// The user goroutine may have stopped without running the command
+		select {
+		case err := <-done:
+			return err
+		default:
+			return fmt.Errorf("user %q has been stopped", username)
+		}
+	}
+}
+
 func (cmds serviceCommandSet) Get(params []string) (*serviceCommand, []string, error) {
 	if len(params) == 0 {
 		return nil, nil, fmt.Errorf("no command specified")
@@ -200,56 +318,65 @@ func init() {
 		"network": {
 			children: serviceCommandSet{
 				"create": {
-					usage:  "-addr <addr> [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-enabled enabled] [-connect-command command]...",
-					desc:   "add a new network",
-					handle: handleServiceNetworkCreate,
+					usage:     "-addr <addr> [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-ident ident] [-enabled enabled] [-connect-command command]...",
+					desc:      "add a new network",
+					handle:    handleServiceNetworkCreate,
+					allowUser: true,
 				},
 				"status": {
-					desc:   "show a list of saved networks and their current status",
-					handle: handleServiceNetworkStatus,
+					desc:      "show a list of saved networks and their current status",
+					handle:    handleServiceNetworkStatus,
+					allowUser: true,
 				},
 				"update": {
-					usage:  "<name> [-addr addr] [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-enabled enabled] [-connect-command command]...",
-					desc:   "update a network",
-					handle: handleServiceNetworkUpdate,
+					usage:     "<name> [-addr addr] [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-ident ident] [-enabled enabled] [-connect-command command]...",
+					desc:      "update a network",
+					handle:    handleServiceNetworkUpdate,
+					allowUser: true,
 				},
 				"delete": {
-					usage:  "<name>",
-					desc:   "delete a network",
-					handle: handleServiceNetworkDelete,
+					usage:     "<name>",
+					desc:      "delete a network",
+					handle:    handleServiceNetworkDelete,
+					allowUser: true,
 				},
 				"quote": {
-					usage:  "<name> <command>",
-					desc:   "send a raw line to a network",
-					handle: handleServiceNetworkQuote,
+					usage:     "<name> <command>",
+					desc:      "send a raw line to a network",
+					handle:    handleServiceNetworkQuote,
+					allowUser: true,
 				},
 			},
 		},
 		"certfp": {
 			children: serviceCommandSet{
 				"generate": {
-					usage:  "[-key-type rsa|ecdsa|ed25519] [-bits N] <network name>",
-					desc:   "generate a new self-signed certificate, defaults to using RSA-3072 key",
-					handle: handleServiceCertFPGenerate,
+					usage:     "[-key-type rsa|ecdsa|ed25519] [-bits N] <network name>",
+					desc:      "generate a new self-signed certificate, defaults to using RSA-3072 key",
+					handle:    handleServiceCertFPGenerate,
+					allowUser: true,
 				},
 				"fingerprint": {
-					usage:  "<network name>",
-					desc:   "show fingerprints of certificate associated with the network",
-					handle: handleServiceCertFPFingerprints,
+					usage:     "<network name>",
+					desc:      "show fingerprints of certificate associated with the network",
+					handle:    handleServiceCertFPFingerprints,
+					allowUser: true,
 				},
 			},
 		},
 		"sasl": {
 			children: serviceCommandSet{
 				"set-plain": {
-					usage:  "<network name> <username> <password>",
-					desc:   "set SASL PLAIN credentials",
-					handle: handleServiceSASLSetPlain,
+					usage:     "<network name> <username> <password>",
+					desc:      "set SASL PLAIN credentials",
+					handle:    handleServiceSASLSetPlain,
+					allowUser: true,
 				},
 				"reset": {
-					usage:  "<network name>",
-					desc:   "disable SASL authentication and remove stored credentials",
-					handle: handleServiceSASLReset,
+					usage:     "<network name>",
+					desc:      "disable SASL authentication and remove stored credentials",
+					handle:    handleServiceSASLReset,
+					allowUser: true,
 				},
 			},
 		},
@@ -262,29 +389,152 @@ func init() {
 					admin:  true,
 				},
 				"update": {
-					usage:  "[-password <password>] [-realname <realname>]",
-					desc:   "update the current user",
+					usage:  "[username] [-password <password>] [-realname <realname>] [-admin <true|false>] [-max-channels <n>] [-max-downstreams <n>] [-max-log-size <size>] [-max-connect-commands <n>]",
+					desc:   "update a user",
 					handle: handleUserUpdate,
 				},
+				"status": {
+					desc:   "show resource usage and quotas of the current user",
+					handle: handleUserStatus,
+				},
 				"delete": {
 					usage:  "<username>",
 					desc:   "delete a user",
 					handle: handleUserDelete,
 					admin:  true,
 				},
+				"suspend": {
+					usage:  "<username>",
+					desc:   "suspend a user, keeping its data",
+					handle: handleUserSuspend,
+					admin:  true,
+				},
+				"resume": {
+					usage:  "<username>",
+					desc:   "resume a suspended user",
+					handle: handleUserResume,
+					admin:  true,
+				},
 			},
 		},
 		"channel": {
 			children: serviceCommandSet{
 				"status": {
-					usage:  "[-network name]",
-					desc:   "show a list of saved channels and their current status",
-					handle: handleServiceChannelStatus,
+					usage:     "[-network name]",
+					desc:      "show a list of saved channels and their current status",
+					handle:    handleServiceChannelStatus,
+					allowUser: true,
 				},
 				"update": {
-					usage:  "<name> [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration>] [-detach-on <default|none|highlight|message>]",
-					desc:   "update a channel",
-					handle: handleServiceChannelUpdate,
+					usage:     "<name> [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration|never>] [-detach-on <default|none|highlight|message>]",
+					desc:      "update a channel",
+					handle:    handleServiceChannelUpdate,
+					allowUser: true,
+				},
+				"defaults": {
+					children: serviceCommandSet{
+						"status": {
+							usage:     "[-network name]",
+							desc:      "show the default channel settings",
+							handle:    handleServiceChannelDefaultsStatus,
+							allowUser: true,
+						},
+						"update": {
+							usage:     "[-network name] [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration|never>] [-detach-on <default|none|highlight|message>]",
+							desc:      "update the default channel settings of the user, or of a network",
+							handle:    handleServiceChannelDefaultsUpdate,
+							allowUser: true,
+						},
+					},
+				},
+			},
+		},
+		"highlight": {
+			children: serviceCommandSet{
+				"add": {
+					usage:  "[-network name] <word|/regexp/>",
+					desc:   "add a custom highlight word or regular expression",
+					handle: highlightRules.handleAdd,
+				},
+				"delete": {
+					usage:  "[-network name] <word|/regexp/>",
+					desc:   "delete a custom highlight word or regular expression",
+					handle: highlightRules.handleDelete,
+				},
+				"list": {
+					usage:  "[-network name]",
+					desc:   "show the list of custom highlights",
+					handle: highlightRules.handleList,
+				},
+			},
+		},
+		"ignore": {
+			children: serviceCommandSet{
+				"add": {
+					usage:  "[-network name] <nick!user@host>",
+					desc:   "ignore messages from users matching a mask",
+					handle: ignoreRules.handleAdd,
+				},
+				"delete": {
+					usage:  "[-network name] <nick!user@host>",
+					desc:   "stop ignoring messages from users matching a mask",
+					handle: ignoreRules.handleDelete,
+				},
+				"list": {
+					usage:  "[-network name]",
+					desc:   "show the list of ignore masks",
+					handle: ignoreRules.handleList,
+				},
+			},
+		},
+		"webhook": {
+			children: serviceCommandSet{
+				"create": {
+					usage:  "-url <url> [-events <event,...>] [-secret <secret>]",
+					desc:   "add a new webhook, events are " + strings.Join(webhookEvents, ", "),
+					handle: handleServiceWebhookCreate,
+				},
+				"list": {
+					desc:   "show the list of webhooks",
+					handle: handleServiceWebhookList,
+				},
+				"delete": {
+					usage:  "<id>",
+					desc:   "delete a webhook",
+					handle: handleServiceWebhookDelete,
+				},
+			},
+		},
+		"client": {
+			children: serviceCommandSet{
+				"list": {
+					usage:  "[-network name]",
+					desc:   "show known clients and their delivery state",
+					handle: handleServiceClientList,
+				},
+				"forget": {
+					usage:  "[-network name] <client>",
+					desc:   "forget the delivery state of a client",
+					handle: handleServiceClientForget,
+				},
+				"fast-forward": {
+					usage:  "[-network name] <client>",
+					desc:   "mark all messages as delivered to a client",
+					handle: handleServiceClientFastForward,
+				},
+			},
+		},
+		"session": {
+			children: serviceCommandSet{
+				"list": {
+					usage:  "[-all]",
+					desc:   "show connected clients",
+					handle: handleServiceSessionList,
+				},
+				"kick": {
+					usage:  "<id>",
+					desc:   "disconnect a client",
+					handle: handleServiceSessionKick,
 				},
 			},
 		},
@@ -300,6 +550,30 @@ func init() {
 					handle: handleServiceServerNotice,
 					admin:  true,
 				},
+				"audit": {
+					usage:  "[-actor username] [-target username] [-action action] [-since time] [-until time] [-limit n]",
+					desc:   "query the audit log",
+					handle: handleServiceServerAudit,
+					admin:  true,
+				},
+				"backup": {
+					usage:  "[-logs] <path>",
+					desc:   "write a backup archive of the database and optionally the message logs",
+					handle: handleServiceServerBackup,
+					admin:  true,
+				},
+				"lockouts": {
+					desc:   "show usernames and IP addresses locked out after failed logins",
+					handle: handleServiceServerLockouts,
+					admin:  true,
+				},
+				"trace": {
+					usage:     "[-network name] <on|off>",
+					desc:      "enable or disable raw protocol logging for a user or network",
+					handle:    handleServiceServerTrace,
+					admin:     true,
+					allowUser: true,
+				},
 			},
 			admin: true,
 		},
@@ -322,7 +596,7 @@ func appendServiceCommandSetHelp(cmds serviceCommandSet, prefix []string, admin
 	}
 }
 
-func handleServiceHelp(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceHelp(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) > 0 {
 		cmd, rest, err := serviceCommands.Get(params)
 		if err != nil {
@@ -339,6 +613,9 @@ func handleServiceHelp(ctx context.Context, dc *downstreamConn, params []string)
 			if cmd.usage != "" {
 				text += " " + cmd.usage
 			}
+			if cmd.allowUser && dc.user.Admin {
+				text += " [-user username]"
+			}
 			text += ": " + cmd.desc
 
 			sendServicePRIVMSG(dc, text)
@@ -407,11 +684,86 @@ func (f boolPtrFlag) Set(s string) error {
 	return nil
 }
 
+type intPtrFlag struct {
+	ptr **int
+}
+
+func (f intPtrFlag) String() string {
+	if f.ptr == nil || *f.ptr == nil {
+		return "<nil>"
+	}
+	return strconv.Itoa(**f.ptr)
+}
+
+func (f intPtrFlag) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*f.ptr = &v
+	return nil
+}
+
+// sizePtrFlag is a flag value populating a size in bytes, with an optional
+// K, M, G or T suffix.
+type sizePtrFlag struct {
+	ptr **int64
+}
+
+func (f sizePtrFlag) String() string {
+	if f.ptr == nil || *f.ptr == nil {
+		return "<nil>"
+	}
+	return strconv.FormatInt(**f.ptr, 10)
+}
+
+func (f sizePtrFlag) Set(s string) error {
+	v, err := config.ParseSize(s)
+	if err != nil {
+		return err
+	}
+	*f.ptr = &v
+	return nil
+}
+
+// userQuotasUpdate holds the quotas changed by a user update. Nil fields are
+// left unchanged.
+type userQuotasUpdate struct {
+	MaxChannels, MaxDownstreams, MaxConnectCommands *int
+	MaxLogSize                                      *int64
+}
+
+func (upd *userQuotasUpdate) register(fs *flag.FlagSet) {
+	fs.Var(intPtrFlag{&upd.MaxChannels}, "max-channels", "")
+	fs.Var(intPtrFlag{&upd.MaxDownstreams}, "max-downstreams", "")
+	fs.Var(sizePtrFlag{&upd.MaxLogSize}, "max-log-size", "")
+	fs.Var(intPtrFlag{&upd.MaxConnectCommands}, "max-connect-commands", "")
+}
+
+func (upd *userQuotasUpdate) isZero() bool {
+	return upd.MaxChannels == nil && upd.MaxDownstreams == nil && upd.MaxLogSize == nil && upd.MaxConnectCommands == nil
+}
+
+func (upd *userQuotasUpdate) apply(q *UserQuotas) {
+	if upd.MaxChannels != nil {
+		q.MaxChannels = *upd.MaxChannels
+	}
+	if upd.MaxDownstreams != nil {
+		q.MaxDownstreams = *upd.MaxDownstreams
+	}
+	if upd.MaxLogSize != nil {
+		q.MaxLogSize = *upd.MaxLogSize
+	}
+	if upd.MaxConnectCommands != nil {
+		q.MaxConnectCommands = *upd.MaxConnectCommands
+	}
+}
+
 type networkFlagSet struct {
 	*flag.FlagSet
-	Addr, Name, Nick, Username, Pass, Realname *string
-	Enabled                                    *bool
-	ConnectCommands                            []string
+	Addr, Name, Nick, Username, Pass, Realname, Ident *string
+	Enabled                                           *bool
+	ConnectCommands                                   []string
 }
 
 func newNetworkFlagSet() *networkFlagSet {
@@ -422,6 +774,7 @@ func newNetworkFlagSet() *networkFlagSet {
 	fs.Var(stringPtrFlag{&fs.Username}, "username", "")
 	fs.Var(stringPtrFlag{&fs.Pass}, "pass", "")
 	fs.Var(stringPtrFlag{&fs.Realname}, "realname", "")
+	fs.Var(stringPtrFlag{&fs.Ident}, "ident", "")
 	fs.Var(boolPtrFlag{&fs.Enabled}, "enabled", "")
 	fs.Var((*stringSliceFlag)(&fs.ConnectCommands), "connect-command", "")
 	return fs
@@ -454,6 +807,14 @@ func (fs *networkFlagSet) update(network *Network) error {
 	if fs.Realname != nil {
 		network.Realname = *fs.Realname
 	}
+	if fs.Ident != nil {
+		if *fs.Ident != "" {
+			if err := checkIdent(*fs.Ident); err != nil {
+				return fmt.Errorf("flag -ident: %v", err)
+			}
+		}
+		network.Ident = *fs.Ident
+	}
 	if fs.Enabled != nil {
 		network.Enabled = *fs.Enabled
 	}
@@ -473,7 +834,20 @@ func (fs *networkFlagSet) update(network *Network) error {
 	return nil
 }
 
-func handleServiceNetworkCreate(ctx context.Context, dc *downstreamConn, params []string) error {
+// ParseNetworkFlags parses the flags accepted by the "network create" and
+// "network update" service commands, and applies them to a network.
+func ParseNetworkFlags(network *Network, args []string) error {
+	fs := newNetworkFlagSet()
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unexpected argument")
+	}
+	return fs.update(network)
+}
+
+func handleServiceNetworkCreate(ctx context.Context, dc *serviceContext, params []string) error {
 	fs := newNetworkFlagSet()
 	if err := fs.Parse(params); err != nil {
 		return err
@@ -491,6 +865,7 @@ func handleServiceNetworkCreate(ctx context.Context, dc *downstreamConn, params
 	}
 
 	network, err := dc.user.createNetwork(ctx, record)
+	dc.audit(ctx, "network.create", dc.user.Username, fmt.Sprintf("network %q", record.GetName()), err)
 	if err != nil {
 		return fmt.Errorf("could not create network: %v", err)
 	}
@@ -499,7 +874,7 @@ func handleServiceNetworkCreate(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
-func handleServiceNetworkStatus(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceNetworkStatus(ctx context.Context, dc *serviceContext, params []string) error {
 	n := 0
 	dc.user.forEachNetwork(func(net *network) {
 		var statuses []string
@@ -545,7 +920,7 @@ func handleServiceNetworkStatus(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
-func handleServiceNetworkUpdate(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceNetworkUpdate(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) < 1 {
 		return fmt.Errorf("expected at least one argument")
 	}
@@ -566,6 +941,7 @@ func handleServiceNetworkUpdate(ctx context.Context, dc *downstreamConn, params
 	}
 
 	network, err := dc.user.updateNetwork(ctx, &record)
+	dc.audit(ctx, "network.update", dc.user.Username, fmt.Sprintf("network %q", net.GetName()), err)
 	if err != nil {
 		return fmt.Errorf("could not update network: %v", err)
 	}
@@ -574,7 +950,7 @@ func handleServiceNetworkUpdate(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
-func handleServiceNetworkDelete(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceNetworkDelete(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) != 1 {
 		return fmt.Errorf("expected exactly one argument")
 	}
@@ -584,7 +960,9 @@ func handleServiceNetworkDelete(ctx context.Context, dc *downstreamConn, params
 		return fmt.Errorf("unknown network %q", params[0])
 	}
 
-	if err := dc.user.deleteNetwork(ctx, net.ID); err != nil {
+	err := dc.user.deleteNetwork(ctx, net.ID)
+	dc.audit(ctx, "network.delete", dc.user.Username, fmt.Sprintf("network %q", net.GetName()), err)
+	if err != nil {
 		return err
 	}
 
@@ -592,7 +970,7 @@ func handleServiceNetworkDelete(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
-func handleServiceNetworkQuote(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceNetworkQuote(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) != 2 {
 		return fmt.Errorf("expected exactly two arguments")
 	}
@@ -617,7 +995,7 @@ func handleServiceNetworkQuote(ctx context.Context, dc *downstreamConn, params [
 	return nil
 }
 
-func sendCertfpFingerprints(dc *downstreamConn, cert []byte) {
+func sendCertfpFingerprints(dc *serviceContext, cert []byte) {
 	sha1Sum := sha1.Sum(cert)
 	sendServicePRIVMSG(dc, "SHA-1 fingerprint: "+hex.EncodeToString(sha1Sum[:]))
 	sha256Sum := sha256.Sum256(cert)
@@ -626,7 +1004,7 @@ func sendCertfpFingerprints(dc *downstreamConn, cert []byte) {
 	sendServicePRIVMSG(dc, "SHA-512 fingerprint: "+hex.EncodeToString(sha512Sum[:]))
 }
 
-func handleServiceCertFPGenerate(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceCertFPGenerate(ctx context.Context, dc *serviceContext, params []string) error {
 	fs := newFlagSet()
 	keyType := fs.String("key-type", "rsa", "key type to generate (rsa, ecdsa, ed25519)")
 	bits := fs.Int("bits", 3072, "size of key to generate, meaningful only for RSA")
@@ -657,7 +1035,9 @@ func handleServiceCertFPGenerate(ctx context.Context, dc *downstreamConn, params
 	net.SASL.External.PrivKeyBlob = privKey
 	net.SASL.Mechanism = "EXTERNAL"
 
-	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+	err = dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network)
+	dc.audit(ctx, "certfp.generate", dc.user.Username, fmt.Sprintf("network %q", net.GetName()), err)
+	if err != nil {
 		return err
 	}
 
@@ -666,7 +1046,7 @@ func handleServiceCertFPGenerate(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
-func handleServiceCertFPFingerprints(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceCertFPFingerprints(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) != 1 {
 		return fmt.Errorf("expected exactly one argument")
 	}
@@ -684,7 +1064,7 @@ func handleServiceCertFPFingerprints(ctx context.Context, dc *downstreamConn, pa
 	return nil
 }
 
-func handleServiceSASLSetPlain(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceSASLSetPlain(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) != 3 {
 		return fmt.Errorf("expected exactly 3 arguments")
 	}
@@ -698,7 +1078,9 @@ func handleServiceSASLSetPlain(ctx context.Context, dc *downstreamConn, params [
 	net.SASL.Plain.Password = params[2]
 	net.SASL.Mechanism = "PLAIN"
 
-	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+	err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network)
+	dc.audit(ctx, "sasl.set-plain", dc.user.Username, fmt.Sprintf("network %q", net.GetName()), err)
+	if err != nil {
 		return err
 	}
 
@@ -706,7 +1088,7 @@ func handleServiceSASLSetPlain(ctx context.Context, dc *downstreamConn, params [
 	return nil
 }
 
-func handleServiceSASLReset(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceSASLReset(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) != 1 {
 		return fmt.Errorf("expected exactly one argument")
 	}
@@ -722,7 +1104,9 @@ func handleServiceSASLReset(ctx context.Context, dc *downstreamConn, params []st
 	net.SASL.External.PrivKeyBlob = nil
 	net.SASL.Mechanism = ""
 
-	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+	err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network)
+	dc.audit(ctx, "sasl.reset", dc.user.Username, fmt.Sprintf("network %q", net.GetName()), err)
+	if err != nil {
 		return err
 	}
 
@@ -730,7 +1114,7 @@ func handleServiceSASLReset(ctx context.Context, dc *downstreamConn, params []st
 	return nil
 }
 
-func handleUserCreate(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleUserCreate(ctx context.Context, dc *serviceContext, params []string) error {
 	fs := newFlagSet()
 	username := fs.String("username", "", "")
 	password := fs.String("password", "", "")
@@ -757,8 +1141,11 @@ func handleUserCreate(ctx context.Context, dc *downstreamConn, params []string)
 		Password: string(hashed),
 		Realname: *realname,
 		Admin:    *admin,
+		Enabled:  true,
 	}
-	if _, err := dc.srv.createUser(ctx, user); err != nil {
+	_, err = dc.srv.createUser(ctx, user)
+	dc.audit(ctx, "user.create", *username, fmt.Sprintf("admin=%v", *admin), err)
+	if err != nil {
 		return fmt.Errorf("could not create user: %v", err)
 	}
 
@@ -766,6 +1153,27 @@ func handleUserCreate(ctx context.Context, dc *downstreamConn, params []string)
 	return nil
 }
 
+// unmarshalEntity is the same as downstreamConn.unmarshalEntity, but uses the
+// networks of the user the command operates on.
+func (dc *serviceContext) unmarshalEntity(name string) (*upstreamConn, string, error) {
+	if dc.user == dc.downstreamConn.user {
+		return dc.downstreamConn.unmarshalEntity(name)
+	}
+
+	var net *network
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		net = dc.user.getNetwork(name[i+1:])
+		name = name[:i]
+	}
+	if net == nil {
+		return nil, "", fmt.Errorf("missing network suffix in name")
+	}
+	if net.conn == nil {
+		return nil, "", fmt.Errorf("disconnected from upstream network")
+	}
+	return net.conn, name, nil
+}
+
 func popArg(params []string) (string, []string) {
 	if len(params) > 0 && !strings.HasPrefix(params[0], "-") {
 		return params[0], params[1:]
@@ -773,13 +1181,15 @@ func popArg(params []string) (string, []string) {
 	return "", params
 }
 
-func handleUserUpdate(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleUserUpdate(ctx context.Context, dc *serviceContext, params []string) error {
 	var password, realname *string
 	var admin *bool
+	var quotas userQuotasUpdate
 	fs := newFlagSet()
 	fs.Var(stringPtrFlag{&password}, "password", "")
 	fs.Var(stringPtrFlag{&realname}, "realname", "")
 	fs.Var(boolPtrFlag{&admin}, "admin", "")
+	quotas.register(fs)
 
 	username, params := popArg(params)
 	if err := fs.Parse(params); err != nil {
@@ -788,6 +1198,9 @@ func handleUserUpdate(ctx context.Context, dc *downstreamConn, params []string)
 	if len(fs.Args()) > 0 {
 		return fmt.Errorf("unexpected argument")
 	}
+	if !quotas.isZero() && !dc.user.Admin {
+		return fmt.Errorf("you must be an admin to update quotas")
+	}
 
 	var hashed *string
 	if password != nil {
@@ -807,24 +1220,39 @@ func handleUserUpdate(ctx context.Context, dc *downstreamConn, params []string)
 			return fmt.Errorf("cannot update -realname of other user")
 		}
 
-		u := dc.srv.getUser(username)
-		if u == nil {
-			return fmt.Errorf("unknown username %q", username)
-		}
-
-		done := make(chan error, 1)
-		event := eventUserUpdate{
-			password: hashed,
-			admin:    admin,
-			done:     done,
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case u.events <- event:
+		var err error
+		if u := dc.srv.getUser(username); u != nil {
+			done := make(chan error, 1)
+			event := eventUserUpdate{
+				password: hashed,
+				admin:    admin,
+				quotas:   quotas,
+				done:     done,
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case u.events <- event:
+			}
+			// TODO: send context to the other side
+			err = <-done
+		} else {
+			// Suspended users aren't running, update the record directly
+			record, getErr := dc.srv.db.GetUser(ctx, username)
+			if getErr != nil {
+				return fmt.Errorf("unknown username %q", username)
+			}
+			if hashed != nil {
+				record.Password = *hashed
+			}
+			if admin != nil {
+				record.Admin = *admin
+			}
+			quotas.apply(&record.Quotas)
+			err = dc.srv.db.StoreUser(ctx, record)
 		}
-		// TODO: send context to the other side
-		if err := <-done; err != nil {
+		dc.audit(ctx, "user.update", username, formatUserUpdate(password, realname, admin, &quotas), err)
+		if err != nil {
 			return err
 		}
 
@@ -842,8 +1270,11 @@ func handleUserUpdate(ctx context.Context, dc *downstreamConn, params []string)
 		if admin != nil {
 			return fmt.Errorf("cannot update -admin of own user")
 		}
+		quotas.apply(&record.Quotas)
 
-		if err := dc.user.updateUser(ctx, &record); err != nil {
+		err := dc.user.updateUser(ctx, &record)
+		dc.audit(ctx, "user.update", dc.user.Username, formatUserUpdate(password, realname, admin, &quotas), err)
+		if err != nil {
 			return err
 		}
 
@@ -853,20 +1284,101 @@ func handleUserUpdate(ctx context.Context, dc *downstreamConn, params []string)
 	return nil
 }
 
-func handleUserDelete(ctx context.Context, dc *downstreamConn, params []string) error {
+// formatUserUpdate describes the fields changed by a user update. Secrets are
+// omitted.
+func formatUserUpdate(password, realname *string, admin *bool, quotas *userQuotasUpdate) string {
+	var l []string
+	if password != nil {
+		l = append(l, "password")
+	}
+	if realname != nil {
+		l = append(l, fmt.Sprintf("realname=%q", *realname))
+	}
+	if admin != nil {
+		l = append(l, fmt.Sprintf("admin=%v", *admin))
+	}
+	if quotas.MaxChannels != nil {
+		l = append(l, fmt.Sprintf("max-channels=%v", *quotas.MaxChannels))
+	}
+	if quotas.MaxDownstreams != nil {
+		l = append(l, fmt.Sprintf("max-downstreams=%v", *quotas.MaxDownstreams))
+	}
+	if quotas.MaxLogSize != nil {
+		l = append(l, fmt.Sprintf("max-log-size=%v", *quotas.MaxLogSize))
+	}
+	if quotas.MaxConnectCommands != nil {
+		l = append(l, fmt.Sprintf("max-connect-commands=%v", *quotas.MaxConnectCommands))
+	}
+	return strings.Join(l, ", ")
+}
+
+func formatQuota(n int64) string {
+	if n < 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func formatSize(n int64) string {
+	if n < 0 {
+		return "unlimited"
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+func handleUserStatus(ctx context.Context, dc *serviceContext, params []string) error {
+	if len(params) != 0 {
+		return fmt.Errorf("expected no argument")
+	}
+
+	u := dc.user
+	q := u.quotas()
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("networks: %v/%v", len(u.networks), formatQuota(int64(u.srv.Config().MaxUserNetworks))))
+	sendServicePRIVMSG(dc, fmt.Sprintf("connected clients: %v/%v", atomic.LoadInt64(&u.downstreamCount), formatQuota(int64(q.MaxDownstreams))))
+
+	if ms, ok := u.msgStore.(*fsMessageStore); ok {
+		size, err := ms.DiskUsage()
+		if err != nil {
+			return err
+		}
+		sendServicePRIVMSG(dc, fmt.Sprintf("message logs: %v/%v", formatSize(size), formatSize(q.MaxLogSize)))
+	}
+
+	u.forEachNetwork(func(net *network) {
+		sendServicePRIVMSG(dc, fmt.Sprintf("network %q: %v/%v channels, %v/%v connect commands", net.GetName(), net.channels.Len(), formatQuota(int64(q.MaxChannels)), len(net.ConnectCommands), formatQuota(int64(q.MaxConnectCommands))))
+	})
+	return nil
+}
+
+func handleUserDelete(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) != 1 {
 		return fmt.Errorf("expected exactly one argument")
 	}
 	username := params[0]
 
-	u := dc.srv.getUser(username)
-	if u == nil {
+	// Suspended users aren't running, so look up the record in the database
+	record, err := dc.srv.db.GetUser(ctx, username)
+	if err != nil {
 		return fmt.Errorf("unknown username %q", username)
 	}
 
-	u.stop()
+	if u := dc.srv.getUser(username); u != nil {
+		u.stop()
+	}
 
-	if err := dc.srv.db.DeleteUser(ctx, u.ID); err != nil {
+	err = dc.srv.db.DeleteUser(ctx, record.ID)
+	dc.audit(ctx, "user.delete", username, "", err)
+	if err != nil {
 		return fmt.Errorf("failed to delete user: %v", err)
 	}
 
@@ -874,7 +1386,43 @@ func handleUserDelete(ctx context.Context, dc *downstreamConn, params []string)
 	return nil
 }
 
-func handleServiceChannelStatus(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleUserSuspend(ctx context.Context, dc *serviceContext, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	username := params[0]
+
+	if username == dc.user.Username {
+		return fmt.Errorf("cannot suspend own user")
+	}
+
+	err := dc.srv.suspendUser(ctx, username)
+	dc.audit(ctx, "user.suspend", username, "", err)
+	if err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("suspended user %q", username))
+	return nil
+}
+
+func handleUserResume(ctx context.Context, dc *serviceContext, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	username := params[0]
+
+	err := dc.srv.resumeUser(ctx, username)
+	dc.audit(ctx, "user.resume", username, "", err)
+	if err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("resumed user %q", username))
+	return nil
+}
+
+func handleServiceChannelStatus(ctx context.Context, dc *serviceContext, params []string) error {
 	var defaultNetworkName string
 	if dc.network != nil {
 		defaultNetworkName = dc.network.GetName()
@@ -962,7 +1510,7 @@ func newChannelFlagSet() *channelFlagSet {
 	return fs
 }
 
-func (fs *channelFlagSet) update(channel *Channel) error {
+func (fs *channelFlagSet) update(channel *ChannelSettings) error {
 	if fs.RelayDetached != nil {
 		filter, err := parseFilter(*fs.RelayDetached)
 		if err != nil {
@@ -978,11 +1526,15 @@ func (fs *channelFlagSet) update(channel *Channel) error {
 		channel.ReattachOn = filter
 	}
 	if fs.DetachAfter != nil {
-		dur, err := time.ParseDuration(*fs.DetachAfter)
-		if err != nil || dur < 0 {
-			return fmt.Errorf("unknown duration for -detach-after %q (duration format: 0, 300s, 22h30m, ...)", *fs.DetachAfter)
+		if *fs.DetachAfter == "never" {
+			channel.DetachAfter = DetachNever
+		} else {
+			dur, err := time.ParseDuration(*fs.DetachAfter)
+			if err != nil || dur < 0 {
+				return fmt.Errorf("unknown duration for -detach-after %q (duration format: 0, never, 300s, 22h30m, ...)", *fs.DetachAfter)
+			}
+			channel.DetachAfter = dur
 		}
-		channel.DetachAfter = dur
 	}
 	if fs.DetachOn != nil {
 		filter, err := parseFilter(*fs.DetachOn)
@@ -994,7 +1546,27 @@ func (fs *channelFlagSet) update(channel *Channel) error {
 	return nil
 }
 
-func handleServiceChannelUpdate(ctx context.Context, dc *downstreamConn, params []string) error {
+// ParseChannelFlags parses the flags accepted by the "channel update" service
+// command, and applies them to channel settings.
+func ParseChannelFlags(settings *ChannelSettings, args []string) error {
+	fs := newChannelFlagSet()
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unexpected argument")
+	}
+	return fs.update(settings)
+}
+
+// FormatChannelSettings formats channel settings, resolved against a list of
+// defaults.
+func FormatChannelSettings(settings ChannelSettings, defaults ...ChannelSettings) string {
+	l := append([]ChannelSettings{settings}, defaults...)
+	return formatChannelSettings(settings, resolveChannelSettings(l...))
+}
+
+func handleServiceChannelUpdate(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) < 1 {
 		return fmt.Errorf("expected at least one argument")
 	}
@@ -1015,7 +1587,7 @@ func handleServiceChannelUpdate(ctx context.Context, dc *downstreamConn, params
 		return fmt.Errorf("unknown channel %q", name)
 	}
 
-	if err := fs.update(ch); err != nil {
+	if err := fs.update(&ch.ChannelSettings); err != nil {
 		return err
 	}
 
@@ -1029,28 +1601,801 @@ func handleServiceChannelUpdate(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
-func handleServiceServerStatus(ctx context.Context, dc *downstreamConn, params []string) error {
-	dbStats, err := dc.user.srv.db.Stats(ctx)
-	if err != nil {
-		return err
+func formatChannelSettings(settings, resolved ChannelSettings) string {
+	formatFilter := func(filter, resolved MessageFilter) string {
+		if filter == FilterDefault {
+			return fmt.Sprintf("default (%v)", resolved)
+		}
+		return filter.String()
 	}
-	serverStats := dc.user.srv.Stats()
-	sendServicePRIVMSG(dc, fmt.Sprintf("%v/%v users, %v downstreams, %v networks, %v channels", serverStats.Users, dbStats.Users, serverStats.Downstreams, dbStats.Networks, dbStats.Channels))
+
+	formatDuration := func(d time.Duration) string {
+		if d <= 0 {
+			return "never"
+		}
+		return d.String()
+	}
+
+	detachAfter := formatDuration(settings.DetachAfter)
+	if settings.DetachAfter == 0 {
+		detachAfter = fmt.Sprintf("default (%v)", formatDuration(resolved.DetachAfter))
+	}
+
+	return fmt.Sprintf("relay-detached: %v, reattach-on: %v, detach-after: %v, detach-on: %v",
+		formatFilter(settings.RelayDetached, resolved.RelayDetached),
+		formatFilter(settings.ReattachOn, resolved.ReattachOn),
+		detachAfter,
+		formatFilter(settings.DetachOn, resolved.DetachOn))
+}
+
+func handleServiceChannelDefaultsStatus(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	userDefaults := dc.user.ChannelDefaults
+	sendServicePRIVMSG(dc, "user: "+formatChannelSettings(userDefaults, resolveChannelSettings(userDefaults)))
+
+	sendNetwork := func(net *network) {
+		resolved := resolveChannelSettings(net.ChannelDefaults, userDefaults)
+		sendServicePRIVMSG(dc, fmt.Sprintf("network %v: %v", net.GetName(), formatChannelSettings(net.ChannelDefaults, resolved)))
+	}
+
+	if *networkName == "" {
+		dc.user.forEachNetwork(sendNetwork)
+	} else {
+		net := dc.user.getNetwork(*networkName)
+		if net == nil {
+			return fmt.Errorf("unknown network %q", *networkName)
+		}
+		sendNetwork(net)
+	}
+
+	return nil
+}
+
+func handleServiceChannelDefaultsUpdate(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newChannelFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unexpected argument")
+	}
+
+	if *networkName != "" {
+		net := dc.user.getNetwork(*networkName)
+		if net == nil {
+			return fmt.Errorf("unknown network %q", *networkName)
+		}
+
+		// copy the network record because we'll mutate it
+		record := net.Network
+		if err := fs.update(&record.ChannelDefaults); err != nil {
+			return err
+		}
+
+		if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &record); err != nil {
+			return fmt.Errorf("failed to update network: %v", err)
+		}
+		net.ChannelDefaults = record.ChannelDefaults
+
+		if uc := net.conn; uc != nil {
+			for _, entry := range uc.channels.innerMap {
+				uc.updateChannelAutoDetach(entry.value.(*upstreamChannel).Name)
+			}
+		}
+
+		sendServicePRIVMSG(dc, fmt.Sprintf("updated default channel settings of network %q", net.GetName()))
+		return nil
+	}
+
+	// copy the user record because we'll mutate it
+	record := dc.user.User
+	if err := fs.update(&record.ChannelDefaults); err != nil {
+		return err
+	}
+
+	if err := dc.user.updateUser(ctx, &record); err != nil {
+		return err
+	}
+
+	dc.user.forEachUpstream(func(uc *upstreamConn) {
+		for _, entry := range uc.channels.innerMap {
+			uc.updateChannelAutoDetach(entry.value.(*upstreamChannel).Name)
+		}
+	})
+
+	sendServicePRIVMSG(dc, "updated default channel settings")
+	return nil
+}
+
+// serviceRuleSet is a list of rules (highlights, ignores) stored per-user and
+// per-network, managed via service commands.
+type serviceRuleSet struct {
+	name    string
+	parse   func(s string) (string, error)
+	user    func(u *User) *[]string
+	network func(net *Network) *[]string
+}
+
+var highlightRules = &serviceRuleSet{
+	name: "highlight",
+	parse: func(s string) (string, error) {
+		_, err := parseHighlightPattern(s)
+		return s, err
+	},
+	user:    func(u *User) *[]string { return &u.Highlights },
+	network: func(net *Network) *[]string { return &net.Highlights },
+}
+
+var ignoreRules = &serviceRuleSet{
+	name:    "ignore mask",
+	parse:   parseIgnoreMask,
+	user:    func(u *User) *[]string { return &u.Ignores },
+	network: func(net *Network) *[]string { return &net.Ignores },
+}
+
+func (rs *serviceRuleSet) parseParams(dc *serviceContext, params []string) (*network, string, error) {
+	fs := newFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return nil, "", err
+	}
+	if len(fs.Args()) != 1 {
+		return nil, "", fmt.Errorf("expected exactly one argument")
+	}
+
+	var net *network
+	if *networkName != "" {
+		net = dc.user.getNetwork(*networkName)
+		if net == nil {
+			return nil, "", fmt.Errorf("unknown network %q", *networkName)
+		}
+	}
+
+	rule, err := rs.parse(fs.Arg(0))
+	return net, rule, err
+}
+
+// update replaces the rules of the user, or of the network if non-nil.
+func (rs *serviceRuleSet) update(ctx context.Context, dc *serviceContext, net *network, f func(rules []string) ([]string, error)) error {
+	if net != nil {
+		rules, err := f(*rs.network(&net.Network))
+		if err != nil {
+			return err
+		}
+		*rs.network(&net.Network) = rules
+		if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+			return fmt.Errorf("failed to update network: %v", err)
+		}
+		net.updateHighlights()
+		return nil
+	}
+
+	// copy the user record because we'll mutate it
+	record := dc.user.User
+	rules, err := f(*rs.user(&record))
+	if err != nil {
+		return err
+	}
+	*rs.user(&record) = rules
+	return dc.user.updateUser(ctx, &record)
+}
+
+func (rs *serviceRuleSet) handleAdd(ctx context.Context, dc *serviceContext, params []string) error {
+	net, rule, err := rs.parseParams(dc, params)
+	if err != nil {
+		return err
+	}
+
+	err = rs.update(ctx, dc, net, func(rules []string) ([]string, error) {
+		for _, r := range rules {
+			if r == rule {
+				return nil, fmt.Errorf("%v %q already exists", rs.name, rule)
+			}
+		}
+		return append(append([]string(nil), rules...), rule), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("added %v %q", rs.name, rule))
+	return nil
+}
+
+func (rs *serviceRuleSet) handleDelete(ctx context.Context, dc *serviceContext, params []string) error {
+	net, rule, err := rs.parseParams(dc, params)
+	if err != nil {
+		return err
+	}
+
+	err = rs.update(ctx, dc, net, func(rules []string) ([]string, error) {
+		var l []string
+		for _, r := range rules {
+			if r != rule {
+				l = append(l, r)
+			}
+		}
+		if len(l) == len(rules) {
+			return nil, fmt.Errorf("unknown %v %q", rs.name, rule)
+		}
+		return l, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("deleted %v %q", rs.name, rule))
+	return nil
+}
+
+func (rs *serviceRuleSet) handleList(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	n := 0
+	sendRules := func(rules []string, suffix string) {
+		for _, rule := range rules {
+			sendServicePRIVMSG(dc, rule+suffix)
+			n++
+		}
+	}
+
+	if *networkName == "" {
+		sendRules(*rs.user(&dc.user.User), "")
+		dc.user.forEachNetwork(func(net *network) {
+			sendRules(*rs.network(&net.Network), fmt.Sprintf(" (network %v)", net.GetName()))
+		})
+	} else {
+		net := dc.user.getNetwork(*networkName)
+		if net == nil {
+			return fmt.Errorf("unknown network %q", *networkName)
+		}
+		sendRules(*rs.network(&net.Network), "")
+	}
+
+	if n == 0 {
+		sendServicePRIVMSG(dc, fmt.Sprintf("No %v configured.", rs.name))
+	}
+
+	return nil
+}
+
+func handleServiceWebhookCreate(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	rawURL := fs.String("url", "", "")
+	eventsStr := fs.String("events", "", "")
+	secret := fs.String("secret", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unexpected argument")
+	}
+	if *rawURL == "" {
+		return fmt.Errorf("flag -url is required")
+	}
+
+	u, err := url.Parse(*rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", *rawURL)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if err := checkWebhookIP(ip); err != nil {
+			return err
+		}
+	}
+
+	events, err := parseWebhookEvents(*eventsStr)
+	if err != nil {
+		return err
+	}
+
+	generatedSecret := *secret == ""
+	if generatedSecret {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("failed to generate secret: %v", err)
+		}
+		*secret = hex.EncodeToString(b)
+	}
+
+	webhook := Webhook{
+		URL:    *rawURL,
+		Events: events,
+		Secret: *secret,
+	}
+	err = dc.srv.db.StoreWebhook(ctx, dc.user.ID, &webhook)
+	dc.audit(ctx, "webhook.create", dc.user.Username, webhook.URL, err)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook: %v", err)
+	}
+	dc.user.webhooks = append(dc.user.webhooks, webhook)
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("created webhook %v", webhook.ID))
+	if generatedSecret {
+		sendServicePRIVMSG(dc, "HMAC secret: "+webhook.Secret)
+	}
+	return nil
+}
+
+func handleServiceWebhookList(ctx context.Context, dc *serviceContext, params []string) error {
+	if len(dc.user.webhooks) == 0 {
+		sendServicePRIVMSG(dc, `No webhook configured, add one with "webhook create".`)
+		return nil
+	}
+
+	for _, webhook := range dc.user.webhooks {
+		events := "all events"
+		if len(webhook.Events) > 0 {
+			events = strings.Join(webhook.Events, ", ")
+		}
+		sendServicePRIVMSG(dc, fmt.Sprintf("%v: %v [%v]", webhook.ID, webhook.URL, events))
+	}
+	return nil
+}
+
+func handleServiceWebhookDelete(ctx context.Context, dc *serviceContext, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+
+	id, err := strconv.ParseInt(params[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook ID %q", params[0])
+	}
+
+	for i, webhook := range dc.user.webhooks {
+		if webhook.ID != id {
+			continue
+		}
+
+		err := dc.srv.db.DeleteWebhook(ctx, id)
+		dc.audit(ctx, "webhook.delete", dc.user.Username, webhook.URL, err)
+		if err != nil {
+			return fmt.Errorf("failed to delete webhook: %v", err)
+		}
+		dc.user.webhooks = append(dc.user.webhooks[:i], dc.user.webhooks[i+1:]...)
+		dc.user.webhookSender.Remove(id)
+
+		sendServicePRIVMSG(dc, fmt.Sprintf("deleted webhook %v", id))
+		return nil
+	}
+
+	return fmt.Errorf("unknown webhook %v", id)
+}
+
+func formatClientName(clientName string) string {
+	if clientName == "" {
+		return "(default)"
+	}
+	return clientName
+}
+
+// clientNetworks returns the networks selected by the -network flag, or all
+// networks if the flag is empty.
+func clientNetworks(dc *serviceContext, networkName string) ([]*network, error) {
+	if networkName == "" {
+		return dc.user.networks, nil
+	}
+	net := dc.user.getNetwork(networkName)
+	if net == nil {
+		return nil, fmt.Errorf("unknown network %q", networkName)
+	}
+	return []*network{net}, nil
+}
+
+func handleServiceClientList(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unexpected argument")
+	}
+
+	nets, err := clientNetworks(dc, *networkName)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, net := range nets {
+		var clients []string
+		net.delivered.ForEachClient(func(clientName string) {
+			clients = append(clients, clientName)
+		})
+		sort.Strings(clients)
+
+		for _, clientName := range clients {
+			targets := 0
+			var delivered time.Time
+			net.delivered.ForEachTarget(func(target string) {
+				msgID := net.delivered.LoadID(target, clientName)
+				if msgID == "" {
+					return
+				}
+				targets++
+				if _, _, t, _, err := parseFSMsgID(msgID); err == nil && t.After(delivered) {
+					delivered = t
+				}
+			})
+
+			var details []string
+			details = append(details, fmt.Sprintf("%v targets", targets))
+			if !delivered.IsZero() {
+				details = append(details, "delivered up to "+delivered.Format("2006-01-02"))
+			}
+			if net.hasClient(clientName) {
+				details = append(details, "connected")
+			} else if seen := net.delivered.LastSeen(clientName); !seen.IsZero() {
+				details = append(details, "last seen "+seen.Format(time.RFC3339))
+			}
+
+			sendServicePRIVMSG(dc, fmt.Sprintf("%v on %v: %v", formatClientName(clientName), net.GetName(), strings.Join(details, ", ")))
+			n++
+		}
+	}
+
+	if n == 0 {
+		sendServicePRIVMSG(dc, "No known client.")
+	}
+	return nil
+}
+
+func handleServiceClientForget(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	clientName := fs.Arg(0)
+
+	nets, err := clientNetworks(dc, *networkName)
+	if err != nil {
+		return err
+	}
+
+	for _, net := range nets {
+		if net.hasClient(clientName) {
+			return fmt.Errorf("client %v is connected to %v", formatClientName(clientName), net.GetName())
+		}
+	}
+
+	for _, net := range nets {
+		net.forgetClient(clientName)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("forgot client %v", formatClientName(clientName)))
+	return nil
+}
+
+func handleServiceClientFastForward(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	clientName := fs.Arg(0)
+
+	nets, err := clientNetworks(dc, *networkName)
+	if err != nil {
+		return err
+	}
+
+	for _, net := range nets {
+		if err := net.fastForwardClient(clientName); err != nil {
+			return err
+		}
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("fast-forwarded client %v", formatClientName(clientName)))
+	return nil
+}
+
+// forEachOtherUser calls f for each user except the current one. The server
+// lock isn't held while f runs, so that f can wait for the user goroutines.
+func forEachOtherUser(dc *serviceContext, f func(u *user) error) error {
+	var users []*user
+	dc.srv.forEachUser(func(u *user) {
+		if u != dc.user {
+			users = append(users, u)
+		}
+	})
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	for _, u := range users {
+		if err := f(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatSession(s *sessionInfo) string {
+	client := s.ClientName
+	if client == "" {
+		client = "<none>"
+	}
+	network := s.Network
+	if network == "" {
+		network = "<all>"
+	}
+	caps := strings.Join(s.Caps, " ")
+	if caps == "" {
+		caps = "<none>"
+	}
+	return fmt.Sprintf("%v: client %v, network %v, %v from %v, connected since %v, caps: %v",
+		s.ID, client, network, s.Transport, s.RemoteAddr, s.ConnectedAt.Format(time.RFC3339), caps)
+}
+
+func handleServiceSessionList(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	all := fs.Bool("all", false, "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if *all && !dc.user.Admin {
+		return fmt.Errorf("only admins may list the sessions of other users")
+	}
+
+	for _, s := range dc.user.listSessions() {
+		line := formatSession(&s)
+		if s.ID == dc.id {
+			line += " (current)"
+		}
+		if *all {
+			line = s.Username + " " + line
+		}
+		sendServicePRIVMSG(dc, line)
+	}
+
+	if !*all {
+		return nil
+	}
+
+	return forEachOtherUser(dc, func(u *user) error {
+		done := make(chan []sessionInfo, 1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u.events <- eventSessionList{done}:
+		}
+
+		var sessions []sessionInfo
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sessions = <-done:
+		}
+
+		for _, s := range sessions {
+			sendServicePRIVMSG(dc, s.Username+" "+formatSession(&s))
+		}
+		return nil
+	})
+}
+
+func handleServiceSessionKick(ctx context.Context, dc *serviceContext, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+
+	id, err := strconv.ParseUint(params[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid session ID %q", params[0])
+	}
+	if id == dc.id {
+		return fmt.Errorf("cannot kick the current session")
+	}
+
+	if dc.user.kickSession(id) {
+		sendServicePRIVMSG(dc, fmt.Sprintf("kicked session %v", id))
+		return nil
+	}
+
+	// Admins can kick sessions of any user
+	if !dc.user.Admin {
+		return fmt.Errorf("unknown session %v", id)
+	}
+
+	var kicked *user
+	err = forEachOtherUser(dc, func(u *user) error {
+		if kicked != nil {
+			return nil
+		}
+
+		done := make(chan bool, 1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u.events <- eventSessionKick{id, done}:
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ok := <-done:
+			if ok {
+				kicked = u
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if kicked == nil {
+		return fmt.Errorf("unknown session %v", id)
+	}
+
+	dc.audit(ctx, "session.kick", kicked.Username, fmt.Sprintf("session %v", id), nil)
+	sendServicePRIVMSG(dc, fmt.Sprintf("kicked session %v of user %q", id, kicked.Username))
+	return nil
+}
+
+func handleServiceServerStatus(ctx context.Context, dc *serviceContext, params []string) error {
+	dbStats, err := dc.user.srv.db.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	serverStats := dc.user.srv.Stats()
+	sendServicePRIVMSG(dc, fmt.Sprintf("%v/%v users, %v downstreams, %v networks, %v channels", serverStats.Users, dbStats.Users, serverStats.Downstreams, dbStats.Networks, dbStats.Channels))
+	return nil
+}
+
+func handleServiceServerAudit(ctx context.Context, dc *serviceContext, params []string) error {
+	filter, err := ParseAuditFilter(params)
+	if err != nil {
+		return err
+	}
+
+	entries, err := dc.srv.db.ListAuditEntries(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to query audit log: %v", err)
+	}
+
+	if len(entries) == 0 {
+		sendServicePRIVMSG(dc, "No matching audit log entry.")
+		return nil
+	}
+
+	// Entries are sorted from newest to oldest, send the oldest first
+	for i := len(entries) - 1; i >= 0; i-- {
+		sendServicePRIVMSG(dc, FormatAuditEntry(&entries[i]))
+	}
+	return nil
+}
+
+func handleServiceServerBackup(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	withLogs := fs.Bool("logs", false, "")
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	filename := fs.Arg(0)
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %v", err)
+	}
+
+	err = dc.srv.Backup(ctx, f, *withLogs, dc.user)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	dc.audit(ctx, "server.backup", "", filename, err)
+	if err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("backup written to %q", filename))
+	return nil
+}
+
+func handleServiceServerLockouts(ctx context.Context, dc *serviceContext, params []string) error {
+	lockouts := dc.srv.loginLimiter.Lockouts()
+	if len(lockouts) == 0 {
+		sendServicePRIVMSG(dc, "No active lockout.")
+		return nil
+	}
+
+	for _, l := range lockouts {
+		what := fmt.Sprintf("username %q", l.Username)
+		if l.IP != "" {
+			what = "IP address " + l.IP
+		}
+		sendServicePRIVMSG(dc, fmt.Sprintf("%v locked out until %v", what, l.Until.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+func handleServiceServerTrace(ctx context.Context, dc *serviceContext, params []string) error {
+	fs := newFlagSet()
+	networkName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+
+	var v int32
+	switch fs.Arg(0) {
+	case "on":
+		v = 1
+	case "off":
+		v = 0
+	default:
+		return fmt.Errorf("expected \"on\" or \"off\", got %q", fs.Arg(0))
+	}
+
+	target := fmt.Sprintf("user %q", dc.user.Username)
+	if *networkName != "" {
+		net := dc.user.getNetwork(*networkName)
+		if net == nil {
+			return fmt.Errorf("unknown network %q", *networkName)
+		}
+		atomic.StoreInt32(&net.trace, v)
+		target = fmt.Sprintf("network %q of user %q", net.GetName(), dc.user.Username)
+	} else {
+		atomic.StoreInt32(&dc.user.trace, v)
+	}
+	dc.user.updateTrace()
+
+	dc.logger.Printf("protocol tracing %v for %v", fs.Arg(0), target)
+	dc.audit(ctx, "server.trace", dc.user.Username, fmt.Sprintf("%v %v", target, fs.Arg(0)), nil)
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("protocol tracing %v for %v", fs.Arg(0), target))
 	return nil
 }
 
-func handleServiceServerNotice(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceServerNotice(ctx context.Context, dc *serviceContext, params []string) error {
 	if len(params) != 1 {
 		return fmt.Errorf("expected exactly one argument")
 	}
 	text := params[0]
 
 	dc.logger.Printf("broadcasting bouncer-wide NOTICE: %v", text)
+	dc.audit(ctx, "server.notice", "", text, nil)
 
 	broadcastMsg := &irc.Message{
 		Prefix:  servicePrefix,
 		Command: "NOTICE",
-		Params:  []string{"$" + dc.srv.Hostname, text},
+		Params:  []string{"$" + dc.srv.Config().Hostname, text},
 	}
 	var err error
 	dc.srv.forEachUser(func(u *user) {
@@ -1,7 +1,10 @@
 package soju
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func assertSplit(t *testing.T, input string, expected []string) {
@@ -52,3 +55,97 @@ func TestSplit(t *testing.T) {
 		t.Errorf("expected error on unterminated backquote sequence")
 	}
 }
+
+func TestPopUserFlag(t *testing.T) {
+	username, rest := popUserFlag([]string{"-user", "alice", "libera", "-nick", "bob"})
+	if username != "alice" {
+		t.Errorf("expected username %q, got %q", "alice", username)
+	}
+	if len(rest) != 3 || rest[0] != "libera" || rest[1] != "-nick" || rest[2] != "bob" {
+		t.Errorf("unexpected remaining params: %v", rest)
+	}
+
+	// -user after a positional argument is a regular parameter, e.g. a
+	// channel topic
+	username, rest = popUserFlag([]string{"#soju", "-topic", "-user", "alice"})
+	if username != "" || len(rest) != 4 {
+		t.Errorf("unexpected result: %q, %v", username, rest)
+	}
+
+	username, rest = popUserFlag([]string{"-user=alice"})
+	if username != "alice" || len(rest) != 0 {
+		t.Errorf("unexpected result: %q, %v", username, rest)
+	}
+}
+
+func TestChannelFlagSetDetachNever(t *testing.T) {
+	user := ChannelSettings{DetachAfter: time.Hour}
+	var network ChannelSettings
+
+	fs := newChannelFlagSet()
+	if err := fs.Parse([]string{"-detach-after", "never"}); err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	if err := fs.update(&network); err != nil {
+		t.Fatalf("update() = %v", err)
+	}
+
+	if got := resolveChannelSettings(network, user).DetachAfter; got > 0 {
+		t.Errorf("resolved DetachAfter = %v, want auto-detach disabled", got)
+	}
+	if got := resolveChannelSettings(ChannelSettings{}, user).DetachAfter; got != time.Hour {
+		t.Errorf("resolved DetachAfter = %v, want %v", got, time.Hour)
+	}
+}
+
+func TestRunServiceCommandAsUserTimeout(t *testing.T) {
+	db := createTempSqliteDB(t)
+	createTestUser(t, db)
+	admin := &User{Username: "admin", Admin: true, Enabled: true}
+	if err := db.StoreUser(context.TODO(), admin); err != nil {
+		t.Fatalf("failed to store admin user: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	adminUser := srv.getUser("admin")
+	dc := &serviceContext{
+		downstreamConn: &downstreamConn{conn: conn{srv: srv}},
+		user:           adminUser,
+	}
+
+	// The target goroutine is busy, e.g. waiting for ours
+	resume, err := srv.pauseUsers(context.TODO(), adminUser)
+	if err != nil {
+		t.Fatalf("failed to pause users: %v", err)
+	}
+
+	var ran int32
+	cmd := &serviceCommand{handle: func(ctx context.Context, dc *serviceContext, params []string) error {
+		atomic.StoreInt32(&ran, 1)
+		return nil
+	}}
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	err = runServiceCommandAsUser(ctx, dc, testUsername, cmd, nil)
+	cancel()
+	if err == nil {
+		t.Errorf("expected an error for a busy user")
+	}
+	resume()
+
+	// Commands are handled in order: once this one completes, the timed
+	// out one has been dropped
+	done := &serviceCommand{handle: func(ctx context.Context, dc *serviceContext, params []string) error {
+		return nil
+	}}
+	if err := runServiceCommandAsUser(context.TODO(), dc, testUsername, done, nil); err != nil {
+		t.Fatalf("failed to run command: %v", err)
+	}
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Errorf("timed out command has been run")
+	}
+}
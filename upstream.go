@@ -13,6 +13,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -60,7 +61,7 @@ func (uc *upstreamChannel) updateAutoDetach(dur time.Duration) {
 		uc.detachTimer = nil
 	}
 
-	if dur == 0 {
+	if dur <= 0 {
 		return
 	}
 
@@ -80,6 +81,9 @@ type pendingUpstreamCommand struct {
 type upstreamConn struct {
 	conn
 
+	netConn net.Conn
+	ircConn *bufferedIRCConn
+
 	network *network
 	user    *user
 
@@ -115,10 +119,17 @@ type upstreamConn struct {
 	pendingCmds map[string][]pendingUpstreamCommand
 
 	gotMotd bool
+
+	handingOver int32 // atomic
+}
+
+// newUpstreamLogger returns the logger of a new upstream connection.
+func newUpstreamLogger(network *network) Logger {
+	return network.logger.With("conn", atomic.AddUint64(&lastConnID, 1))
 }
 
 func connectToUpstream(network *network) (*upstreamConn, error) {
-	logger := &prefixLogger{network.user.logger, fmt.Sprintf("upstream %q: ", network.GetName())}
+	logger := newUpstreamLogger(network)
 
 	dialer := net.Dialer{Timeout: connectTimeout}
 
@@ -190,14 +201,24 @@ func connectToUpstream(network *network) (*upstreamConn, error) {
 		return nil, fmt.Errorf("failed to dial %q: unknown scheme: %v", network.Addr, u.Scheme)
 	}
 
+	return newUpstreamConn(network, netConn, nil, logger), nil
+}
+
+// newUpstreamConn creates an upstream connection. buffered contains data
+// already received from the server but not processed yet.
+func newUpstreamConn(network *network, netConn net.Conn, buffered []byte, logger Logger) *upstreamConn {
 	options := connOptions{
 		Logger:         logger,
 		RateLimitDelay: upstreamMessageDelay,
 		RateLimitBurst: upstreamMessageBurst,
+		Trace:          network.isTraced(),
 	}
 
+	ircConn := newBufferedIRCConn(netConn, buffered)
 	uc := &upstreamConn{
-		conn:                  *newConn(network.user.srv, newNetIRCConn(netConn), &options),
+		conn:                  *newConn(network.user.srv, ircConn, &options),
+		netConn:               netConn,
+		ircConn:               ircConn,
 		network:               network,
 		user:                  network.user,
 		channels:              upstreamChannelCasemapMap{newCasemapMap(0)},
@@ -210,7 +231,7 @@ func connectToUpstream(network *network) (*upstreamConn, error) {
 		isupport:              make(map[string]*string),
 		pendingCmds:           make(map[string][]pendingUpstreamCommand),
 	}
-	return uc, nil
+	return uc
 }
 
 func (uc *upstreamConn) forEachDownstream(f func(*downstreamConn)) {
@@ -262,7 +283,7 @@ func (uc *upstreamConn) endPendingCommands() {
 			switch pendingCmd.msg.Command {
 			case "LIST":
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: irc.RPL_LISTEND,
 					Params:  []string{dc.nick, "End of /LIST"},
 				})
@@ -272,7 +293,7 @@ func (uc *upstreamConn) endPendingCommands() {
 					mask = pendingCmd.msg.Params[0]
 				}
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: irc.RPL_ENDOFWHO,
 					Params:  []string{dc.nick, mask, "End of /WHO"},
 				})
@@ -407,22 +428,44 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		}
 
 		if msg.Prefix.Name == serviceNick {
-			uc.logger.Printf("skipping %v from soju's service: %v", msg.Command, msg)
+			uc.logger.Debugf("skipping %v from soju's service: %v", msg.Command, msg)
 			break
 		}
 		if entity == serviceNick {
-			uc.logger.Printf("skipping %v to soju's service: %v", msg.Command, msg)
+			uc.logger.Debugf("skipping %v to soju's service: %v", msg.Command, msg)
 			break
 		}
 
 		if msg.Prefix.User == "" && msg.Prefix.Host == "" { // server message
 			uc.produce("", msg, nil)
 		} else { // regular user message
+			if !uc.isOurNick(msg.Prefix.Name) && uc.network.isIgnored(msg.Prefix) {
+				break
+			}
+
 			target := entity
 			if uc.isOurNick(target) {
 				target = msg.Prefix.Name
 			}
 
+			if msg.Command != "TAGMSG" && !uc.isOurNick(msg.Prefix.Name) {
+				var event string
+				if uc.isOurNick(entity) {
+					event = webhookEventMessage
+				} else if uc.isChannel(entity) && uc.network.isHighlight(msg) {
+					event = webhookEventHighlight
+				}
+				if event != "" {
+					uc.user.notifyWebhooks(&webhookPayload{
+						Event:   event,
+						Network: uc.network.GetName(),
+						Target:  target,
+						Sender:  msg.Prefix.Name,
+						Text:    text,
+					})
+				}
+			}
+
 			ch := uc.network.channels.Value(target)
 			if ch != nil && msg.Command != "TAGMSG" {
 				if ch.Detached {
@@ -430,7 +473,8 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				}
 
 				highlight := uc.network.isHighlight(msg)
-				if ch.DetachOn == FilterMessage || ch.DetachOn == FilterDefault || (ch.DetachOn == FilterHighlight && highlight) {
+				detachOn := uc.network.channelSettings(ch).DetachOn
+				if detachOn == FilterMessage || (detachOn == FilterHighlight && highlight) {
 					uc.updateChannelAutoDetach(target)
 				}
 			}
@@ -508,7 +552,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				})
 			}
 		default:
-			uc.logger.Printf("unhandled message: %v", msg)
+			uc.logger.Debugf("unhandled message: %v", msg)
 		}
 	case "AUTHENTICATE":
 		if uc.saslClient == nil {
@@ -618,71 +662,16 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			return err
 		}
 
-		var downstreamIsupport []string
-		for _, token := range msg.Params[1 : len(msg.Params)-1] {
-			parameter := token
-			var negate, hasValue bool
-			var value string
-			if strings.HasPrefix(token, "-") {
-				negate = true
-				token = token[1:]
-			} else if i := strings.IndexByte(token, '='); i >= 0 {
-				parameter = token[:i]
-				value = token[i+1:]
-				hasValue = true
-			}
-
-			if hasValue {
-				uc.isupport[parameter] = &value
-			} else if !negate {
-				uc.isupport[parameter] = nil
-			} else {
-				delete(uc.isupport, parameter)
-			}
-
-			var err error
-			switch parameter {
-			case "CASEMAPPING":
-				casemap, ok := parseCasemappingToken(value)
-				if !ok {
-					casemap = casemapRFC1459
-				}
-				uc.network.updateCasemapping(casemap)
-				uc.nickCM = uc.network.casemap(uc.nick)
-				uc.casemapIsSet = true
-			case "CHANMODES":
-				if !negate {
-					err = uc.handleChanModes(value)
-				} else {
-					uc.availableChannelModes = stdChannelModes
-				}
-			case "CHANTYPES":
-				if !negate {
-					uc.availableChannelTypes = value
-				} else {
-					uc.availableChannelTypes = stdChannelTypes
-				}
-			case "PREFIX":
-				if !negate {
-					err = uc.handleMemberships(value)
-				} else {
-					uc.availableMemberships = stdMemberships
-				}
-			}
-			if err != nil {
-				return err
-			}
-
-			if passthroughIsupport[parameter] {
-				downstreamIsupport = append(downstreamIsupport, token)
-			}
+		downstreamIsupport, err := uc.handleIsupport(msg.Params[1 : len(msg.Params)-1])
+		if err != nil {
+			return err
 		}
 
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			if dc.network == nil {
 				return
 			}
-			msgs := generateIsupport(dc.srv.prefix(), dc.nick, downstreamIsupport)
+			msgs := generateIsupport(dc.srvPrefix(), dc.nick, downstreamIsupport)
 			for _, msg := range msgs {
 				dc.SendMessage(msg)
 			}
@@ -705,7 +694,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			dc.SendMessage(&irc.Message{
-				Prefix:  uc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: msg.Command,
 				Params:  msg.Params,
 			})
@@ -1061,7 +1050,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 					params = append(params, modeParams...)
 
 					dc.SendMessage(&irc.Message{
-						Prefix:  dc.srv.prefix(),
+						Prefix:  dc.srvPrefix(),
 						Command: irc.RPL_CHANNELMODEIS,
 						Params:  params,
 					})
@@ -1084,7 +1073,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		if firstCreationTime {
 			uc.forEachDownstream(func(dc *downstreamConn) {
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: rpl_creationtime,
 					Params:  []string{dc.nick, dc.marshalEntity(uc.network, ch.Name), creationTime},
 				})
@@ -1110,7 +1099,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			uc.forEachDownstream(func(dc *downstreamConn) {
 				topicWho := dc.marshalUserPrefix(uc.network, ch.TopicWho)
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: rpl_topicwhotime,
 					Params: []string{
 						dc.nick,
@@ -1135,7 +1124,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		}
 
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_LIST,
 			Params:  []string{dc.nick, dc.marshalEntity(uc.network, channel), clients, topic},
 		})
@@ -1148,7 +1137,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		}
 
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_LISTEND,
 			Params:  []string{dc.nick, "End of /LIST"},
 		})
@@ -1171,7 +1160,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				memberStr := strings.Join(members, " ")
 
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: irc.RPL_NAMREPLY,
 					Params:  []string{dc.nick, statusStr, channel, memberStr},
 				})
@@ -1202,7 +1191,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				channel := dc.marshalEntity(uc.network, name)
 
 				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
+					Prefix:  dc.srvPrefix(),
 					Command: irc.RPL_ENDOFNAMES,
 					Params:  []string{dc.nick, channel, "End of /NAMES list"},
 				})
@@ -1252,7 +1241,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		}
 		nick = dc.marshalEntity(uc.network, nick)
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_WHOREPLY,
 			Params:  []string{dc.nick, channel, username, host, server, nick, mode, trailing},
 		})
@@ -1284,7 +1273,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			mask = cmd.Params[0]
 		}
 		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
+			Prefix:  dc.srvPrefix(),
 			Command: irc.RPL_ENDOFWHO,
 			Params:  []string{dc.nick, mask, "End of /WHO list"},
 		})
@@ -1297,7 +1286,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			nick := dc.marshalEntity(uc.network, nick)
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISUSER,
 				Params:  []string{dc.nick, nick, username, host, "*", realname},
 			})
@@ -1311,7 +1300,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			nick := dc.marshalEntity(uc.network, nick)
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISSERVER,
 				Params:  []string{dc.nick, nick, server, serverInfo},
 			})
@@ -1325,7 +1314,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			nick := dc.marshalEntity(uc.network, nick)
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISOPERATOR,
 				Params:  []string{dc.nick, nick, "is an IRC operator"},
 			})
@@ -1341,7 +1330,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			params := []string{dc.nick, nick}
 			params = append(params, msg.Params[2:]...)
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISIDLE,
 				Params:  params,
 			})
@@ -1363,7 +1352,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			}
 			channels := strings.Join(channelList, " ")
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_WHOISCHANNELS,
 				Params:  []string{dc.nick, nick, channels},
 			})
@@ -1377,7 +1366,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			nick := dc.marshalEntity(uc.network, nick)
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_ENDOFWHOIS,
 				Params:  []string{dc.nick, nick, "End of /WHOIS list"},
 			})
@@ -1408,7 +1397,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_INVITING,
 				Params:  []string{dc.nick, dc.marshalEntity(uc.network, nick), dc.marshalEntity(uc.network, channel)},
 			})
@@ -1421,7 +1410,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: irc.RPL_AWAY,
 				Params:  []string{dc.nick, dc.marshalEntity(uc.network, nick), reason},
 			})
@@ -1461,7 +1450,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			}
 
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: msg.Command,
 				Params:  params,
 			})
@@ -1475,7 +1464,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			upstreamChannel := dc.marshalEntity(uc.network, channel)
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: msg.Command,
 				Params:  []string{dc.nick, upstreamChannel, trailing},
 			})
@@ -1495,7 +1484,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			dc.SendMessage(&irc.Message{
-				Prefix:  uc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: msg.Command,
 				Params:  []string{dc.nick, command, reason},
 			})
@@ -1521,7 +1510,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			dc.SendMessage(&irc.Message{
-				Prefix:  uc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: msg.Command,
 				Params:  msg.Params,
 			})
@@ -1541,7 +1530,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		}
 		fallthrough
 	default:
-		uc.logger.Printf("unhandled message: %v", msg)
+		uc.logger.Debugf("unhandled message: %v", msg)
 
 		uc.forEachDownstreamByID(downstreamID, func(dc *downstreamConn) {
 			// best effort marshaling for unknown messages, replies and errors:
@@ -1554,7 +1543,7 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				}
 			}
 			dc.SendMessage(&irc.Message{
-				Prefix:  uc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: msg.Command,
 				Params:  params,
 			})
@@ -1569,12 +1558,78 @@ func (uc *upstreamConn) handleDetachedMessage(ch *Channel, msg *irc.Message) {
 			dc.relayDetachedMessage(uc.network, msg)
 		})
 	}
-	if ch.ReattachOn == FilterMessage || (ch.ReattachOn == FilterHighlight && uc.network.isHighlight(msg)) {
+	reattachOn := uc.network.channelSettings(ch).ReattachOn
+	if reattachOn == FilterMessage || (reattachOn == FilterHighlight && uc.network.isHighlight(msg)) {
 		uc.network.attach(ch)
 		if err := uc.srv.db.StoreChannel(context.TODO(), uc.network.ID, ch); err != nil {
-			uc.logger.Printf("failed to update channel %q: %v", ch.Name, err)
+			uc.logger.Errorf("failed to update channel %q: %v", ch.Name, err)
+		}
+	}
+}
+
+// handleIsupport applies RPL_ISUPPORT tokens. It returns the tokens which
+// should be forwarded to downstream connections.
+func (uc *upstreamConn) handleIsupport(tokens []string) ([]string, error) {
+	var downstreamIsupport []string
+	for _, token := range tokens {
+		parameter := token
+		var negate, hasValue bool
+		var value string
+		if strings.HasPrefix(token, "-") {
+			negate = true
+			token = token[1:]
+		} else if i := strings.IndexByte(token, '='); i >= 0 {
+			parameter = token[:i]
+			value = token[i+1:]
+			hasValue = true
+		}
+
+		if hasValue {
+			uc.isupport[parameter] = &value
+		} else if !negate {
+			uc.isupport[parameter] = nil
+		} else {
+			delete(uc.isupport, parameter)
+		}
+
+		var err error
+		switch parameter {
+		case "CASEMAPPING":
+			casemap, ok := parseCasemappingToken(value)
+			if !ok {
+				casemap = casemapRFC1459
+			}
+			uc.network.updateCasemapping(casemap)
+			uc.nickCM = uc.network.casemap(uc.nick)
+			uc.casemapIsSet = true
+		case "CHANMODES":
+			if !negate {
+				err = uc.handleChanModes(value)
+			} else {
+				uc.availableChannelModes = stdChannelModes
+			}
+		case "CHANTYPES":
+			if !negate {
+				uc.availableChannelTypes = value
+			} else {
+				uc.availableChannelTypes = stdChannelTypes
+			}
+		case "PREFIX":
+			if !negate {
+				err = uc.handleMemberships(value)
+			} else {
+				uc.availableMemberships = stdMemberships
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if passthroughIsupport[parameter] {
+			downstreamIsupport = append(downstreamIsupport, token)
 		}
 	}
+	return downstreamIsupport, nil
 }
 
 func (uc *upstreamConn) handleChanModes(s string) error {
@@ -1767,7 +1822,7 @@ func (uc *upstreamConn) runUntilRegistered() error {
 	for _, command := range uc.network.ConnectCommands {
 		m, err := irc.ParseMessage(command)
 		if err != nil {
-			uc.logger.Printf("failed to parse connect command %q: %v", command, err)
+			uc.logger.Errorf("failed to parse connect command %q: %v", command, err)
 		} else {
 			uc.SendMessage(m)
 		}
@@ -1838,7 +1893,7 @@ func (uc *upstreamConn) appendLog(entity string, msg *irc.Message) (msgID string
 		// in the backlog if an offline client reconnects.
 		lastID, err := uc.user.msgStore.LastMsgID(&uc.network.Network, entityCM, time.Now())
 		if err != nil {
-			uc.logger.Printf("failed to log message: failed to get last message ID: %v", err)
+			uc.logger.Errorf("failed to log message: failed to get last message ID: %v", err)
 			return ""
 		}
 
@@ -1848,8 +1903,18 @@ func (uc *upstreamConn) appendLog(entity string, msg *irc.Message) (msgID string
 	}
 
 	msgID, err := uc.user.msgStore.Append(&uc.network.Network, entityCM, msg)
-	if err != nil {
-		uc.logger.Printf("failed to log message: %v", err)
+	if err == errMessageStoreFull {
+		// Only warn once, until the quota is updated
+		if !uc.user.logQuotaExceeded {
+			uc.user.logQuotaExceeded = true
+			uc.logger.Errorf("failed to log message: %v", err)
+			uc.user.forEachDownstream(func(dc *downstreamConn) {
+				sendServiceNOTICE(dc, "message log quota exceeded, new messages won't be saved")
+			})
+		}
+		return ""
+	} else if err != nil {
+		uc.logger.Errorf("failed to log message: %v", err)
 		return ""
 	}
 
@@ -1910,5 +1975,5 @@ func (uc *upstreamConn) updateChannelAutoDetach(name string) {
 	if ch == nil || ch.Detached {
 		return
 	}
-	uch.updateAutoDetach(ch.DetachAfter)
+	uch.updateAutoDetach(uc.network.channelSettings(ch).DetachAfter)
 }
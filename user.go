@@ -6,6 +6,8 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/irc.v3"
@@ -60,20 +62,83 @@ type eventBroadcast struct {
 
 type eventStop struct{}
 
+type eventHandover struct {
+	done chan<- []*UpstreamHandover
+}
+
+type eventUpstreamHandover struct {
+	uc *upstreamConn
+}
+
+type eventClientExpiry struct{}
+
+type eventConfigUpdate struct{}
+
+type eventAdminNotice struct {
+	text string
+}
+
 type eventUserUpdate struct {
 	password *string
 	admin    *bool
+	quotas   userQuotasUpdate
 	done     chan error
 }
 
+// States of an eventServiceCommand, see runServiceCommandAsUser.
+const (
+	serviceCommandPending int32 = iota
+	serviceCommandStarted
+	serviceCommandCanceled
+)
+
+type eventServiceCommand struct {
+	ctx        context.Context
+	downstream *downstreamConn
+	handle     func(ctx context.Context, dc *serviceContext, params []string) error
+	params     []string
+	state      *int32 // accessed atomically
+	done       chan error
+}
+
+type eventPause struct {
+	paused chan<- struct{}
+	resume <-chan struct{}
+}
+
+type eventSessionList struct {
+	done chan []sessionInfo
+}
+
+type eventSessionKick struct {
+	id   uint64
+	done chan bool
+}
+
+// sessionInfo describes a registered downstream connection.
+type sessionInfo struct {
+	ID          uint64
+	Username    string
+	ClientName  string
+	Network     string // empty if not bound to a network
+	Transport   string
+	RemoteAddr  string
+	Caps        []string
+	ConnectedAt time.Time
+}
+
 type deliveredClientMap map[string]string // client name -> msg ID
 
 type deliveredStore struct {
-	m deliveredCasemapMap
+	m    deliveredCasemapMap
+	seen map[string]time.Time // client name -> last seen time
 }
 
 func newDeliveredStore() deliveredStore {
-	return deliveredStore{deliveredCasemapMap{newCasemapMap(0)}}
+	return deliveredStore{
+		m:    deliveredCasemapMap{newCasemapMap(0)},
+		seen: make(map[string]time.Time),
+	}
 }
 
 func (ds deliveredStore) HasTarget(target string) bool {
@@ -117,21 +182,42 @@ func (ds deliveredStore) ForEachClient(f func(clientName string)) {
 	}
 }
 
+// ForgetClient removes all delivery receipts of a client.
+func (ds deliveredStore) ForgetClient(clientName string) {
+	for _, entry := range ds.m.innerMap {
+		delivered := entry.value.(deliveredClientMap)
+		delete(delivered, clientName)
+	}
+	delete(ds.seen, clientName)
+}
+
+func (ds deliveredStore) LastSeen(clientName string) time.Time {
+	return ds.seen[clientName]
+}
+
+func (ds deliveredStore) MarkSeen(clientName string, t time.Time) {
+	if t.After(ds.seen[clientName]) {
+		ds.seen[clientName] = t
+	}
+}
+
 type network struct {
 	Network
 	user    *user
 	logger  Logger
 	stopped chan struct{}
-
-	conn      *upstreamConn
-	channels  channelCasemapMap
-	delivered deliveredStore
-	lastError error
-	casemap   casemapping
+	trace   int32 // atomic
+
+	conn       *upstreamConn
+	channels   channelCasemapMap
+	delivered  deliveredStore
+	lastError  error
+	casemap    casemapping
+	highlights []*highlightPattern
 }
 
 func newNetwork(user *user, record *Network, channels []Channel) *network {
-	logger := &prefixLogger{user.logger, fmt.Sprintf("network %q: ", record.GetName())}
+	logger := user.logger.With("network", record.GetName())
 
 	m := channelCasemapMap{newCasemapMap(0)}
 	for _, ch := range channels {
@@ -139,7 +225,7 @@ func newNetwork(user *user, record *Network, channels []Channel) *network {
 		m.SetValue(ch.Name, &ch)
 	}
 
-	return &network{
+	net := &network{
 		Network:   *record,
 		user:      user,
 		logger:    logger,
@@ -148,6 +234,30 @@ func newNetwork(user *user, record *Network, channels []Channel) *network {
 		delivered: newDeliveredStore(),
 		casemap:   casemapRFC1459,
 	}
+	net.updateHighlights()
+	return net
+}
+
+// updateHighlights compiles the user and network custom highlight patterns.
+// It needs to be called whenever these change.
+func (net *network) updateHighlights() {
+	patterns := append(append([]string(nil), net.user.Highlights...), net.Highlights...)
+
+	net.highlights = nil
+	for _, s := range patterns {
+		p, err := parseHighlightPattern(s)
+		if err != nil {
+			net.logger.Printf("ignoring highlight pattern: %v", err)
+			continue
+		}
+		net.highlights = append(net.highlights, p)
+	}
+}
+
+// isTraced checks whether protocol tracing is enabled for this network, either
+// directly or via its user. It is safe to call from any goroutine.
+func (net *network) isTraced() bool {
+	return atomic.LoadInt32(&net.trace) != 0 || atomic.LoadInt32(&net.user.trace) != 0
 }
 
 func (net *network) forEachDownstream(f func(*downstreamConn)) {
@@ -182,60 +292,98 @@ func userIdent(u *User) string {
 	return hex.EncodeToString(h[:16])
 }
 
+// ident returns the reply to ident queries for connections to this network.
+func (net *network) ident() string {
+	if net.Ident != "" {
+		return net.Ident
+	}
+	return userIdent(&net.user.User)
+}
+
 func (net *network) run() {
+	handover := net.user.srv.takeHandover(net.user.Username, net.ID)
 	if !net.Enabled {
+		if handover != nil {
+			handover.File.Close()
+		}
 		return
 	}
 
 	var lastTry time.Time
 	for {
 		if net.isStopped() {
+			if handover != nil {
+				handover.File.Close()
+			}
 			return
 		}
 
-		if dur := time.Now().Sub(lastTry); dur < retryConnectDelay {
-			delay := retryConnectDelay - dur
-			net.logger.Printf("waiting %v before trying to reconnect to %q", delay.Truncate(time.Second), net.Addr)
-			time.Sleep(delay)
-		}
-		lastTry = time.Now()
+		var uc *upstreamConn
+		var err error
+		if handover != nil {
+			uc, err = adoptUpstream(net, handover)
+			handover = nil
+			if err != nil {
+				net.logger.Errorf("failed to adopt upstream connection: %v", err)
+				continue
+			}
+		} else {
+			if dur := time.Now().Sub(lastTry); dur < retryConnectDelay {
+				delay := retryConnectDelay - dur
+				net.logger.Printf("waiting %v before trying to reconnect to %q", delay.Truncate(time.Second), net.Addr)
+				time.Sleep(delay)
+			}
+			lastTry = time.Now()
 
-		uc, err := connectToUpstream(net)
-		if err != nil {
-			net.logger.Printf("failed to connect to upstream server %q: %v", net.Addr, err)
-			net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("failed to connect: %v", err)}
-			continue
+			uc, err = connectToUpstream(net)
+			if err != nil {
+				net.logger.Errorf("failed to connect to upstream server %q: %v", net.Addr, err)
+				net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("failed to connect: %v", err)}
+				continue
+			}
 		}
 
 		if net.user.srv.Identd != nil {
-			net.user.srv.Identd.Store(uc.RemoteAddr().String(), uc.LocalAddr().String(), userIdent(&net.user.User))
+			if err := net.user.srv.Identd.Store(uc.RemoteAddr().String(), uc.LocalAddr().String(), net.ident()); err != nil {
+				net.logger.Errorf("failed to store ident: %v", err)
+			}
 		}
 
-		uc.register()
-		if err := uc.runUntilRegistered(); err != nil {
-			text := err.Error()
-			if regErr, ok := err.(registrationError); ok {
-				text = string(regErr)
+		if !uc.registered {
+			uc.register()
+			if err := uc.runUntilRegistered(); err != nil {
+				text := err.Error()
+				if regErr, ok := err.(registrationError); ok {
+					text = string(regErr)
+				}
+				uc.logger.Errorf("failed to register: %v", text)
+				net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("failed to register: %v", text)}
+				uc.Close()
+				continue
 			}
-			uc.logger.Printf("failed to register: %v", text)
-			net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("failed to register: %v", text)}
-			uc.Close()
-			continue
 		}
 
 		// TODO: this is racy with net.stopped. If the network is stopped
 		// before the user goroutine receives eventUpstreamConnected, the
 		// connection won't be closed.
 		net.user.events <- eventUpstreamConnected{uc}
-		if err := uc.readMessages(net.user.events); err != nil {
-			uc.logger.Printf("failed to handle messages: %v", err)
+		err = uc.readMessages(net.user.events)
+		if uc.isHandingOver() {
+			// The user goroutine takes care of the connection from now on
+			net.user.events <- eventUpstreamHandover{uc}
+			return
+		}
+		if err != nil {
+			uc.logger.Errorf("failed to handle messages: %v", err)
 			net.user.events <- eventUpstreamError{uc, fmt.Errorf("failed to handle messages: %v", err)}
 		}
 		uc.Close()
 		net.user.events <- eventUpstreamDisconnected{uc}
 
 		if net.user.srv.Identd != nil {
-			net.user.srv.Identd.Delete(uc.RemoteAddr().String(), uc.LocalAddr().String())
+			if err := net.user.srv.Identd.Delete(uc.RemoteAddr().String(), uc.LocalAddr().String()); err != nil {
+				net.logger.Errorf("failed to delete ident: %v", err)
+			}
 		}
 	}
 }
@@ -263,7 +411,7 @@ func (net *network) detach(ch *Channel) {
 		nameCM := net.casemap(ch.Name)
 		lastID, err := net.user.msgStore.LastMsgID(&net.Network, nameCM, time.Now())
 		if err != nil {
-			net.logger.Printf("failed to get last message ID for channel %q: %v", ch.Name, err)
+			net.logger.Errorf("failed to get last message ID for channel %q: %v", ch.Name, err)
 		}
 		ch.DetachedInternalMsgID = lastID
 	}
@@ -319,6 +467,13 @@ func (net *network) attach(ch *Channel) {
 	})
 }
 
+// channelQuotaExceeded checks whether saving a new channel would exceed the
+// channel quota of the user.
+func (net *network) channelQuotaExceeded(name string) bool {
+	max := net.user.quotas().MaxChannels
+	return max >= 0 && net.channels.Value(name) == nil && net.channels.Len() >= max
+}
+
 func (net *network) deleteChannel(ctx context.Context, name string) error {
 	ch := net.channels.Value(name)
 	if ch == nil {
@@ -365,12 +520,64 @@ func (net *network) storeClientDeliveryReceipts(clientName string) {
 		receipts = append(receipts, DeliveryReceipt{
 			Target:        target,
 			InternalMsgID: msgID,
+			UpdatedAt:     net.delivered.LastSeen(clientName),
 		})
 	})
 
 	if err := net.user.srv.db.StoreClientDeliveryReceipts(context.TODO(), net.ID, clientName, receipts); err != nil {
-		net.logger.Printf("failed to store delivery receipts for client %q: %v", clientName, err)
+		net.logger.Errorf("failed to store delivery receipts for client %q: %v", clientName, err)
+	}
+}
+
+// hasClient checks whether a client with the specified name is connected to
+// the network.
+func (net *network) hasClient(clientName string) bool {
+	found := false
+	net.user.forEachDownstream(func(dc *downstreamConn) {
+		if dc.clientName != clientName {
+			return
+		}
+		dc.forEachNetwork(func(n *network) {
+			if n == net {
+				found = true
+			}
+		})
+	})
+	return found
+}
+
+// forgetClient removes the delivery receipts of a client, so that it won't
+// receive any backlog on its next connection.
+func (net *network) forgetClient(clientName string) {
+	net.delivered.ForgetClient(clientName)
+	net.storeClientDeliveryReceipts(clientName)
+}
+
+// fastForwardClient marks all messages as delivered to a client.
+func (net *network) fastForwardClient(clientName string) error {
+	if net.user.msgStore == nil {
+		return fmt.Errorf("message store is disabled")
+	}
+
+	var err error
+	net.delivered.ForEachTarget(func(target string) {
+		if err != nil || net.delivered.LoadID(target, clientName) == "" {
+			return
+		}
+
+		var lastID string
+		lastID, err = net.user.msgStore.LastMsgID(&net.Network, net.casemap(target), time.Now())
+		if err != nil {
+			return
+		}
+		net.delivered.StoreID(target, clientName, lastID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get last message ID: %v", err)
 	}
+
+	net.storeClientDeliveryReceipts(clientName)
+	return nil
 }
 
 func (net *network) isHighlight(msg *irc.Message) bool {
@@ -386,12 +593,48 @@ func (net *network) isHighlight(msg *irc.Message) bool {
 	}
 
 	// TODO: use case-mapping aware comparison here
-	return msg.Prefix.Name != nick && isHighlight(text, nick)
+	if msg.Prefix.Name == nick {
+		return false
+	}
+	if isHighlight(text, nick) {
+		return true
+	}
+	for _, p := range net.highlights {
+		if p.match(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnored checks whether the sender of a message matches one of the user or
+// network ignore masks.
+func (net *network) isIgnored(prefix *irc.Prefix) bool {
+	if prefix == nil {
+		return false
+	}
+
+	s := net.casemap(prefix.Name + "!" + prefix.User + "@" + prefix.Host)
+	for _, masks := range [][]string{net.user.Ignores, net.Ignores} {
+		for _, mask := range masks {
+			if matchMask(net.casemap(mask), s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// channelSettings returns the effective settings of a channel, resolving
+// default values against the network and user defaults.
+func (net *network) channelSettings(ch *Channel) ChannelSettings {
+	return resolveChannelSettings(ch.ChannelSettings, net.ChannelDefaults, net.user.ChannelDefaults)
 }
 
 func (net *network) detachedMessageNeedsRelay(ch *Channel, msg *irc.Message) bool {
 	highlight := net.isHighlight(msg)
-	return ch.RelayDetached == FilterMessage || ((ch.RelayDetached == FilterHighlight || ch.RelayDetached == FilterDefault) && highlight)
+	relayDetached := net.channelSettings(ch).RelayDetached
+	return relayDetached == FilterMessage || (relayDetached == FilterHighlight && highlight)
 }
 
 type user struct {
@@ -405,26 +648,125 @@ type user struct {
 	networks        []*network
 	downstreamConns []*downstreamConn
 	msgStore        messageStore
+	webhooks        []Webhook
+	webhookSender   *webhookSender
+
+	downstreamCount  int64 // atomic
+	maxDownstreams   int64 // atomic
+	trace            int32 // atomic
+	logQuotaExceeded bool
+
+	// Upstream connections being handed over to another process
+	handovers       []*UpstreamHandover
+	handoverPending int
+	handoverDone    chan<- []*UpstreamHandover
 }
 
 func newUser(srv *Server, record *User) *user {
-	logger := &prefixLogger{srv.Logger, fmt.Sprintf("user %q: ", record.Username)}
+	logger := srv.Logger.With("user", record.Username)
 
 	var msgStore messageStore
-	if srv.LogPath != "" {
-		msgStore = newFSMessageStore(srv.LogPath, record.Username)
+	if srv.Config().LogPath != "" {
+		msgStore = newFSMessageStore(srv.Config().LogPath, record.Username)
 	} else {
 		msgStore = newMemoryMessageStore()
 	}
 
-	return &user{
-		User:     *record,
-		srv:      srv,
-		logger:   logger,
-		events:   make(chan event, 64),
-		done:     make(chan struct{}),
-		msgStore: msgStore,
+	u := &user{
+		User:          *record,
+		srv:           srv,
+		logger:        logger,
+		events:        make(chan event, 64),
+		done:          make(chan struct{}),
+		msgStore:      msgStore,
+		webhookSender: newWebhookSender(logger, webhookClient),
+	}
+	u.updateQuotas()
+	return u
+}
+
+// isDownstreamTraced checks whether protocol tracing is enabled for a
+// downstream connection. Connections bound to a single network are traced
+// along with that network.
+func (u *user) isDownstreamTraced(dc *downstreamConn) bool {
+	if dc.network != nil {
+		return dc.network.isTraced()
 	}
+	return atomic.LoadInt32(&u.trace) != 0
+}
+
+// updateTrace applies the protocol tracing settings of the user and its
+// networks to the existing connections.
+func (u *user) updateTrace() {
+	for _, net := range u.networks {
+		if net.conn != nil {
+			net.conn.SetTrace(net.isTraced())
+		}
+	}
+	for _, dc := range u.downstreamConns {
+		dc.SetTrace(u.isDownstreamTraced(dc))
+	}
+}
+
+// quotas returns the effective quotas of the user, with the server defaults
+// filled in.
+func (u *user) quotas() UserQuotas {
+	return effectiveQuotas(&u.User, u.srv.Config())
+}
+
+// effectiveQuotas returns the quotas of a user, falling back to the server
+// defaults.
+func effectiveQuotas(record *User, cfg *Config) UserQuotas {
+	q := record.Quotas
+	if q.MaxChannels == 0 {
+		q.MaxChannels = cfg.MaxUserChannels
+	}
+	if q.MaxDownstreams == 0 {
+		q.MaxDownstreams = cfg.MaxUserDownstreams
+	}
+	if q.MaxLogSize == 0 {
+		q.MaxLogSize = cfg.MaxUserLogSize
+	}
+	if q.MaxConnectCommands == 0 {
+		q.MaxConnectCommands = cfg.MaxUserConnectCommands
+	}
+	return q
+}
+
+// updateQuotas propagates the user's quotas to the parts of the bouncer
+// which enforce them outside of the user goroutine.
+func (u *user) updateQuotas() {
+	q := u.quotas()
+	atomic.StoreInt64(&u.maxDownstreams, int64(q.MaxDownstreams))
+	if ms, ok := u.msgStore.(*fsMessageStore); ok {
+		ms.SetMaxSize(q.MaxLogSize)
+	}
+	u.logQuotaExceeded = false
+}
+
+// flushDeliveryReceipts stores the delivery receipts of all clients in the
+// database.
+func (u *user) flushDeliveryReceipts() {
+	for _, net := range u.networks {
+		net.delivered.ForEachClient(func(clientName string) {
+			net.storeClientDeliveryReceipts(clientName)
+		})
+	}
+}
+
+// acquireDownstream reserves a slot for a new downstream connection. It is
+// safe to call from any goroutine.
+func (u *user) acquireDownstream() bool {
+	n := atomic.AddInt64(&u.downstreamCount, 1)
+	if max := atomic.LoadInt64(&u.maxDownstreams); max >= 0 && n > max {
+		atomic.AddInt64(&u.downstreamCount, -1)
+		return false
+	}
+	return true
+}
+
+func (u *user) releaseDownstream() {
+	atomic.AddInt64(&u.downstreamCount, -1)
 }
 
 func (u *user) forEachNetwork(f func(*network)) {
@@ -473,15 +815,23 @@ func (u *user) run() {
 	defer func() {
 		if u.msgStore != nil {
 			if err := u.msgStore.Close(); err != nil {
-				u.logger.Printf("failed to close message store for user %q: %v", u.Username, err)
+				u.logger.Errorf("failed to close message store for user %q: %v", u.Username, err)
 			}
 		}
+		u.webhookSender.Close()
 		close(u.done)
 	}()
 
+	webhooks, err := u.srv.db.ListWebhooks(context.TODO(), u.ID)
+	if err != nil {
+		u.logger.Errorf("failed to list webhooks for user %q: %v", u.Username, err)
+		return
+	}
+	u.webhooks = webhooks
+
 	networks, err := u.srv.db.ListNetworks(context.TODO(), u.ID)
 	if err != nil {
-		u.logger.Printf("failed to list networks for user %q: %v", u.Username, err)
+		u.logger.Errorf("failed to list networks for user %q: %v", u.Username, err)
 		return
 	}
 
@@ -489,7 +839,7 @@ func (u *user) run() {
 		record := record
 		channels, err := u.srv.db.ListChannels(context.TODO(), record.ID)
 		if err != nil {
-			u.logger.Printf("failed to list channels for user %q, network %q: %v", u.Username, record.GetName(), err)
+			u.logger.Errorf("failed to list channels for user %q, network %q: %v", u.Username, record.GetName(), err)
 			continue
 		}
 
@@ -499,17 +849,30 @@ func (u *user) run() {
 		if u.hasPersistentMsgStore() {
 			receipts, err := u.srv.db.ListDeliveryReceipts(context.TODO(), record.ID)
 			if err != nil {
-				u.logger.Printf("failed to load delivery receipts for user %q, network %q: %v", u.Username, network.GetName(), err)
+				u.logger.Errorf("failed to load delivery receipts for user %q, network %q: %v", u.Username, network.GetName(), err)
 				return
 			}
 
+			now := time.Now()
 			for _, rcpt := range receipts {
 				network.delivered.StoreID(rcpt.Target, rcpt.Client, rcpt.InternalMsgID)
+
+				// Receipts stored before last seen times were recorded
+				// count as seen now
+				seen := rcpt.UpdatedAt
+				if seen.IsZero() {
+					seen = now
+				}
+				network.delivered.MarkSeen(rcpt.Client, seen)
 			}
 		}
 
 		go network.run()
 	}
+	u.srv.discardHandovers(u)
+
+	u.expireClients()
+	go u.runClientExpiry()
 
 	for e := range u.events {
 		switch e := e.(type) {
@@ -534,7 +897,7 @@ func (u *user) run() {
 			u.forEachDownstream(func(dc *downstreamConn) {
 				if dc.caps["soju.im/bouncer-networks-notify"] {
 					dc.SendMessage(&irc.Message{
-						Prefix:  dc.srv.prefix(),
+						Prefix:  dc.srvPrefix(),
 						Command: "BOUNCER",
 						Params:  []string{"NETWORK", netIDStr, "state=connected"},
 					})
@@ -557,6 +920,11 @@ func (u *user) run() {
 				net.forEachDownstream(func(dc *downstreamConn) {
 					sendServiceNOTICE(dc, fmt.Sprintf("failed connecting/registering to %s: %v", net.GetName(), e.err))
 				})
+				u.notifyWebhooks(&webhookPayload{
+					Event:   webhookEventDisconnected,
+					Network: net.GetName(),
+					Error:   e.err.Error(),
+				})
 			}
 			net.lastError = e.err
 		case eventUpstreamError:
@@ -569,11 +937,11 @@ func (u *user) run() {
 		case eventUpstreamMessage:
 			msg, uc := e.msg, e.uc
 			if uc.isClosed() {
-				uc.logger.Printf("ignoring message on closed connection: %v", msg)
+				uc.logger.Debugf("ignoring message on closed connection: %v", msg)
 				break
 			}
 			if err := uc.handleMessage(msg); err != nil {
-				uc.logger.Printf("failed to handle message %q: %v", msg, err)
+				uc.logger.Errorf("failed to handle message %q: %v", msg, err)
 			}
 		case eventChannelDetach:
 			uc, name := e.uc, e.name
@@ -583,13 +951,14 @@ func (u *user) run() {
 			}
 			uc.network.detach(c)
 			if err := uc.srv.db.StoreChannel(context.TODO(), uc.network.ID, c); err != nil {
-				u.logger.Printf("failed to store updated detached channel %q: %v", c.Name, err)
+				u.logger.Errorf("failed to store updated detached channel %q: %v", c.Name, err)
 			}
 		case eventDownstreamConnected:
 			dc := e.dc
 
+			dc.SetTrace(u.isDownstreamTraced(dc))
 			if err := dc.welcome(); err != nil {
-				dc.logger.Printf("failed to handle new registered connection: %v", err)
+				dc.logger.Errorf("failed to handle new registered connection: %v", err)
 				break
 			}
 
@@ -615,6 +984,7 @@ func (u *user) run() {
 			}
 
 			dc.forEachNetwork(func(net *network) {
+				net.delivered.MarkSeen(dc.clientName, time.Now())
 				net.storeClientDeliveryReceipts(dc.clientName)
 			})
 
@@ -624,15 +994,15 @@ func (u *user) run() {
 		case eventDownstreamMessage:
 			msg, dc := e.msg, e.dc
 			if dc.isClosed() {
-				dc.logger.Printf("ignoring message on closed connection: %v", msg)
+				dc.logger.Debugf("ignoring message on closed connection: %v", msg)
 				break
 			}
 			err := dc.handleMessage(msg)
 			if ircErr, ok := err.(ircError); ok {
-				ircErr.Message.Prefix = dc.srv.prefix()
+				ircErr.Message.Prefix = dc.srvPrefix()
 				dc.SendMessage(ircErr.Message)
 			} else if err != nil {
-				dc.logger.Printf("failed to handle message %q: %v", msg, err)
+				dc.logger.Errorf("failed to handle message %q: %v", msg, err)
 				dc.Close()
 			}
 		case eventBroadcast:
@@ -650,6 +1020,7 @@ func (u *user) run() {
 			if e.admin != nil {
 				record.Admin = *e.admin
 			}
+			e.quotas.apply(&record.Quotas)
 
 			e.done <- u.updateUser(context.TODO(), &record)
 
@@ -660,8 +1031,44 @@ func (u *user) run() {
 					dc.Close()
 				})
 			}
+		case eventServiceCommand:
+			// The sender might have stopped waiting for the command
+			if !atomic.CompareAndSwapInt32(e.state, serviceCommandPending, serviceCommandStarted) {
+				break
+			}
+			if err := e.ctx.Err(); err != nil {
+				e.done <- err
+				break
+			}
+			dc := &serviceContext{downstreamConn: e.downstream, user: u}
+			e.done <- e.handle(e.ctx, dc, e.params)
+		case eventPause:
+			u.flushDeliveryReceipts()
+			close(e.paused)
+			<-e.resume
+		case eventSessionList:
+			e.done <- u.listSessions()
+		case eventSessionKick:
+			e.done <- u.kickSession(e.id)
+		case eventAdminNotice:
+			if u.Admin {
+				u.forEachDownstream(func(dc *downstreamConn) {
+					sendServiceNOTICE(dc, e.text)
+				})
+			}
+		case eventClientExpiry:
+			u.expireClients()
+		case eventConfigUpdate:
+			u.updateQuotas()
+		case eventHandover:
+			u.startHandover(e.done)
+		case eventUpstreamHandover:
+			u.handleUpstreamHandover(e.uc)
 		case eventStop:
 			u.forEachDownstream(func(dc *downstreamConn) {
+				dc.forEachNetwork(func(net *network) {
+					net.delivered.MarkSeen(dc.clientName, time.Now())
+				})
 				dc.Close()
 			})
 			for _, n := range u.networks {
@@ -708,13 +1115,22 @@ func (u *user) handleUpstreamDisconnected(uc *upstreamConn) {
 	u.forEachDownstream(func(dc *downstreamConn) {
 		if dc.caps["soju.im/bouncer-networks-notify"] {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "BOUNCER",
 				Params:  []string{"NETWORK", netIDStr, "state=disconnected"},
 			})
 		}
 	})
 
+	payload := webhookPayload{
+		Event:   webhookEventDisconnected,
+		Network: uc.network.GetName(),
+	}
+	if uc.network.lastError != nil {
+		payload.Error = uc.network.lastError.Error()
+	}
+	u.notifyWebhooks(&payload)
+
 	if uc.network.lastError == nil {
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			if !dc.caps["soju.im/bouncer-networks"] {
@@ -749,11 +1165,28 @@ func (u *user) removeNetwork(network *network) {
 }
 
 func (u *user) checkNetwork(record *Network) error {
-	for _, net := range u.networks {
+	networks := make([]Network, len(u.networks))
+	for i, net := range u.networks {
+		networks[i] = net.Network
+	}
+	return CheckNetwork(u.srv.Config(), &u.User, networks, record)
+}
+
+// CheckNetwork checks that a network can be stored for a user, given the
+// existing networks of the user. New networks (with a zero ID) are also
+// checked against the maximum number of networks.
+func CheckNetwork(cfg *Config, user *User, networks []Network, record *Network) error {
+	for _, net := range networks {
 		if net.GetName() == record.GetName() && net.ID != record.ID {
 			return fmt.Errorf("a network with the name %q already exists", record.GetName())
 		}
 	}
+	if max := effectiveQuotas(user, cfg).MaxConnectCommands; max >= 0 && len(record.ConnectCommands) > max {
+		return fmt.Errorf("maximum number of connect commands (%v) exceeded", max)
+	}
+	if record.ID == 0 && cfg.MaxUserNetworks >= 0 && len(networks) >= cfg.MaxUserNetworks {
+		return fmt.Errorf("maximum number of networks reached")
+	}
 	return nil
 }
 
@@ -766,10 +1199,6 @@ func (u *user) createNetwork(ctx context.Context, record *Network) (*network, er
 		return nil, err
 	}
 
-	if u.srv.MaxUserNetworks >= 0 && len(u.networks) >= u.srv.MaxUserNetworks {
-		return nil, fmt.Errorf("maximum number of networks reached")
-	}
-
 	network := newNetwork(u, record, nil)
 	err := u.srv.db.StoreNetwork(ctx, u.ID, &network.Network)
 	if err != nil {
@@ -783,7 +1212,7 @@ func (u *user) createNetwork(ctx context.Context, record *Network) (*network, er
 	u.forEachDownstream(func(dc *downstreamConn) {
 		if dc.caps["soju.im/bouncer-networks-notify"] {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "BOUNCER",
 				Params:  []string{"NETWORK", idStr, attrs.String()},
 			})
@@ -826,6 +1255,7 @@ func (u *user) updateNetwork(ctx context.Context, record *Network) (*network, er
 	}
 
 	updatedNetwork := newNetwork(u, record, channels)
+	atomic.StoreInt32(&updatedNetwork.trace, atomic.LoadInt32(&network.trace))
 
 	// If we're currently connected, disconnect and perform the necessary
 	// bookkeeping
@@ -851,7 +1281,7 @@ func (u *user) updateNetwork(ctx context.Context, record *Network) (*network, er
 	fsMsgStore, isFS := u.msgStore.(*fsMessageStore)
 	if isFS && updatedNetwork.GetName() != network.GetName() {
 		if err := fsMsgStore.RenameNetwork(&network.Network, &updatedNetwork.Network); err != nil {
-			network.logger.Printf("failed to update FS message store network name to %q: %v", updatedNetwork.GetName(), err)
+			network.logger.Errorf("failed to update FS message store network name to %q: %v", updatedNetwork.GetName(), err)
 		}
 	}
 
@@ -864,7 +1294,7 @@ func (u *user) updateNetwork(ctx context.Context, record *Network) (*network, er
 	u.forEachDownstream(func(dc *downstreamConn) {
 		if dc.caps["soju.im/bouncer-networks-notify"] {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "BOUNCER",
 				Params:  []string{"NETWORK", idStr, attrs.String()},
 			})
@@ -890,7 +1320,7 @@ func (u *user) deleteNetwork(ctx context.Context, id int64) error {
 	u.forEachDownstream(func(dc *downstreamConn) {
 		if dc.caps["soju.im/bouncer-networks-notify"] {
 			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
+				Prefix:  dc.srvPrefix(),
 				Command: "BOUNCER",
 				Params:  []string{"NETWORK", idStr, "*"},
 			})
@@ -910,6 +1340,11 @@ func (u *user) updateUser(ctx context.Context, record *User) error {
 		return fmt.Errorf("failed to update user %q: %v", u.Username, err)
 	}
 	u.User = *record
+	u.updateQuotas()
+
+	u.forEachNetwork(func(net *network) {
+		net.updateHighlights()
+	})
 
 	if realnameUpdated {
 		// Re-connect to networks which use the default realname
@@ -946,3 +1381,90 @@ func (u *user) hasPersistentMsgStore() bool {
 	_, isMem := u.msgStore.(*memoryMessageStore)
 	return !isMem
 }
+
+func (u *user) listSessions() []sessionInfo {
+	var sessions []sessionInfo
+	u.forEachDownstream(func(dc *downstreamConn) {
+		var caps []string
+		for name, enabled := range dc.caps {
+			if enabled {
+				caps = append(caps, name)
+			}
+		}
+		sort.Strings(caps)
+
+		var networkName string
+		if dc.network != nil {
+			networkName = dc.network.GetName()
+		}
+
+		sessions = append(sessions, sessionInfo{
+			ID:          dc.id,
+			Username:    u.Username,
+			ClientName:  dc.clientName,
+			Network:     networkName,
+			Transport:   dc.transport(),
+			RemoteAddr:  dc.RemoteAddr().String(),
+			Caps:        caps,
+			ConnectedAt: dc.connectedAt,
+		})
+	})
+	return sessions
+}
+
+// kickSession closes the downstream connection with the specified ID. It
+// returns false if no such connection exists.
+func (u *user) kickSession(id uint64) bool {
+	for _, dc := range u.downstreamConns {
+		if dc.id == id {
+			dc.logger.Printf("session kicked")
+			dc.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// runClientExpiry periodically asks the user goroutine to expire clients.
+func (u *user) runClientExpiry() {
+	ticker := time.NewTicker(clientExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case u.events <- eventClientExpiry{}:
+			case <-u.done:
+				return
+			}
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// expireClients forgets about clients which haven't been seen for longer than
+// the server's client expiry delay.
+func (u *user) expireClients() {
+	if u.srv.Config().ClientExpiry <= 0 {
+		return
+	}
+
+	expiry := time.Now().Add(-u.srv.Config().ClientExpiry)
+	for _, net := range u.networks {
+		var expired []string
+		net.delivered.ForEachClient(func(clientName string) {
+			seen := net.delivered.LastSeen(clientName)
+			if seen.IsZero() || seen.After(expiry) || net.hasClient(clientName) {
+				return
+			}
+			expired = append(expired, clientName)
+		})
+
+		for _, clientName := range expired {
+			net.logger.Printf("expiring client %q, last seen %v", clientName, net.delivered.LastSeen(clientName))
+			net.forgetClient(clientName)
+		}
+	}
+}
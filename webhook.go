@@ -0,0 +1,304 @@
+package soju
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookEventHighlight    = "highlight"
+	webhookEventMessage      = "message"
+	webhookEventDisconnected = "disconnected"
+)
+
+var webhookEvents = []string{
+	webhookEventHighlight,
+	webhookEventMessage,
+	webhookEventDisconnected,
+}
+
+// TODO: make configurable
+var webhookTimeout = 15 * time.Second
+var webhookMaxAttempts = 5
+var webhookRetryDelay = 5 * time.Second // doubled after each failed attempt
+var webhookQueueSize = 64
+
+// webhookPayload is the JSON body of a webhook delivery.
+type webhookPayload struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Network string    `json:"network"`
+	Target  string    `json:"target,omitempty"`
+	Sender  string    `json:"sender,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func parseWebhookEvents(s string) ([]string, error) {
+	if s == "" || s == "*" {
+		return nil, nil
+	}
+
+	var events []string
+	for _, event := range strings.Split(s, ",") {
+		found := false
+		for _, name := range webhookEvents {
+			if event == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown webhook event %q", event)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func webhookWantsEvent(webhook *Webhook, event string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, e := range webhook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhookBody computes the hex-encoded HMAC-SHA256 signature of a body.
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookDelivery struct {
+	webhook Webhook
+	event   string
+	body    []byte
+}
+
+// webhookPrivateNets are the address ranges webhooks can't be delivered to,
+// in addition to loopback, link-local, multicast and unspecified addresses.
+// Otherwise users could make the bouncer send requests to services only
+// reachable from the bouncer host.
+var webhookPrivateNets = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(l ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range l {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// checkWebhookIP checks that webhooks can be delivered to an address.
+func checkWebhookIP(ip net.IP) error {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("webhooks can't be delivered to non-public address %v", ip)
+	}
+	for _, ipNet := range webhookPrivateNets {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("webhooks can't be delivered to private address %v", ip)
+		}
+	}
+	return nil
+}
+
+// newWebhookClient returns an HTTP client which refuses to connect to
+// non-public addresses. The check is performed when connecting, so that it
+// also applies to redirects and DNS names resolving to such addresses.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", address)
+			}
+			return checkWebhookIP(ip)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would bypass the address check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+var webhookClient = newWebhookClient()
+
+// webhookSender delivers webhooks from dedicated goroutines, so that slow
+// endpoints never block the user goroutine. Each webhook has its own queue,
+// so that a failing endpoint doesn't delay the others.
+type webhookSender struct {
+	logger Logger
+	client *http.Client
+	stop   chan struct{}
+	queues map[int64]chan webhookDelivery // indexed by webhook ID
+}
+
+func newWebhookSender(logger Logger, client *http.Client) *webhookSender {
+	return &webhookSender{
+		logger: logger,
+		client: client,
+		stop:   make(chan struct{}),
+		queues: make(map[int64]chan webhookDelivery),
+	}
+}
+
+func (ws *webhookSender) run(queue <-chan webhookDelivery) {
+	for {
+		select {
+		case <-ws.stop:
+			return
+		case d, ok := <-queue:
+			if !ok {
+				return
+			}
+			ws.deliver(&d)
+		}
+	}
+}
+
+func (ws *webhookSender) deliver(d *webhookDelivery) {
+	delay := webhookRetryDelay
+	for i := 1; ; i++ {
+		retry, err := ws.post(d)
+		if err == nil {
+			return
+		}
+		if !retry || i >= webhookMaxAttempts {
+			ws.logger.Errorf("failed to deliver webhook %v to %q: %v", d.event, d.webhook.URL, err)
+			return
+		}
+
+		select {
+		case <-ws.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (ws *webhookSender) post(d *webhookDelivery) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.webhook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "soju")
+	req.Header.Set("X-Soju-Event", d.event)
+	if d.webhook.Secret != "" {
+		req.Header.Set("X-Soju-Signature", "sha256="+signWebhookBody(d.webhook.Secret, d.body))
+	}
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("HTTP server error: %v", resp.Status)
+	default:
+		return false, fmt.Errorf("HTTP client error: %v", resp.Status)
+	}
+}
+
+// Enqueue schedules a delivery. It never blocks: if the queue of the webhook
+// is full, the delivery is dropped. It must be called from the user
+// goroutine.
+func (ws *webhookSender) Enqueue(d webhookDelivery) {
+	queue, ok := ws.queues[d.webhook.ID]
+	if !ok {
+		queue = make(chan webhookDelivery, webhookQueueSize)
+		ws.queues[d.webhook.ID] = queue
+		go ws.run(queue)
+	}
+
+	select {
+	case queue <- d:
+	default:
+		ws.logger.Printf("dropping webhook %v to %q: queue is full", d.event, d.webhook.URL)
+	}
+}
+
+// Remove stops delivering to a webhook once its queue is drained. It must be
+// called from the user goroutine.
+func (ws *webhookSender) Remove(id int64) {
+	if queue, ok := ws.queues[id]; ok {
+		close(queue)
+		delete(ws.queues, id)
+	}
+}
+
+// Close stops the sender goroutines. Pending deliveries are abandoned.
+func (ws *webhookSender) Close() {
+	close(ws.stop)
+}
+
+// notifyWebhooks sends an event to the user's webhooks subscribed to it.
+func (u *user) notifyWebhooks(payload *webhookPayload) {
+	if len(u.webhooks) == 0 {
+		return
+	}
+
+	payload.User = u.Username
+	if payload.Time.IsZero() {
+		payload.Time = time.Now()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		u.logger.Errorf("failed to marshal webhook payload: %v", err)
+		return
+	}
+
+	for _, webhook := range u.webhooks {
+		if !webhookWantsEvent(&webhook, payload.Event) {
+			continue
+		}
+		u.webhookSender.Enqueue(webhookDelivery{
+			webhook: webhook,
+			event:   payload.Event,
+			body:    body,
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package soju
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookSender(t *testing.T) {
+	oldDelay := webhookRetryDelay
+	webhookRetryDelay = time.Millisecond
+	defer func() { webhookRetryDelay = oldDelay }()
+
+	body := []byte(`{"event":"highlight"}`)
+	done := make(chan *http.Request, 1)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil || string(b) != string(body) {
+			t.Errorf("unexpected request body: %q (%v)", b, err)
+		}
+		done <- req
+	}))
+	defer srv.Close()
+
+	ws := newWebhookSender(NewLogWriter(ioutil.Discard).Logger(), srv.Client())
+	defer ws.Close()
+
+	ws.Enqueue(webhookDelivery{
+		webhook: Webhook{URL: srv.URL, Secret: "hunter2"},
+		event:   webhookEventHighlight,
+		body:    body,
+	})
+
+	select {
+	case req := <-done:
+		if got := req.Header.Get("X-Soju-Event"); got != webhookEventHighlight {
+			t.Errorf("X-Soju-Event = %q, want %q", got, webhookEventHighlight)
+		}
+		want := "sha256=" + signWebhookBody("hunter2", body)
+		if got := req.Header.Get("X-Soju-Signature"); got != want {
+			t.Errorf("X-Soju-Signature = %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook not delivered")
+	}
+}
+
+func TestWebhookClientPrivateAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request to private address")
+	}))
+	defer srv.Close()
+
+	resp, err := webhookClient.Post(srv.URL, "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("webhook client connected to %v", srv.URL)
+	}
+}
+
+func TestCheckWebhookIP(t *testing.T) {
+	testCases := []struct {
+		ip string
+		ok bool
+	}{
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+	}
+	for _, tc := range testCases {
+		err := checkWebhookIP(net.ParseIP(tc.ip))
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("checkWebhookIP(%v) = %v, want ok = %v", tc.ip, err, tc.ok)
+		}
+	}
+}